@@ -0,0 +1,304 @@
+// Package audit keeps an append-only, tamper evident log of tunnel
+// lifecycle events: who authenticated, which subdomain they got, when their
+// sessions started and ended and why they were cut off.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Event names.
+const (
+	AuthSuccess       = "auth_success"
+	AuthFailure       = "auth_failure"
+	SubdomainAssigned = "subdomain_assigned"
+	SessionStart      = "session_start"
+	SessionEnd        = "session_end"
+	ForceClose        = "force_close"
+	LimitBreach       = "limit_breach"
+)
+
+// Record is a single audit entry. Hash covers every other field including
+// Prev, the hash of the record before it, so that editing, removing or
+// reordering records breaks the chain.
+type Record struct {
+	Seq    uint64    `json:"seq"`
+	Time   time.Time `json:"time"`
+	Event  string    `json:"event"`
+	User   string    `json:"user,omitempty"`
+	Remote string    `json:"remote,omitempty"`
+	Host   string    `json:"host,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+	Prev   string    `json:"prev"`
+	Hash   string    `json:"hash"`
+}
+
+// computeHash returns the chain hash of r, ignoring r.Hash.
+func (r Record) computeHash() string {
+	r.Hash = ""
+	b, _ := json.Marshal(r)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// Sink receives a copy of every record once it is safely on disk.
+type Sink interface {
+	Write(Record) error
+}
+
+// Options configure a Logger.
+type Options struct {
+	Path    string // JSON lines file, rotated when it grows past MaxSize
+	MaxSize int64  // bytes, 0 disables rotation
+	Sinks   []Sink // optional remote copies (syslog, webhook...)
+}
+
+// Logger writes audit records. A nil *Logger discards everything, so
+// callers don't have to care whether auditing is enabled.
+type Logger struct {
+	mu   sync.Mutex
+	opts Options
+	f    *os.File
+	size int64
+	seq  uint64
+	last string
+
+	sinks chan Record
+	done  chan struct{}
+}
+
+// Open opens (or creates) the audit log at opts.Path and resumes its hash
+// chain.
+func Open(opts Options) (*Logger, error) {
+	seq, last, err := tail(opts.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(opts.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	l := &Logger{
+		opts: opts,
+		f:    f,
+		size: info.Size(),
+		seq:  seq,
+		last: last,
+		done: make(chan struct{}),
+	}
+	if len(opts.Sinks) > 0 {
+		l.sinks = make(chan Record, 1024)
+		go l.forward(l.sinks)
+	} else {
+		close(l.done)
+	}
+	return l, nil
+}
+
+// Log appends a record for event.
+func (l *Logger) Log(event, user, remote, host, detail string) {
+	if l == nil {
+		return
+	}
+	if err := l.write(Record{
+		Time:   time.Now().UTC(),
+		Event:  event,
+		User:   user,
+		Remote: remote,
+		Host:   host,
+		Detail: detail,
+	}); err != nil {
+		log.Println("--------- audit write failed:", err)
+	}
+}
+
+func (l *Logger) write(r Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		return fmt.Errorf("audit: log is closed")
+	}
+
+	l.seq++
+	r.Seq = l.seq
+	r.Prev = l.last
+	r.Hash = r.computeHash()
+
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if l.opts.MaxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.opts.MaxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := l.f.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		return err
+	}
+	if err := l.f.Sync(); err != nil {
+		return err
+	}
+	l.last = r.Hash
+
+	if l.sinks != nil {
+		select {
+		case l.sinks <- r:
+		default:
+			log.Println("--------- audit sink queue full, record", r.Seq, "only on disk")
+		}
+	}
+	return nil
+}
+
+// rename moves files aside on rotation, replaced in tests.
+var rename = os.Rename
+
+// rotate moves the current file aside. The chain carries on in the new file.
+// If the file cannot be moved, or the new one created, records keep going
+// to the current file and rotation is tried again on the next write.
+func (l *Logger) rotate() error {
+	// the file is closed first, it cannot be moved while open on Windows
+	if err := l.f.Close(); err != nil {
+		log.Println("--------- audit log close failed:", err)
+	}
+	rotated := fmt.Sprintf("%s.%s", l.opts.Path, time.Now().UTC().Format("20060102T150405.000000000"))
+	if err := rename(l.opts.Path, rotated); err != nil {
+		log.Println("--------- audit log rotation failed:", err)
+		return l.reopen(l.opts.Path, l.size)
+	}
+	if err := l.reopen(l.opts.Path, 0); err != nil {
+		log.Println("--------- audit log rotation failed:", err)
+		return l.reopen(rotated, l.size)
+	}
+	return nil
+}
+
+// reopen makes path, size bytes long, the file records are appended to.
+func (l *Logger) reopen(path string, size int64) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	l.f = f
+	l.size = size
+	return nil
+}
+
+func (l *Logger) forward(sinks <-chan Record) {
+	defer close(l.done)
+	for r := range sinks {
+		for _, s := range l.opts.Sinks {
+			if err := s.Write(r); err != nil {
+				log.Println("--------- audit sink failed:", err)
+			}
+		}
+	}
+}
+
+// Close flushes pending sink writes and closes the file. Closing it again
+// does nothing.
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	if l.f == nil && l.sinks == nil {
+		l.mu.Unlock()
+		return nil // already closed
+	}
+	f := l.f
+	l.f = nil
+	if l.sinks != nil {
+		close(l.sinks)
+		l.sinks = nil
+	}
+	l.mu.Unlock()
+
+	<-l.done
+	if f == nil {
+		return nil
+	}
+	return f.Close()
+}
+
+// tail returns the sequence number and hash of the last record in path.
+func tail(path string) (uint64, string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, "", nil
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+
+	var last []byte
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		if line := bytes.TrimSpace(sc.Bytes()); len(line) > 0 {
+			last = append(last[:0], line...)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return 0, "", err
+	}
+	if last == nil {
+		return 0, "", nil
+	}
+
+	var r Record
+	if err := json.Unmarshal(last, &r); err != nil {
+		return 0, "", fmt.Errorf("audit: corrupt last record in %s: %v", path, err)
+	}
+	return r.Seq, r.Hash, nil
+}
+
+// Verify checks the hash chain of the records read from r, starting after
+// the record whose hash is prev ("" for the very first file). It returns
+// the hash of the last record so rotated files can be verified in order.
+func Verify(r io.Reader, prev string) (string, error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; sc.Scan(); line++ {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		var rec Record
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			return prev, fmt.Errorf("audit: line %d: %v", line, err)
+		}
+		if rec.Prev != prev {
+			return prev, fmt.Errorf("audit: line %d (seq %d): chain broken", line, rec.Seq)
+		}
+		if rec.computeHash() != rec.Hash {
+			return prev, fmt.Errorf("audit: line %d (seq %d): record was modified", line, rec.Seq)
+		}
+		prev = rec.Hash
+	}
+	return prev, sc.Err()
+}
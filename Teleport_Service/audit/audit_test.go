@@ -0,0 +1,184 @@
+package audit
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type memorySink struct {
+	sync.Mutex
+	records []Record
+}
+
+func (s *memorySink) Write(r Record) error {
+	s.Lock()
+	s.records = append(s.records, r)
+	s.Unlock()
+	return nil
+}
+
+func verifyFile(t *testing.T, path, prev string) (string, error) {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	return Verify(f, prev)
+}
+
+func TestChainVerifies(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sink := &memorySink{}
+	l, err := Open(Options{Path: path, Sinks: []Sink{sink}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Log(AuthSuccess, "alice", "1.2.3.4:5555", "", "free")
+	l.Log(SubdomainAssigned, "alice", "", "teleport_alice_x.teleport.me", "")
+	l.Log(SessionStart, "alice", "", "teleport_alice_x.teleport.me", "")
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := verifyFile(t, path, ""); err != nil {
+		t.Fatalf("expected a valid chain: %v", err)
+	}
+	if len(sink.records) != 3 {
+		t.Fatalf("expected 3 records in the sink, got %d", len(sink.records))
+	}
+
+	// reopening resumes the chain
+	l, err = Open(Options{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Log(SessionEnd, "alice", "", "teleport_alice_x.teleport.me", "")
+	l.Close()
+	if _, err := verifyFile(t, path, ""); err != nil {
+		t.Fatalf("expected a valid chain after reopening: %v", err)
+	}
+}
+
+func TestTamperingIsDetected(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := Open(Options{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Log(AuthFailure, "mallory", "6.6.6.6:1", "", "bad password")
+	l.Log(AuthSuccess, "alice", "1.2.3.4:5555", "", "free")
+	l.Log(LimitBreach, "alice", "", "teleport_alice_x.teleport.me", "connection limit")
+	l.Close()
+
+	b, _ := os.ReadFile(path)
+	lines := strings.SplitAfter(string(b), "\n")
+
+	tests := map[string]string{
+		"modified": strings.Replace(string(b), "mallory", "nobody!", 1),
+		"removed":  lines[0] + lines[2],
+		"reorder":  lines[1] + lines[0] + lines[2],
+	}
+	for name, content := range tests {
+		if _, err := Verify(strings.NewReader(content), ""); err == nil {
+			t.Errorf("%s: tampering not detected", name)
+		}
+	}
+}
+
+func TestRotationKeepsChain(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.log")
+	l, err := Open(Options{Path: path, MaxSize: 512})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		l.Log(SessionStart, "alice", "", "teleport_alice_x.teleport.me", "")
+	}
+	l.Close()
+
+	rotated, _ := filepath.Glob(path + ".*")
+	if len(rotated) == 0 {
+		t.Fatal("expected the log to be rotated")
+	}
+	sort.Strings(rotated)
+
+	var buf bytes.Buffer
+	for _, name := range append(rotated, path) {
+		b, _ := os.ReadFile(name)
+		buf.Write(b)
+	}
+	if _, err := Verify(&buf, ""); err != nil {
+		t.Fatalf("chain broken across rotation: %v", err)
+	}
+}
+
+func TestNilLogger(t *testing.T) {
+	var l *Logger
+	l.Log(AuthSuccess, "alice", "", "", "")
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCloseTwice(t *testing.T) {
+	sink := &memorySink{}
+	l, err := Open(Options{Path: filepath.Join(t.TempDir(), "audit.log"), Sinks: []Sink{sink}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Log(SessionStart, "alice", "", "", "")
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// main's deferred Close after drainOnSignal's
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	l.Log(SessionEnd, "alice", "", "", "")
+}
+
+func TestFailedRotationKeepsLogging(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := Open(Options{Path: path, MaxSize: 512})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	rename = func(string, string) error { return errors.New("sharing violation") }
+	defer func() { rename = os.Rename }()
+	for i := 0; i < 20; i++ {
+		if err := l.write(Record{Event: SessionStart, User: "alice"}); err != nil {
+			t.Fatalf("record %d: %v", i, err)
+		}
+	}
+
+	// once it works again the log rotates as usual
+	rename = os.Rename
+	if err := l.write(Record{Event: SessionEnd, User: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	rotated, _ := filepath.Glob(path + ".*")
+	if len(rotated) != 1 {
+		t.Fatalf("expected one rotated file, got %v", rotated)
+	}
+	var buf bytes.Buffer
+	for _, name := range append(rotated, path) {
+		b, _ := os.ReadFile(name)
+		buf.Write(b)
+	}
+	if n := strings.Count(buf.String(), "\n"); n != 21 {
+		t.Fatalf("expected 21 records, got %d", n)
+	}
+	if _, err := Verify(&buf, ""); err != nil {
+		t.Fatalf("chain broken across the failed rotation: %v", err)
+	}
+}
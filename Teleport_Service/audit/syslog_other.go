@@ -0,0 +1,17 @@
+//go:build windows || plan9
+
+package audit
+
+import "errors"
+
+// SyslogSink is not available on this platform.
+type SyslogSink struct{}
+
+// NewSyslogSink always fails on this platform.
+func NewSyslogSink(tag string) (*SyslogSink, error) {
+	return nil, errors.New("audit: syslog is not supported on this platform")
+}
+
+func (s *SyslogSink) Write(r Record) error {
+	return errors.New("audit: syslog is not supported on this platform")
+}
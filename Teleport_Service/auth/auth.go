@@ -2,6 +2,7 @@ package auth
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -43,14 +44,14 @@ func SignInAndGetSubscriptionType(apiUrl string, signInData SignInDto) (string,
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("error sending request: %v", err)
+		return "", &UnreachableError{Op: "signin", Err: err}
 	}
 	defer resp.Body.Close()
 
 	// Check if the response status is 200 OK
 	if resp.StatusCode != http.StatusOK {
 		body, _ := ioutil.ReadAll(resp.Body)
-		return "", fmt.Errorf("error response from server: %s", string(body))
+		return "", &StatusError{Op: "signin", StatusCode: resp.StatusCode, Body: string(body)}
 	}
 
 	// Read the response body
@@ -108,12 +109,12 @@ func AddUserUrlDetails(apiUrl, token, userName, url, timepass string) error {
 	client := &http.Client{Timeout: 3 * time.Second}
 	resp, err := client.Do(req)
 	if err != nil {
-		return fmt.Errorf("error performing request: %v", err)
+		return &UnreachableError{Op: "add", Err: err}
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		return &StatusError{Op: "add", StatusCode: resp.StatusCode}
 	}
 
 	fmt.Println("User URL details added successfully.")
@@ -121,7 +122,7 @@ func AddUserUrlDetails(apiUrl, token, userName, url, timepass string) error {
 }
 
 // SendIncrementRequest sends a request to increment user details.
-func SendIncrementRequest(userName, url, apiUrl, token string) error {
+func SendIncrementRequest(ctx context.Context, userName, url, apiUrl, token string) error {
 	requestPayload := IncrementRequest{
 		UserName: userName,
 		Url:      url,
@@ -131,7 +132,7 @@ func SendIncrementRequest(userName, url, apiUrl, token string) error {
 		return fmt.Errorf("error marshalling JSON: %v", err)
 	}
 
-	req, err := http.NewRequest("POST", apiUrl+"/increment", bytes.NewBuffer(jsonPayload))
+	req, err := http.NewRequestWithContext(ctx, "POST", apiUrl+"/increment", bytes.NewBuffer(jsonPayload))
 	if err != nil {
 		return fmt.Errorf("error creating request: %v", err)
 	}
@@ -139,17 +140,47 @@ func SendIncrementRequest(userName, url, apiUrl, token string) error {
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", "Bearer "+token)
 
-	client := &http.Client{}
+	client := &http.Client{Timeout: 3 * time.Second}
 	resp, err := client.Do(req)
 	if err != nil {
-		return fmt.Errorf("error performing request: %v", err)
+		return &UnreachableError{Op: "increment", Err: err}
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		return &StatusError{Op: "increment", StatusCode: resp.StatusCode}
 	}
 
 	fmt.Println("Increment API call was successful.")
 	return nil
 }
+
+// UsageEvent is a single usage record reported to the details API.
+type UsageEvent struct {
+	Kind     string    `json:"kind"`
+	UserName string    `json:"userName"`
+	Url      string    `json:"url"`
+	Bytes    int64     `json:"bytes,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// Ping checks that the backend behind apiUrl answers HTTP at all. Any
+// response below 500 counts as reachable.
+func Ping(ctx context.Context, apiUrl string) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", apiUrl, nil)
+	if err != nil {
+		return fmt.Errorf("error creating request: %v", err)
+	}
+
+	client := &http.Client{Timeout: 3 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return &UnreachableError{Op: "ping", Err: err}
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		return &StatusError{Op: "ping", StatusCode: resp.StatusCode}
+	}
+	return nil
+}
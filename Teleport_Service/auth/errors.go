@@ -0,0 +1,51 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// StatusError is returned when the backend answers with anything other
+// than 200 OK.
+type StatusError struct {
+	Op         string
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	if e.Body != "" {
+		return fmt.Sprintf("auth: %s: unexpected status code %d: %s", e.Op, e.StatusCode, e.Body)
+	}
+	return fmt.Sprintf("auth: %s: unexpected status code %d", e.Op, e.StatusCode)
+}
+
+// UnreachableError is returned when the backend could not be reached at all
+// (DNS failure, refused connection, timeout...).
+type UnreachableError struct {
+	Op  string
+	Err error
+}
+
+func (e *UnreachableError) Error() string {
+	return fmt.Sprintf("auth: %s: backend unreachable: %v", e.Op, e.Err)
+}
+
+func (e *UnreachableError) Unwrap() error {
+	return e.Err
+}
+
+// IsRetryable reports whether err is worth retrying: the backend was
+// unreachable, or it answered with a 5xx or 429.
+func IsRetryable(err error) bool {
+	var unreachable *UnreachableError
+	if errors.As(err, &unreachable) {
+		return true
+	}
+	var status *StatusError
+	if errors.As(err, &status) {
+		return status.StatusCode >= 500 || status.StatusCode == http.StatusTooManyRequests
+	}
+	return false
+}
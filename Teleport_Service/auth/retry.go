@@ -0,0 +1,52 @@
+package auth
+
+import (
+	"context"
+	"time"
+)
+
+// Backoff describes how a backend call is retried.
+type Backoff struct {
+	Attempts int           // total number of tries, including the first one
+	Initial  time.Duration // delay before the first retry
+	Max      time.Duration // upper bound for a single delay
+}
+
+// DefaultBackoff is used for the details API.
+var DefaultBackoff = Backoff{
+	Attempts: 4,
+	Initial:  250 * time.Millisecond,
+	Max:      2 * time.Second,
+}
+
+// Retry calls fn until it succeeds, returns a non retryable error, the
+// attempts are exhausted or ctx is done. The delay doubles after every try.
+func (b Backoff) Retry(ctx context.Context, fn func() error) error {
+	delay := b.Initial
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = fn(); err == nil || !IsRetryable(err) || attempt >= b.Attempts {
+			return err
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+
+		delay *= 2
+		if delay > b.Max {
+			delay = b.Max
+		}
+	}
+}
+
+// AddUserUrlDetailsWithRetry is AddUserUrlDetails retried with b.
+func AddUserUrlDetailsWithRetry(ctx context.Context, b Backoff, apiUrl, token, userName, url, timepass string) error {
+	return b.Retry(ctx, func() error {
+		return AddUserUrlDetails(apiUrl, token, userName, url, timepass)
+	})
+}
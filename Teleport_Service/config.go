@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+///   *************************************** config loading ***************************************
+
+// Config is the server configuration. Every field can be set in the config
+// file under its json name, or through the TELEPORT_<NAME> environment
+// variable (apiUrlAuth -> TELEPORT_API_URL_AUTH). Fields tagged secret are
+// redacted when the config is printed.
+type Config struct {
+	Port           string `json:"port"`
+	Host           string `json:"host"`
+	UrlStyle       string `json:"urlStyle"`
+	Addr           string `json:"addr"`
+	ApiUrlAuth     string `json:"apiUrlAuth"`
+	ApiUrlDetails  string `json:"apiUrlDetails"`
+	Token          string `json:"token" secret:"true"`
+	TokenFile      string `json:"tokenFile"`
+	Free           int    `json:"free"`
+	Moderate       int    `json:"moderate"`
+	High           int    `json:"high"`
+	UsageSpool     string `json:"usageSpool"`
+	AuditLog       string `json:"auditLog"`
+	AuditMaxSize   int64  `json:"auditMaxSize"`
+	AuditWebhook   string `json:"auditWebhook" secret:"true"`
+	AuditSyslog    bool   `json:"auditSyslog"`
+	ManagementAddr string `json:"managementAddr"`
+	DrainSeconds   int    `json:"drainSeconds"`
+
+	ErrorPageTemplate string `json:"errorPageTemplate"`
+	ProxyProtocolFrom string `json:"proxyProtocolFrom"`
+
+	StripPrefix     bool `json:"stripPrefix"`
+	ForwardedPrefix bool `json:"forwardedPrefix"`
+
+	KeepaliveSeconds   int `json:"keepaliveSeconds"`
+	KeepaliveMaxMissed int `json:"keepaliveMaxMissed"`
+	IdleTimeoutMinutes int `json:"idleTimeoutMinutes"`
+
+	WindowSize    int64 `json:"windowSize"`
+	MaxWindowSize int64 `json:"maxWindowSize"`
+
+	AcceptQueueSize      int `json:"acceptQueueSize"`
+	AcceptTimeoutSeconds int `json:"acceptTimeoutSeconds"`
+
+	FreeUpgrades       int `json:"freeUpgrades"`
+	ModerateUpgrades   int `json:"moderateUpgrades"`
+	HighUpgrades       int `json:"highUpgrades"`
+	UpgradeIdleMinutes int `json:"upgradeIdleMinutes"`
+}
+
+const envPrefix = "TELEPORT_"
+
+// Public URL styles: a subdomain of host per tunnel, or a path prefix on
+// host itself for networks where wildcard DNS is not available.
+const (
+	urlStyleSubdomain = "subdomain"
+	urlStylePath      = "path"
+)
+
+// With the path URL style, StripPrefix removes the tunnel's prefix from the
+// requests before they reach the client, and ForwardedPrefix passes it in
+// X-Forwarded-Prefix; a local service mounted under the prefix wants
+// neither.
+
+// defaultConfig is what the server runs with before the config file and the
+// environment are applied.
+func defaultConfig() Config {
+	return Config{
+		Port:         "9999",
+		Addr:         "0.0.0.0",
+		UrlStyle:     urlStyleSubdomain,
+		Free:         2,
+		Moderate:     50,
+		High:         100,
+		UsageSpool:   "usage-spool.jsonl",
+		AuditMaxSize: 100 << 20,
+		DrainSeconds: 10,
+
+		StripPrefix:     true,
+		ForwardedPrefix: true,
+
+		KeepaliveSeconds:   15,
+		KeepaliveMaxMissed: 3,
+		IdleTimeoutMinutes: 60,
+
+		WindowSize:    2 << 20,
+		MaxWindowSize: 16 << 20,
+
+		AcceptQueueSize:      16,
+		AcceptTimeoutSeconds: 10,
+
+		FreeUpgrades:       5,
+		ModerateUpgrades:   50,
+		HighUpgrades:       100,
+		UpgradeIdleMinutes: 30,
+	}
+}
+
+// LoadConfig merges, in order, the defaults, the config file at path (if
+// any), the environment and the secret files, then validates the result.
+func LoadConfig(path string, environ []string) (Config, error) {
+	cfg := defaultConfig()
+
+	if path != "" {
+		if err := decodeConfigFile(path, &cfg); err != nil {
+			return cfg, err
+		}
+	}
+
+	if err := applyEnv(&cfg, environ); err != nil {
+		return cfg, err
+	}
+
+	if cfg.TokenFile != "" {
+		b, err := os.ReadFile(cfg.TokenFile)
+		if err != nil {
+			return cfg, fmt.Errorf("config: reading tokenFile: %v", err)
+		}
+		cfg.Token = strings.TrimSpace(string(b))
+	}
+
+	return cfg, cfg.Validate()
+}
+
+// decodeConfigFile reads a JSON, YAML or TOML file, picked by extension.
+// YAML and TOML are converted to JSON first so the json tags are the only
+// source of field names.
+func decodeConfigFile(path string, cfg *Config) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config: %v", err)
+	}
+
+	var generic map[string]interface{}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".json", "":
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(b, &generic); err != nil {
+			return fmt.Errorf("config: %s: %v", path, err)
+		}
+	case ".toml":
+		if err := toml.Unmarshal(b, &generic); err != nil {
+			return fmt.Errorf("config: %s: %v", path, err)
+		}
+	default:
+		return fmt.Errorf("config: %s: unsupported format %q (use .json, .yaml or .toml)", path, ext)
+	}
+	if generic != nil {
+		if b, err = json.Marshal(generic); err != nil {
+			return fmt.Errorf("config: %s: %v", path, err)
+		}
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return fmt.Errorf("config: %s: %v", path, err)
+	}
+	return nil
+}
+
+// envName turns a json field name into its environment variable.
+func envName(jsonName string) string {
+	var b strings.Builder
+	b.WriteString(envPrefix)
+	for i, r := range jsonName {
+		if unicode.IsUpper(r) && i > 0 {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+// applyEnv overrides cfg fields from TELEPORT_* variables.
+func applyEnv(cfg *Config, environ []string) error {
+	env := make(map[string]string, len(environ))
+	for _, kv := range environ {
+		if i := strings.IndexByte(kv, '='); i > 0 {
+			env[kv[:i]] = kv[i+1:]
+		}
+	}
+
+	v := reflect.ValueOf(cfg).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := envName(t.Field(i).Tag.Get("json"))
+		value, ok := env[name]
+		if !ok {
+			continue
+		}
+		field := v.Field(i)
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(value)
+		case reflect.Int, reflect.Int64:
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("config: %s: %q is not a number", name, value)
+			}
+			field.SetInt(n)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("config: %s: %q is not a boolean", name, value)
+			}
+			field.SetBool(b)
+		}
+	}
+	return nil
+}
+
+// Validate reports every problem with the config at once.
+func (c Config) Validate() error {
+	var errs []error
+	add := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("config: "+format, args...))
+	}
+
+	if err := validatePort(c.Port); err != nil {
+		add("port: %v", err)
+	}
+	if c.Host == "" {
+		add("host is required")
+	} else if strings.ContainsAny(c.Host, ":/ ") {
+		add("host: %q must be a bare domain name", c.Host)
+	}
+	if c.UrlStyle != urlStyleSubdomain && c.UrlStyle != urlStylePath {
+		add("urlStyle: %q must be %q or %q", c.UrlStyle, urlStyleSubdomain, urlStylePath)
+	} else if c.UrlStyle != urlStylePath && (!c.StripPrefix || !c.ForwardedPrefix) {
+		add("stripPrefix and forwardedPrefix only apply with urlStyle %q", urlStylePath)
+	}
+	if c.Addr != "" && net.ParseIP(c.Addr) == nil {
+		add("addr: %q is not an IP address", c.Addr)
+	}
+	if _, err := parseCIDRs(c.ProxyProtocolFrom); err != nil {
+		add("proxyProtocolFrom: %v", err)
+	}
+	if err := validateURL(c.ApiUrlAuth); err != nil {
+		add("apiUrlAuth: %v", err)
+	}
+	if err := validateURL(c.ApiUrlDetails); err != nil {
+		add("apiUrlDetails: %v", err)
+	}
+	if c.Token == "" {
+		add("token is required (set %s or tokenFile)", envName("token"))
+	}
+	if c.Free < 1 || c.Moderate < 1 || c.High < 1 {
+		add("tier limits must be at least 1 (free=%d moderate=%d high=%d)", c.Free, c.Moderate, c.High)
+	} else if c.Free > c.Moderate || c.Moderate > c.High {
+		add("tier limits must not decrease from free to high (free=%d moderate=%d high=%d)", c.Free, c.Moderate, c.High)
+	}
+	if c.AuditMaxSize < 0 {
+		add("auditMaxSize must not be negative")
+	}
+	if c.AuditWebhook != "" {
+		if err := validateURL(c.AuditWebhook); err != nil {
+			add("auditWebhook: %v", err)
+		}
+	}
+	if c.ManagementAddr != "" {
+		_, port, err := net.SplitHostPort(c.ManagementAddr)
+		if err == nil {
+			err = validatePort(port)
+		}
+		if err != nil {
+			add("managementAddr: %v", err)
+		}
+	}
+	if c.DrainSeconds < 0 {
+		add("drainSeconds must not be negative")
+	}
+	if c.KeepaliveSeconds < 0 || c.KeepaliveMaxMissed < 0 || c.IdleTimeoutMinutes < 0 {
+		add("keepaliveSeconds, keepaliveMaxMissed and idleTimeoutMinutes must not be negative")
+	}
+	if c.WindowSize < 0 || c.WindowSize > math.MaxUint32 || c.MaxWindowSize < 0 || c.MaxWindowSize > math.MaxUint32 {
+		add("windowSize and maxWindowSize must be between 0 and %d bytes", uint32(math.MaxUint32))
+	}
+	if c.AcceptQueueSize < 0 || c.AcceptTimeoutSeconds < 0 {
+		add("acceptQueueSize and acceptTimeoutSeconds must not be negative")
+	}
+	if c.FreeUpgrades < 1 || c.ModerateUpgrades < 1 || c.HighUpgrades < 1 {
+		add("upgrade limits must be at least 1 (freeUpgrades=%d moderateUpgrades=%d highUpgrades=%d)", c.FreeUpgrades, c.ModerateUpgrades, c.HighUpgrades)
+	} else if c.FreeUpgrades > c.ModerateUpgrades || c.ModerateUpgrades > c.HighUpgrades {
+		add("upgrade limits must not decrease from free to high (freeUpgrades=%d moderateUpgrades=%d highUpgrades=%d)", c.FreeUpgrades, c.ModerateUpgrades, c.HighUpgrades)
+	}
+	if c.UpgradeIdleMinutes < 0 {
+		add("upgradeIdleMinutes must not be negative")
+	}
+
+	return errors.Join(errs...)
+}
+
+func validatePort(port string) error {
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("%q is not a port between 1 and 65535", port)
+	}
+	return nil
+}
+
+// parseCIDRs parses a comma-separated list of networks, a bare IP standing
+// for itself.
+func parseCIDRs(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if ip := net.ParseIP(s); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an IP address or network", s)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func validateURL(raw string) error {
+	if raw == "" {
+		return errors.New("is required")
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%q is not an absolute http(s) URL", raw)
+	}
+	return nil
+}
+
+// Redacted returns the config as indented JSON with secrets masked.
+func (c Config) Redacted() string {
+	v := reflect.ValueOf(&c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("secret") == "true" && v.Field(i).String() != "" {
+			v.Field(i).SetString("REDACTED")
+		}
+	}
+	b, _ := json.MarshalIndent(c, "", "  ")
+	return string(b)
+}
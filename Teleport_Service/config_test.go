@@ -0,0 +1,132 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigFormats(t *testing.T) {
+	files := map[string]string{
+		"config.json": `{"host": "teleport.me", "apiUrlAuth": "http://auth:9090/auth", "apiUrlDetails": "http://auth:9090/details", "token": "t", "moderate": 20}`,
+		"config.yaml": "host: teleport.me\napiUrlAuth: http://auth:9090/auth\napiUrlDetails: http://auth:9090/details\ntoken: t\nmoderate: 20\n",
+		"config.toml": "host = \"teleport.me\"\napiUrlAuth = \"http://auth:9090/auth\"\napiUrlDetails = \"http://auth:9090/details\"\ntoken = \"t\"\nmoderate = 20\n",
+	}
+	for name, content := range files {
+		cfg, err := LoadConfig(writeFile(t, name, content), nil)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if cfg.Host != "teleport.me" || cfg.Moderate != 20 {
+			t.Fatalf("%s: unexpected config %+v", name, cfg)
+		}
+		// defaults fill in what the file leaves out
+		if cfg.Port != "9999" || cfg.Free != 2 || cfg.High != 100 {
+			t.Fatalf("%s: defaults not applied %+v", name, cfg)
+		}
+	}
+}
+
+func TestLoadConfigEnvAndSecretFile(t *testing.T) {
+	path := writeFile(t, "config.json", `{"host": "teleport.me", "apiUrlAuth": "http://auth/auth", "apiUrlDetails": "http://auth/details", "token": "from-file"}`)
+	tokenFile := writeFile(t, "token", "from-secret\n")
+
+	cfg, err := LoadConfig(path, []string{
+		"TELEPORT_PORT=8080",
+		"TELEPORT_API_URL_AUTH=https://auth.example.com/auth",
+		"TELEPORT_AUDIT_SYSLOG=true",
+		"TELEPORT_TOKEN=from-env",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Port != "8080" || cfg.ApiUrlAuth != "https://auth.example.com/auth" || !cfg.AuditSyslog || cfg.Token != "from-env" {
+		t.Fatalf("environment not applied %+v", cfg)
+	}
+
+	cfg, err = LoadConfig(path, []string{"TELEPORT_TOKEN_FILE=" + tokenFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Token != "from-secret" {
+		t.Fatalf("expected the token from the secret file, got %q", cfg.Token)
+	}
+}
+
+func TestLoadConfigValidation(t *testing.T) {
+	path := writeFile(t, "config.json", `{"port": "70000", "apiUrlAuth": "auth:9090", "free": 10, "moderate": 5, "managementAddr": "nope", "maxWindowSize": -1, "urlStyle": "query", "proxyProtocolFrom": "10.0.0.0/8, lb", "highUpgrades": 0}`)
+
+	_, err := LoadConfig(path, nil)
+	if err == nil {
+		t.Fatal("expected validation errors")
+	}
+	for _, want := range []string{"port", "host is required", "apiUrlAuth", "apiUrlDetails", "token is required", "tier limits", "managementAddr", "maxWindowSize", "urlStyle", "proxyProtocolFrom", "upgrade limits"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected an error about %q in:\n%v", want, err)
+		}
+	}
+
+	if _, err := LoadConfig(writeFile(t, "config.json", `{"tokn": "typo"}`), nil); err == nil {
+		t.Fatal("expected unknown keys to be rejected")
+	}
+	if _, err := LoadConfig(writeFile(t, "config.ini", ``), nil); err == nil {
+		t.Fatal("expected unsupported formats to be rejected")
+	}
+	if _, err := LoadConfig("", []string{"TELEPORT_FREE=lots"}); err == nil || !strings.Contains(err.Error(), "TELEPORT_FREE") {
+		t.Fatalf("expected a bad number error, got %v", err)
+	}
+}
+
+func TestLoadConfigPrefixOptions(t *testing.T) {
+	path := writeFile(t, "config.json", `{"host": "teleport.me", "apiUrlAuth": "http://auth/auth", "apiUrlDetails": "http://auth/details", "token": "t"}`)
+
+	cfg, err := LoadConfig(path, []string{"TELEPORT_URL_STYLE=path"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.StripPrefix || !cfg.ForwardedPrefix {
+		t.Fatalf("expected the prefix stripped and forwarded by default, got %+v", cfg)
+	}
+
+	// a local service mounted under the prefix keeps it
+	cfg, err = LoadConfig(path, []string{"TELEPORT_URL_STYLE=path", "TELEPORT_STRIP_PREFIX=false", "TELEPORT_FORWARDED_PREFIX=false"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.StripPrefix || cfg.ForwardedPrefix {
+		t.Fatalf("environment not applied %+v", cfg)
+	}
+
+	// they mean nothing with subdomains
+	_, err = LoadConfig(path, []string{"TELEPORT_STRIP_PREFIX=false"})
+	if err == nil || !strings.Contains(err.Error(), "stripPrefix") {
+		t.Fatalf("expected an error about stripPrefix, got %v", err)
+	}
+}
+
+func TestConfigRedacted(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Token = "super-secret-token"
+	cfg.AuditWebhook = "https://hooks.example.com/secret-path"
+
+	out := cfg.Redacted()
+	if strings.Contains(out, "super-secret-token") || strings.Contains(out, "secret-path") {
+		t.Fatalf("secrets leaked:\n%s", out)
+	}
+	if !strings.Contains(out, `"token": "REDACTED"`) {
+		t.Fatalf("expected the token to be redacted:\n%s", out)
+	}
+	if cfg.Token != "super-secret-token" {
+		t.Fatal("Redacted must not modify the config")
+	}
+}
@@ -5,7 +5,12 @@ go 1.20
 require (
 	github.com/progrium/qmux/golang v0.0.0-20210721211401-475935a675d8
 	golang.org/x/net v0.27.0
+)
 
+require (
+	github.com/BurntSushi/toml v1.4.0
+	golang.org/x/time v0.6.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
-require golang.org/x/time v0.6.0
+require golang.org/x/text v0.16.0 // indirect
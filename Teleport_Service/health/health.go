@@ -0,0 +1,136 @@
+// Package health serves liveness and readiness probes as JSON.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Check returns nil when whatever it checks is healthy.
+type Check func(ctx context.Context) error
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// Result is the outcome of a single check.
+type Result struct {
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// Report is the JSON body returned by the probes.
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]Result `json:"checks"`
+}
+
+// Checker holds the liveness and readiness checks of the process.
+type Checker struct {
+	timeout time.Duration
+
+	mu        sync.RWMutex
+	liveness  []namedCheck
+	readiness []namedCheck
+}
+
+// New returns a Checker running every probe within timeout.
+func New(timeout time.Duration) *Checker {
+	return &Checker{timeout: timeout}
+}
+
+// Live registers a liveness check. Liveness checks are part of readiness too.
+func (c *Checker) Live(name string, check Check) {
+	c.mu.Lock()
+	c.liveness = append(c.liveness, namedCheck{name, check})
+	c.mu.Unlock()
+}
+
+// Ready registers a readiness check.
+func (c *Checker) Ready(name string, check Check) {
+	c.mu.Lock()
+	c.readiness = append(c.readiness, namedCheck{name, check})
+	c.mu.Unlock()
+}
+
+// Liveness runs the liveness checks.
+func (c *Checker) Liveness(ctx context.Context) Report {
+	c.mu.RLock()
+	checks := append([]namedCheck(nil), c.liveness...)
+	c.mu.RUnlock()
+	return c.run(ctx, checks)
+}
+
+// Readiness runs the liveness and readiness checks.
+func (c *Checker) Readiness(ctx context.Context) Report {
+	c.mu.RLock()
+	checks := append(append([]namedCheck(nil), c.liveness...), c.readiness...)
+	c.mu.RUnlock()
+	return c.run(ctx, checks)
+}
+
+// run executes checks concurrently, each bounded by the checker timeout.
+func (c *Checker) run(ctx context.Context, checks []namedCheck) Report {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	report := Report{Status: "ok", Checks: make(map[string]Result, len(checks))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, nc := range checks {
+		wg.Add(1)
+		go func(nc namedCheck) {
+			defer wg.Done()
+			start := time.Now()
+			errc := make(chan error, 1)
+			go func() { errc <- nc.check(ctx) }()
+
+			var err error
+			select {
+			case err = <-errc:
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+
+			res := Result{Status: "ok", Duration: time.Since(start).String()}
+			if err != nil {
+				res.Status = "fail"
+				res.Error = err.Error()
+			}
+			mu.Lock()
+			report.Checks[nc.name] = res
+			if err != nil {
+				report.Status = "fail"
+			}
+			mu.Unlock()
+		}(nc)
+	}
+	wg.Wait()
+	return report
+}
+
+// Handler serves /healthz and /readyz.
+func (c *Checker) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeReport(w, c.Liveness(r.Context()))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeReport(w, c.Readiness(r.Context()))
+	})
+	return mux
+}
+
+func writeReport(w http.ResponseWriter, report Report) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if report.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,52 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func get(t *testing.T, h http.Handler, path string) (int, Report) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+	var report Report
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatalf("%s: invalid JSON: %v", path, err)
+	}
+	return rec.Code, report
+}
+
+func TestProbes(t *testing.T) {
+	c := New(50 * time.Millisecond)
+	c.Live("alive", func(ctx context.Context) error { return nil })
+	c.Ready("backend", func(ctx context.Context) error { return errors.New("connection refused") })
+	c.Ready("slow", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	h := c.Handler()
+
+	code, report := get(t, h, "/healthz")
+	if code != http.StatusOK || report.Status != "ok" || len(report.Checks) != 1 {
+		t.Fatalf("unexpected liveness %d %+v", code, report)
+	}
+
+	code, report = get(t, h, "/readyz")
+	if code != http.StatusServiceUnavailable || report.Status != "fail" {
+		t.Fatalf("unexpected readiness %d %+v", code, report)
+	}
+	if report.Checks["alive"].Status != "ok" {
+		t.Fatalf("liveness checks should be part of readiness: %+v", report)
+	}
+	if report.Checks["backend"].Error != "connection refused" {
+		t.Fatalf("unexpected backend result %+v", report.Checks["backend"])
+	}
+	if report.Checks["slow"].Status != "fail" {
+		t.Fatalf("slow check should time out: %+v", report.Checks["slow"])
+	}
+}
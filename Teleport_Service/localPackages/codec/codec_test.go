@@ -2,7 +2,13 @@ package codec
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"runtime"
 	"testing"
+	"testing/iotest"
 )
 
 func TestMarshalUnmarshal(t *testing.T) {
@@ -53,6 +59,24 @@ func TestMarshalUnmarshal(t *testing.T) {
 			},
 			out: &OpenFailureMessage{},
 		},
+		{
+			in: OpenMessage{
+				SenderID:      10,
+				WindowSize:    1024,
+				MaxPacketSize: 1 << 15,
+				Type:          "forwarded-tcpip",
+				Extra:         MarshalExtra(map[string]string{"host": "a.teleport.me"}),
+			},
+			out: &OpenMessage{},
+		},
+		{
+			in: OpenFailureMessage{
+				ChannelID:   20,
+				Reason:      ReasonConnectFailed,
+				Description: "dial tcp 127.0.0.1:3000: connection refused",
+			},
+			out: &OpenFailureMessage{},
+		},
 		{
 			in: WindowAdjustMessage{
 				ChannelID:       20,
@@ -60,6 +84,35 @@ func TestMarshalUnmarshal(t *testing.T) {
 			},
 			out: &WindowAdjustMessage{},
 		},
+		{
+			in: RequestMessage{
+				ID:        3,
+				Type:      "tunnel-expiring",
+				WantReply: true,
+				Payload:   []byte("600"),
+			},
+			out: &RequestMessage{},
+		},
+		{
+			in: ResponseMessage{
+				ID:      3,
+				OK:      true,
+				Payload: []byte("ack"),
+			},
+			out: &ResponseMessage{},
+		},
+		{
+			in: PingMessage{
+				ID: 1 << 40,
+			},
+			out: &PingMessage{},
+		},
+		{
+			in: PongMessage{
+				ID: 1 << 40,
+			},
+			out: &PongMessage{},
+		},
 	}
 	for _, test := range tests {
 		b, err := Marshal(test.in)
@@ -146,6 +199,20 @@ func TestEncodeDecode(t *testing.T) {
 			id: 20,
 			ok: true,
 		},
+		{
+			in: PingMessage{
+				ID: 7,
+			},
+			id: 0,
+			ok: false,
+		},
+		{
+			in: PongMessage{
+				ID: 7,
+			},
+			id: 0,
+			ok: false,
+		},
 	}
 	for _, test := range tests {
 		var buf bytes.Buffer
@@ -168,3 +235,292 @@ func TestEncodeDecode(t *testing.T) {
 	}
 
 }
+
+// testMessages returns one of each message, used as fuzz seeds.
+func testMessages() []Message {
+	return []Message{
+		OpenMessage{SenderID: 10, WindowSize: 1024, MaxPacketSize: 1 << 15},
+		OpenConfirmMessage{ChannelID: 20, SenderID: 10, WindowSize: 1024, MaxPacketSize: 1 << 15},
+		OpenFailureMessage{ChannelID: 20},
+		OpenMessage{SenderID: 11, WindowSize: 1024, MaxPacketSize: 1 << 15, Type: "session", Extra: []byte{1, 2, 3}},
+		OpenFailureMessage{ChannelID: 21, Reason: ReasonConnectFailed, Description: "connection refused"},
+		WindowAdjustMessage{ChannelID: 20, AdditionalBytes: 1024},
+		DataMessage{ChannelID: 10, Length: 5, Data: []byte("Hello")},
+		EOFMessage{ChannelID: 10},
+		CloseMessage{ChannelID: 10},
+		PingMessage{ID: 7},
+		PongMessage{ID: 7},
+		RequestMessage{ID: 1, Type: "status", WantReply: true, Payload: []byte("{}")},
+		ResponseMessage{ID: 1, OK: true},
+	}
+}
+
+func TestDecodeShortReads(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	for _, msg := range testMessages() {
+		if err := enc.Encode(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// one byte per Read, as a slow TCP or WebSocket connection may deliver
+	dec := NewDecoder(iotest.OneByteReader(&buf))
+	for _, want := range testMessages() {
+		got, err := dec.Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.String() != want.String() {
+			t.Fatalf("got %v, expected %v", got, want)
+		}
+	}
+	if _, err := dec.Decode(); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	data, _ := Marshal(DataMessage{ChannelID: 1, Length: 5, Data: []byte("Hello")})
+	huge, _ := Marshal(DataMessage{ChannelID: 1, Length: 1 << 30})
+
+	tests := []struct {
+		name  string
+		input []byte
+		check func(error) bool
+	}{
+		{"unknown type", []byte{42, 0, 0, 0, 0}, func(err error) bool {
+			var unknown UnknownMessageError
+			return errors.As(err, &unknown) && unknown.Type == 42
+		}},
+		{"truncated header", data[:4], func(err error) bool { return err == io.ErrUnexpectedEOF }},
+		{"truncated data", data[:len(data)-1], func(err error) bool { return err == io.ErrUnexpectedEOF }},
+		{"data too long", huge, func(err error) bool { return errors.Is(err, ErrDataTooLong) }},
+	}
+	for _, test := range tests {
+		_, err := NewDecoder(bytes.NewReader(test.input)).Decode()
+		if !test.check(err) {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		}
+	}
+
+	dec := NewDecoder(bytes.NewReader(data))
+	dec.MaxDataLength = 4
+	if _, err := dec.Decode(); !errors.Is(err, ErrDataTooLong) {
+		t.Errorf("expected MaxDataLength to be enforced, got %v", err)
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	for _, msg := range testMessages() {
+		b, err := Marshal(msg)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(b)
+	}
+	f.Add([]byte{msgChannelData, 0, 0, 0, 1, 0xff, 0xff, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		dec := NewDecoder(bytes.NewReader(b))
+		for {
+			m, err := dec.Decode()
+			if err != nil {
+				return
+			}
+			// whatever decodes must survive a round trip
+			bb, err := Marshal(m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m2, err := NewDecoder(bytes.NewReader(bb)).Decode()
+			if err != nil {
+				t.Fatalf("re-decoding %v: %v", m, err)
+			}
+			if m.String() != m2.String() {
+				t.Fatalf("round trip changed %v into %v", m, m2)
+			}
+		}
+	})
+}
+
+func FuzzUnmarshalMux(f *testing.F) {
+	for _, msg := range testMessages() {
+		b, err := Marshal(msg)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(b)
+	}
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		for _, out := range []Unmarshaler{
+			&OpenMessage{},
+			&OpenConfirmMessage{},
+			&OpenFailureMessage{},
+			&WindowAdjustMessage{},
+			&DataMessage{},
+			&EOFMessage{},
+			&CloseMessage{},
+			&PingMessage{},
+			&PongMessage{},
+			&RequestMessage{},
+			&ResponseMessage{},
+		} {
+			if err := Unmarshal(b, out); err != nil {
+				continue
+			}
+			bb, err := Marshal(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.HasPrefix(b, bb) {
+				t.Fatalf("%v: marshal does not reproduce its input", out)
+			}
+		}
+	})
+}
+
+func TestDecodePooledData(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	payloads := [][]byte{
+		bytes.Repeat([]byte("a"), 10),
+		bytes.Repeat([]byte("b"), 5000),
+		bytes.Repeat([]byte("c"), 10),
+		bytes.Repeat([]byte("d"), 1<<17), // above the largest size class
+	}
+	for _, p := range payloads {
+		if err := enc.EncodeData(3, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dec := NewDecoder(&buf)
+	dec.MaxDataLength = 1 << 18
+	for _, p := range payloads {
+		m, err := dec.Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := m.(*DataMessage)
+		if msg.ChannelID != 3 || msg.Length != uint32(len(p)) || !bytes.Equal(msg.Data, p) {
+			t.Fatalf("unexpected message %v", msg)
+		}
+		msg.Release()
+		msg.Release() // a second release is a no-op
+	}
+}
+
+func TestExtra(t *testing.T) {
+	kv := map[string]string{"remote-addr": "1.2.3.4:5555", "host": "a.teleport.me", "empty": ""}
+	got, err := UnmarshalExtra(MarshalExtra(kv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(kv) {
+		t.Fatalf("got %v, expected %v", got, kv)
+	}
+	for k, v := range kv {
+		if got[k] != v {
+			t.Fatalf("got %v, expected %v", got, kv)
+		}
+	}
+
+	for _, bad := range [][]byte{{0, 0}, {0, 0, 0, 9, 'a'}, {0, 0, 0, 1, 'k'}} {
+		if _, err := UnmarshalExtra(bad); err == nil {
+			t.Errorf("expected an error for %v", bad)
+		}
+	}
+}
+
+func TestOpenMetadataBounds(t *testing.T) {
+	_, err := Marshal(OpenMessage{Type: "x", Extra: make([]byte, MaxOpenMetadataLength)})
+	if !errors.Is(err, ErrOpenMetadataTooLong) {
+		t.Fatalf("expected ErrOpenMetadataTooLong, got %v", err)
+	}
+
+	b, _ := Marshal(OpenMessage{Type: "x"})
+	b[17], b[18] = 0xff, 0xff // extra length
+	if _, err := NewDecoder(bytes.NewReader(b)).Decode(); !errors.Is(err, ErrOpenMetadataTooLong) {
+		t.Fatalf("expected ErrOpenMetadataTooLong, got %v", err)
+	}
+
+	_, err = Marshal(OpenFailureMessage{Reason: ReasonConnectFailed, Description: string(make([]byte, MaxDescriptionLength+1))})
+	if !errors.Is(err, ErrDescriptionTooLong) {
+		t.Fatalf("expected ErrDescriptionTooLong, got %v", err)
+	}
+	b, _ = Marshal(OpenFailureMessage{Reason: ReasonConnectFailed})
+	b[11] = 0xff // description length
+	if _, err := NewDecoder(bytes.NewReader(b)).Decode(); !errors.Is(err, ErrDescriptionTooLong) {
+		t.Fatalf("expected ErrDescriptionTooLong, got %v", err)
+	}
+}
+
+// reportAllocsPerMB runs fn b.N times, each call moving perOp bytes, and
+// reports the heap allocations made per megabyte moved.
+func reportAllocsPerMB(b *testing.B, perOp int, fn func()) {
+	b.Helper()
+	b.SetBytes(int64(perOp))
+	b.ReportAllocs()
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		fn()
+	}
+	b.StopTimer()
+	runtime.ReadMemStats(&after)
+
+	mb := float64(perOp) * float64(b.N) / (1 << 20)
+	b.ReportMetric(float64(after.Mallocs-before.Mallocs)/mb, "allocs/MB")
+}
+
+func BenchmarkEncodeData(b *testing.B) {
+	for _, size := range []int{1 << 10, 1 << 15} {
+		data := make([]byte, size)
+		enc := NewEncoder(ioutil.Discard)
+
+		// Encode is the generic path, which boxes the message
+		b.Run(fmt.Sprintf("Encode/%d", size), func(b *testing.B) {
+			reportAllocsPerMB(b, size, func() {
+				if err := enc.Encode(DataMessage{ChannelID: 1, Length: uint32(size), Data: data}); err != nil {
+					b.Fatal(err)
+				}
+			})
+		})
+		b.Run(fmt.Sprintf("EncodeData/%d", size), func(b *testing.B) {
+			reportAllocsPerMB(b, size, func() {
+				if err := enc.EncodeData(1, data); err != nil {
+					b.Fatal(err)
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkDecodeData(b *testing.B) {
+	const frames = 32
+	var stream bytes.Buffer
+	enc := NewEncoder(&stream)
+	data := make([]byte, 1<<15)
+	for i := 0; i < frames; i++ {
+		enc.Encode(DataMessage{ChannelID: 1, Length: uint32(len(data)), Data: data})
+	}
+	r := bytes.NewReader(stream.Bytes())
+	dec := NewDecoder(r)
+
+	n := 0
+	reportAllocsPerMB(b, len(data), func() {
+		if n%frames == 0 {
+			r.Reset(stream.Bytes())
+		}
+		n++
+		m, err := dec.Decode()
+		if err != nil {
+			b.Fatal(err)
+		}
+		m.(*DataMessage).Release()
+	})
+}
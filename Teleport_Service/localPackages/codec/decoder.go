@@ -10,9 +10,50 @@ import (
 	"syscall"
 )
 
+// DefaultMaxDataLength bounds the payload of a DataMessage read from the
+// wire, so a corrupt or hostile length field cannot make the decoder
+// allocate gigabytes.
+const DefaultMaxDataLength = 1 << 20
+
+var (
+	// ErrDataTooLong is returned when a DataMessage announces more data
+	// than the decoder accepts.
+	ErrDataTooLong = errors.New("qmux: data message exceeds maximum length")
+
+	// ErrShortPacket is returned when a packet is too short for its type.
+	ErrShortPacket = errors.New("qmux: packet too short")
+
+	// ErrOpenMetadataTooLong is returned for an OpenMessage whose Type and
+	// Extra exceed MaxOpenMetadataLength.
+	ErrOpenMetadataTooLong = errors.New("qmux: open metadata exceeds maximum length")
+
+	// ErrDescriptionTooLong is returned for an OpenFailureMessage whose
+	// Description exceeds MaxDescriptionLength.
+	ErrDescriptionTooLong = errors.New("qmux: open failure description exceeds maximum length")
+
+	// ErrRequestTooLong is returned for a RequestMessage or ResponseMessage
+	// larger than MaxRequestLength.
+	ErrRequestTooLong = errors.New("qmux: request exceeds maximum length")
+)
+
+// UnknownMessageError is returned for a message type the codec does not know.
+type UnknownMessageError struct {
+	Type byte
+}
+
+func (e UnknownMessageError) Error() string {
+	return fmt.Sprintf("qmux: unexpected message type %d", e.Type)
+}
+
 type Decoder struct {
 	r io.Reader
 	sync.Mutex
+
+	// MaxDataLength is the largest DataMessage payload accepted, 0 means
+	// DefaultMaxDataLength. Set it before the first call to Decode.
+	MaxDataLength uint32
+
+	header []byte // fixed part of the packet being read
 }
 
 func NewDecoder(r io.Reader) *Decoder {
@@ -23,61 +64,146 @@ func (dec *Decoder) Decode() (Message, error) {
 	dec.Lock()
 	defer dec.Unlock()
 
-	packet, err := readPacket(dec.r)
+	packet, data, err := dec.readPacket()
 	if err != nil {
 		return nil, err
 	}
 
 	if DebugBytes != nil {
-		fmt.Fprintln(DebugBytes, ">>DEC", packet)
+		if data != nil {
+			fmt.Fprintln(DebugBytes, ">>DEC", packet, data.Data)
+		} else {
+			fmt.Fprintln(DebugBytes, ">>DEC", packet)
+		}
 	}
 
+	if data != nil {
+		if DebugMessages != nil {
+			fmt.Fprintln(DebugMessages, ">>DEC", data)
+		}
+		return data, nil
+	}
 	return decode(packet)
 }
 
-func readPacket(c io.Reader) ([]byte, error) {
-	msgNum := make([]byte, 1)
-	_, err := c.Read(msgNum)
-	if err != nil {
+func (dec *Decoder) maxDataLength() uint32 {
+	if dec.MaxDataLength == 0 {
+		return DefaultMaxDataLength
+	}
+	return dec.MaxDataLength
+}
+
+// readPacket reads exactly one packet. Partial reads are retried until the
+// whole packet is in, and a connection that ends mid-packet yields
+// io.ErrUnexpectedEOF rather than a truncated packet.
+//
+// The fixed part of the packet is read into dec.header and is only valid
+// until the next call. For a DataMessage the payload is read straight into
+// a pooled message, which is returned as well.
+func (dec *Decoder) readPacket() ([]byte, *DataMessage, error) {
+	if dec.header == nil {
+		dec.header = make([]byte, 1+maxPayloadSize)
+	}
+
+	if _, err := io.ReadFull(dec.r, dec.header[:1]); err != nil {
 		var syscallErr *os.SyscallError
 		if errors.As(err, &syscallErr) && syscallErr.Err == syscall.ECONNRESET {
-			return nil, io.EOF
+			return nil, nil, io.EOF
 		}
-		return nil, err
+		return nil, nil, err
 	}
 
-	rest := make([]byte, payloadSizes[msgNum[0]])
-	_, err = c.Read(rest)
-	if err != nil {
-		return nil, err
+	size, ok := payloadSizes[dec.header[0]]
+	if !ok {
+		return nil, nil, UnknownMessageError{Type: dec.header[0]}
 	}
 
-	packet := append(msgNum, rest...)
+	packet := dec.header[:1+size]
+	if _, err := io.ReadFull(dec.r, packet[1:]); err != nil {
+		return nil, nil, unexpectedEOF(err)
+	}
 
-	if msgNum[0] == msgChannelData {
-		dataSize := binary.BigEndian.Uint32(rest[4:8])
-		data := make([]byte, dataSize)
-		_, err := c.Read(data)
-		if err != nil {
-			return nil, err
-		}
+	switch packet[0] {
+	case msgChannelOpenExt:
+		tail := uint64(binary.BigEndian.Uint32(packet[13:17])) + uint64(binary.BigEndian.Uint32(packet[17:21]))
+		packet, err := dec.readTail(packet, tail, MaxOpenMetadataLength, ErrOpenMetadataTooLong)
+		return packet, nil, err
+	case msgChannelOpenFailureExt:
+		tail := uint64(binary.BigEndian.Uint32(packet[9:13]))
+		packet, err := dec.readTail(packet, tail, MaxDescriptionLength, ErrDescriptionTooLong)
+		return packet, nil, err
+	case msgRequest:
+		tail := uint64(binary.BigEndian.Uint32(packet[6:10])) + uint64(binary.BigEndian.Uint32(packet[10:14]))
+		packet, err := dec.readTail(packet, tail, MaxRequestLength, ErrRequestTooLong)
+		return packet, nil, err
+	case msgResponse:
+		tail := uint64(binary.BigEndian.Uint32(packet[6:10]))
+		packet, err := dec.readTail(packet, tail, MaxRequestLength, ErrRequestTooLong)
+		return packet, nil, err
+	case msgChannelData:
+	default:
+		return packet, nil, nil
+	}
 
-		packet = append(packet, data...)
+	dataSize := binary.BigEndian.Uint32(packet[5:9])
+	if dataSize > dec.maxDataLength() {
+		return nil, nil, fmt.Errorf("%w: %d > %d", ErrDataTooLong, dataSize, dec.maxDataLength())
 	}
+	msg := getDataMessage(dataSize)
+	msg.ChannelID = binary.BigEndian.Uint32(packet[1:5])
+	if _, err := io.ReadFull(dec.r, msg.Data); err != nil {
+		msg.Release()
+		return nil, nil, unexpectedEOF(err)
+	}
+	return packet, msg, nil
+}
 
+// readTail reads the variable part of size tail that follows the fixed
+// header of an extended message, and returns the whole packet in a new
+// slice. A tail above limit fails with errTooLong.
+func (dec *Decoder) readTail(header []byte, tail uint64, limit int, errTooLong error) ([]byte, error) {
+	if tail > uint64(limit) {
+		return nil, fmt.Errorf("%w: %d > %d", errTooLong, tail, limit)
+	}
+	packet := make([]byte, len(header)+int(tail))
+	copy(packet, header)
+	if _, err := io.ReadFull(dec.r, packet[len(header):]); err != nil {
+		return nil, unexpectedEOF(err)
+	}
 	return packet, nil
 }
 
+// unexpectedEOF turns a clean EOF in the middle of a packet into
+// io.ErrUnexpectedEOF.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// checkPacket verifies that b holds at least the fixed part of a packet of
+// type typ.
+func checkPacket(b []byte, typ byte) error {
+	if len(b) < payloadSizes[typ]+1 {
+		return ErrShortPacket
+	}
+	if b[0] != typ {
+		return fmt.Errorf("qmux: expected message type %d, got %d", typ, b[0])
+	}
+	return nil
+}
+
 func decode(packet []byte) (Message, error) {
 	var msg Message
 	switch packet[0] {
-	case msgChannelOpen:
+	case msgChannelOpen, msgChannelOpenExt:
 		msg = new(OpenMessage)
 	case msgChannelData:
 		msg = new(DataMessage)
 	case msgChannelOpenConfirm:
 		msg = new(OpenConfirmMessage)
-	case msgChannelOpenFailure:
+	case msgChannelOpenFailure, msgChannelOpenFailureExt:
 		msg = new(OpenFailureMessage)
 	case msgChannelWindowAdjust:
 		msg = new(WindowAdjustMessage)
@@ -85,8 +211,16 @@ func decode(packet []byte) (Message, error) {
 		msg = new(EOFMessage)
 	case msgChannelClose:
 		msg = new(CloseMessage)
+	case msgPing:
+		msg = new(PingMessage)
+	case msgPong:
+		msg = new(PongMessage)
+	case msgRequest:
+		msg = new(RequestMessage)
+	case msgResponse:
+		msg = new(ResponseMessage)
 	default:
-		return nil, fmt.Errorf("qmux: unexpected message type %d", packet[0])
+		return nil, UnknownMessageError{Type: packet[0]}
 	}
 	if err := Unmarshal(packet, msg); err != nil {
 		return nil, err
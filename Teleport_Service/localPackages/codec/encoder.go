@@ -1,14 +1,26 @@
 package codec
 
 import (
+	"encoding/binary"
 	"fmt"
 	"io"
+	"net"
 	"sync"
 )
 
+// coalesceLimit is the largest payload EncodeData copies behind its header
+// to send in a single Write. Bigger payloads go out as net.Buffers, which
+// is a single writev on TCP connections, instead of being copied.
+const coalesceLimit = 2048
+
 type Encoder struct {
 	w io.Writer
 	sync.Mutex
+
+	// reused by EncodeData so that sending data does not allocate
+	scratch []byte
+	vec     [2][]byte
+	bufs    net.Buffers
 }
 
 func NewEncoder(w io.Writer) *Encoder {
@@ -23,6 +35,10 @@ func (enc *Encoder) Encode(msg interface{}) error {
 		fmt.Fprintln(DebugMessages, "<<ENC", msg)
 	}
 
+	if m, ok := msg.(DataMessage); ok {
+		return enc.encodeData(m.ChannelID, m.Data)
+	}
+
 	b, err := Marshal(msg)
 	if err != nil {
 		return err
@@ -47,3 +63,40 @@ func Marshal(v interface{}) ([]byte, error) {
 	}
 	return m.MarshalMux()
 }
+
+// EncodeData writes a DataMessage carrying data on channelID. It is
+// equivalent to Encode(DataMessage{...}) but does not allocate.
+func (enc *Encoder) EncodeData(channelID uint32, data []byte) error {
+	enc.Lock()
+	defer enc.Unlock()
+
+	if DebugMessages != nil {
+		fmt.Fprintln(DebugMessages, "<<ENC", DataMessage{ChannelID: channelID, Length: uint32(len(data))})
+	}
+	return enc.encodeData(channelID, data)
+}
+
+func (enc *Encoder) encodeData(channelID uint32, data []byte) error {
+	if enc.scratch == nil {
+		enc.scratch = make([]byte, 0, 1+payloadSizes[msgChannelData]+coalesceLimit)
+	}
+	header := enc.scratch[:1+payloadSizes[msgChannelData]]
+	header[0] = msgChannelData
+	binary.BigEndian.PutUint32(header[1:5], channelID)
+	binary.BigEndian.PutUint32(header[5:9], uint32(len(data)))
+
+	if DebugBytes != nil {
+		fmt.Fprintln(DebugBytes, "<<ENC", append(header[:len(header):len(header)], data...))
+	}
+
+	if len(data) <= coalesceLimit {
+		_, err := enc.w.Write(append(header, data...))
+		return err
+	}
+
+	enc.vec[0], enc.vec[1] = header, data
+	enc.bufs = enc.vec[:]
+	_, err := enc.bufs.WriteTo(enc.w)
+	enc.vec[1] = nil
+	return err
+}
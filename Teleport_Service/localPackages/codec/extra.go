@@ -0,0 +1,63 @@
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+var errBadExtra = errors.New("qmux: malformed key/value extra data")
+
+// MarshalExtra encodes kv as the Extra of an OpenMessage: every key and
+// value as a uint32 length followed by its bytes, keys in sorted order.
+func MarshalExtra(kv map[string]string) []byte {
+	keys := make([]string, 0, len(kv))
+	size := 0
+	for k, v := range kv {
+		keys = append(keys, k)
+		size += 8 + len(k) + len(v)
+	}
+	sort.Strings(keys)
+
+	b := make([]byte, 0, size)
+	for _, k := range keys {
+		b = appendString(b, k)
+		b = appendString(b, kv[k])
+	}
+	return b
+}
+
+// UnmarshalExtra decodes Extra data written by MarshalExtra.
+func UnmarshalExtra(b []byte) (map[string]string, error) {
+	kv := make(map[string]string)
+	for len(b) > 0 {
+		k, rest, ok := readString(b)
+		if !ok {
+			return nil, errBadExtra
+		}
+		v, rest, ok := readString(rest)
+		if !ok {
+			return nil, errBadExtra
+		}
+		kv[k] = v
+		b = rest
+	}
+	return kv, nil
+}
+
+func appendString(b []byte, s string) []byte {
+	var n [4]byte
+	binary.BigEndian.PutUint32(n[:], uint32(len(s)))
+	return append(append(b, n[:]...), s...)
+}
+
+func readString(b []byte) (string, []byte, bool) {
+	if len(b) < 4 {
+		return "", nil, false
+	}
+	n := binary.BigEndian.Uint32(b)
+	if uint64(n) > uint64(len(b)-4) {
+		return "", nil, false
+	}
+	return string(b[4 : 4+n]), b[4+n:], true
+}
@@ -8,6 +8,12 @@ const (
 	msgChannelData
 	msgChannelEOF
 	msgChannelClose
+	msgPing
+	msgPong
+	msgChannelOpenExt
+	msgChannelOpenFailureExt
+	msgRequest
+	msgResponse
 )
 
 var (
@@ -19,7 +25,26 @@ var (
 		msgChannelData:         8,
 		msgChannelEOF:          4,
 		msgChannelClose:        4,
+		msgPing:                8,
+		msgPong:                8,
+
+		// extended formats, see OpenMessage and OpenFailureMessage
+		msgChannelOpenExt:        20,
+		msgChannelOpenFailureExt: 12,
+		msgRequest:               13,
+		msgResponse:              9,
 	}
+
+	// maxPayloadSize is the largest fixed payload in payloadSizes.
+	maxPayloadSize = func() int {
+		max := 0
+		for _, size := range payloadSizes {
+			if size > max {
+				max = size
+			}
+		}
+		return max
+	}()
 )
 
 type Message interface {
@@ -25,6 +25,9 @@ func (msg CloseMessage) MarshalMux() ([]byte, error) {
 }
 
 func (msg *CloseMessage) UnmarshalMux(b []byte) error {
+	if err := checkPacket(b, msgChannelClose); err != nil {
+		return err
+	}
 	msg.ChannelID = binary.BigEndian.Uint32(b[1:5])
 	return nil
 }
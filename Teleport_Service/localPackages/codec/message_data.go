@@ -9,6 +9,8 @@ type DataMessage struct {
 	ChannelID uint32
 	Length    uint32
 	Data      []byte
+
+	pooled bool // Data belongs to dataPools, see Release
 }
 
 func (msg DataMessage) String() string {
@@ -29,8 +31,14 @@ func (msg DataMessage) MarshalMux() ([]byte, error) {
 }
 
 func (msg *DataMessage) UnmarshalMux(b []byte) error {
+	if err := checkPacket(b, msgChannelData); err != nil {
+		return err
+	}
 	msg.ChannelID = binary.BigEndian.Uint32(b[1:5])
 	msg.Length = binary.BigEndian.Uint32(b[5:9])
 	msg.Data = b[9:]
+	if uint32(len(msg.Data)) != msg.Length {
+		return fmt.Errorf("qmux: data length %d does not match header %d", len(msg.Data), msg.Length)
+	}
 	return nil
 }
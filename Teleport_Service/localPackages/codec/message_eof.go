@@ -25,6 +25,9 @@ func (msg EOFMessage) MarshalMux() ([]byte, error) {
 }
 
 func (msg *EOFMessage) UnmarshalMux(b []byte) error {
+	if err := checkPacket(b, msgChannelEOF); err != nil {
+		return err
+	}
 	msg.ChannelID = binary.BigEndian.Uint32(b[1:5])
 	return nil
 }
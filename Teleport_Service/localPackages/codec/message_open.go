@@ -2,36 +2,102 @@ package codec
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 )
 
+// MaxOpenMetadataLength bounds the Type and Extra of an OpenMessage
+// together.
+const MaxOpenMetadataLength = 64 << 10
+
+// OpenMessage asks the peer to open a channel. Type and Extra describe the
+// channel, like the channel type and type-specific data of an SSH channel
+// open; Extra is often a key/value list built with MarshalExtra.
+//
+// An OpenMessage without Type or Extra is sent in the original format.
+// With them it is sent as msgChannelOpenExt, which peers that predate it
+// cannot decode, so it must only be sent to peers known to support it.
 type OpenMessage struct {
 	SenderID      uint32
 	WindowSize    uint32
 	MaxPacketSize uint32
+	Type          string
+	Extra         []byte
 }
 
 func (msg OpenMessage) String() string {
-	return fmt.Sprintf("{OpenMessage SenderID:%d WindowSize:%d MaxPacketSize:%d}",
-		msg.SenderID, msg.WindowSize, msg.MaxPacketSize)
+	return fmt.Sprintf("{OpenMessage SenderID:%d WindowSize:%d MaxPacketSize:%d Type:%q Extra:%d bytes}",
+		msg.SenderID, msg.WindowSize, msg.MaxPacketSize, msg.Type, len(msg.Extra))
 }
 
 func (msg OpenMessage) Channel() (uint32, bool) {
 	return 0, false
 }
 
+// extended reports whether msg needs the msgChannelOpenExt format.
+func (msg OpenMessage) extended() bool {
+	return msg.Type != "" || len(msg.Extra) > 0
+}
+
 func (msg OpenMessage) MarshalMux() ([]byte, error) {
-	packet := make([]byte, payloadSizes[msgChannelOpen]+1)
-	packet[0] = msgChannelOpen
+	if !msg.extended() {
+		packet := make([]byte, payloadSizes[msgChannelOpen]+1)
+		packet[0] = msgChannelOpen
+		binary.BigEndian.PutUint32(packet[1:5], msg.SenderID)
+		binary.BigEndian.PutUint32(packet[5:9], msg.WindowSize)
+		binary.BigEndian.PutUint32(packet[9:13], msg.MaxPacketSize)
+		return packet, nil
+	}
+
+	if len(msg.Type)+len(msg.Extra) > MaxOpenMetadataLength {
+		return nil, ErrOpenMetadataTooLong
+	}
+	size := payloadSizes[msgChannelOpenExt] + 1
+	packet := make([]byte, size, size+len(msg.Type)+len(msg.Extra))
+	packet[0] = msgChannelOpenExt
 	binary.BigEndian.PutUint32(packet[1:5], msg.SenderID)
 	binary.BigEndian.PutUint32(packet[5:9], msg.WindowSize)
 	binary.BigEndian.PutUint32(packet[9:13], msg.MaxPacketSize)
-	return packet, nil
+	binary.BigEndian.PutUint32(packet[13:17], uint32(len(msg.Type)))
+	binary.BigEndian.PutUint32(packet[17:21], uint32(len(msg.Extra)))
+	packet = append(packet, msg.Type...)
+	return append(packet, msg.Extra...), nil
 }
 
 func (msg *OpenMessage) UnmarshalMux(b []byte) error {
+	if len(b) > 0 && b[0] == msgChannelOpenExt {
+		return msg.unmarshalExt(b)
+	}
+	if err := checkPacket(b, msgChannelOpen); err != nil {
+		return err
+	}
+	msg.SenderID = binary.BigEndian.Uint32(b[1:5])
+	msg.WindowSize = binary.BigEndian.Uint32(b[5:9])
+	msg.MaxPacketSize = binary.BigEndian.Uint32(b[9:13])
+	msg.Type, msg.Extra = "", nil
+	return nil
+}
+
+func (msg *OpenMessage) unmarshalExt(b []byte) error {
+	if err := checkPacket(b, msgChannelOpenExt); err != nil {
+		return err
+	}
+	typeLen := binary.BigEndian.Uint32(b[13:17])
+	extraLen := binary.BigEndian.Uint32(b[17:21])
+	rest := b[payloadSizes[msgChannelOpenExt]+1:]
+	if uint64(typeLen)+uint64(extraLen) != uint64(len(rest)) {
+		return fmt.Errorf("qmux: open metadata length %d does not match header %d+%d", len(rest), typeLen, extraLen)
+	}
+	if typeLen == 0 && extraLen == 0 {
+		return errors.New("qmux: extended open without metadata")
+	}
 	msg.SenderID = binary.BigEndian.Uint32(b[1:5])
 	msg.WindowSize = binary.BigEndian.Uint32(b[5:9])
 	msg.MaxPacketSize = binary.BigEndian.Uint32(b[9:13])
+	msg.Type = string(rest[:typeLen])
+	msg.Extra = rest[typeLen:]
+	if len(msg.Extra) == 0 {
+		msg.Extra = nil
+	}
 	return nil
 }
@@ -32,6 +32,9 @@ func (msg OpenConfirmMessage) MarshalMux() ([]byte, error) {
 }
 
 func (msg *OpenConfirmMessage) UnmarshalMux(b []byte) error {
+	if err := checkPacket(b, msgChannelOpenConfirm); err != nil {
+		return err
+	}
 	msg.ChannelID = binary.BigEndian.Uint32(b[1:5])
 	msg.SenderID = binary.BigEndian.Uint32(b[5:9])
 	msg.WindowSize = binary.BigEndian.Uint32(b[9:13])
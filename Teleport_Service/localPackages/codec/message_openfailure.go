@@ -2,15 +2,55 @@ package codec
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 )
 
+// OpenFailureReason tells why a channel could not be opened. The codes
+// are those of SSH (RFC 4254, section 5.1).
+type OpenFailureReason uint32
+
+const (
+	// ReasonUnspecified is what peers that predate reason codes send.
+	ReasonUnspecified OpenFailureReason = iota
+	ReasonAdministrativelyProhibited
+	ReasonConnectFailed
+	ReasonUnknownChannelType
+	ReasonResourceShortage
+)
+
+func (r OpenFailureReason) String() string {
+	switch r {
+	case ReasonUnspecified:
+		return "unspecified"
+	case ReasonAdministrativelyProhibited:
+		return "administratively prohibited"
+	case ReasonConnectFailed:
+		return "connect failed"
+	case ReasonUnknownChannelType:
+		return "unknown channel type"
+	case ReasonResourceShortage:
+		return "resource shortage"
+	default:
+		return fmt.Sprintf("reason %d", uint32(r))
+	}
+}
+
+// MaxDescriptionLength bounds the Description of an OpenFailureMessage.
+const MaxDescriptionLength = 1 << 10
+
+// OpenFailureMessage refuses a channel open. With a Reason or a
+// human-readable Description it is sent as msgChannelOpenFailureExt, which
+// only peers that sent an extended OpenMessage are sure to understand.
 type OpenFailureMessage struct {
-	ChannelID uint32
+	ChannelID   uint32
+	Reason      OpenFailureReason
+	Description string
 }
 
 func (msg OpenFailureMessage) String() string {
-	return fmt.Sprintf("{OpenFailureMessage ChannelID:%d}", msg.ChannelID)
+	return fmt.Sprintf("{OpenFailureMessage ChannelID:%d Reason:%s Description:%q}",
+		msg.ChannelID, msg.Reason, msg.Description)
 }
 
 func (msg OpenFailureMessage) Channel() (uint32, bool) {
@@ -18,13 +58,46 @@ func (msg OpenFailureMessage) Channel() (uint32, bool) {
 }
 
 func (msg OpenFailureMessage) MarshalMux() ([]byte, error) {
-	packet := make([]byte, payloadSizes[msgChannelOpenFailure]+1)
-	packet[0] = msgChannelOpenFailure
+	if msg.Reason == ReasonUnspecified && msg.Description == "" {
+		packet := make([]byte, payloadSizes[msgChannelOpenFailure]+1)
+		packet[0] = msgChannelOpenFailure
+		binary.BigEndian.PutUint32(packet[1:5], msg.ChannelID)
+		return packet, nil
+	}
+
+	if len(msg.Description) > MaxDescriptionLength {
+		return nil, ErrDescriptionTooLong
+	}
+	size := payloadSizes[msgChannelOpenFailureExt] + 1
+	packet := make([]byte, size, size+len(msg.Description))
+	packet[0] = msgChannelOpenFailureExt
 	binary.BigEndian.PutUint32(packet[1:5], msg.ChannelID)
-	return packet, nil
+	binary.BigEndian.PutUint32(packet[5:9], uint32(msg.Reason))
+	binary.BigEndian.PutUint32(packet[9:13], uint32(len(msg.Description)))
+	return append(packet, msg.Description...), nil
 }
 
 func (msg *OpenFailureMessage) UnmarshalMux(b []byte) error {
+	if len(b) > 0 && b[0] == msgChannelOpenFailureExt {
+		if err := checkPacket(b, msgChannelOpenFailureExt); err != nil {
+			return err
+		}
+		description := b[payloadSizes[msgChannelOpenFailureExt]+1:]
+		if n := binary.BigEndian.Uint32(b[9:13]); uint64(n) != uint64(len(description)) {
+			return fmt.Errorf("qmux: open failure description length %d does not match header %d", len(description), n)
+		}
+		msg.ChannelID = binary.BigEndian.Uint32(b[1:5])
+		msg.Reason = OpenFailureReason(binary.BigEndian.Uint32(b[5:9]))
+		msg.Description = string(description)
+		if msg.Reason == ReasonUnspecified && msg.Description == "" {
+			return errors.New("qmux: extended open failure without a reason")
+		}
+		return nil
+	}
+	if err := checkPacket(b, msgChannelOpenFailure); err != nil {
+		return err
+	}
 	msg.ChannelID = binary.BigEndian.Uint32(b[1:5])
+	msg.Reason, msg.Description = ReasonUnspecified, ""
 	return nil
 }
@@ -0,0 +1,63 @@
+package codec
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// PingMessage asks the peer to answer with a PongMessage carrying the same
+// ID. It is a session level message and belongs to no channel.
+type PingMessage struct {
+	ID uint64
+}
+
+func (msg PingMessage) String() string {
+	return fmt.Sprintf("{PingMessage ID:%d}", msg.ID)
+}
+
+func (msg PingMessage) Channel() (uint32, bool) {
+	return 0, false
+}
+
+func (msg PingMessage) MarshalMux() ([]byte, error) {
+	packet := make([]byte, payloadSizes[msgPing]+1)
+	packet[0] = msgPing
+	binary.BigEndian.PutUint64(packet[1:9], msg.ID)
+	return packet, nil
+}
+
+func (msg *PingMessage) UnmarshalMux(b []byte) error {
+	if err := checkPacket(b, msgPing); err != nil {
+		return err
+	}
+	msg.ID = binary.BigEndian.Uint64(b[1:9])
+	return nil
+}
+
+// PongMessage answers a PingMessage.
+type PongMessage struct {
+	ID uint64
+}
+
+func (msg PongMessage) String() string {
+	return fmt.Sprintf("{PongMessage ID:%d}", msg.ID)
+}
+
+func (msg PongMessage) Channel() (uint32, bool) {
+	return 0, false
+}
+
+func (msg PongMessage) MarshalMux() ([]byte, error) {
+	packet := make([]byte, payloadSizes[msgPong]+1)
+	packet[0] = msgPong
+	binary.BigEndian.PutUint64(packet[1:9], msg.ID)
+	return packet, nil
+}
+
+func (msg *PongMessage) UnmarshalMux(b []byte) error {
+	if err := checkPacket(b, msgPong); err != nil {
+		return err
+	}
+	msg.ID = binary.BigEndian.Uint64(b[1:9])
+	return nil
+}
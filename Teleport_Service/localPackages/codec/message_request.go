@@ -0,0 +1,138 @@
+package codec
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// MaxRequestLength bounds the Type and Payload of a RequestMessage, and the
+// Payload of a ResponseMessage.
+const MaxRequestLength = 64 << 10
+
+// RequestMessage is a session level request, like an SSH global request:
+// Type names it and Payload is request specific. When WantReply is set the
+// peer answers with a ResponseMessage carrying the same ID.
+//
+// Peers that predate requests cannot decode them, so they must only be
+// sent to peers known to support them.
+type RequestMessage struct {
+	ID        uint32
+	Type      string
+	WantReply bool
+	Payload   []byte
+}
+
+func (msg RequestMessage) String() string {
+	return fmt.Sprintf("{RequestMessage ID:%d Type:%q WantReply:%t Payload:%d bytes}",
+		msg.ID, msg.Type, msg.WantReply, len(msg.Payload))
+}
+
+func (msg RequestMessage) Channel() (uint32, bool) {
+	return 0, false
+}
+
+func (msg RequestMessage) MarshalMux() ([]byte, error) {
+	if len(msg.Type)+len(msg.Payload) > MaxRequestLength {
+		return nil, ErrRequestTooLong
+	}
+	size := payloadSizes[msgRequest] + 1
+	packet := make([]byte, size, size+len(msg.Type)+len(msg.Payload))
+	packet[0] = msgRequest
+	binary.BigEndian.PutUint32(packet[1:5], msg.ID)
+	packet[5] = boolByte(msg.WantReply)
+	binary.BigEndian.PutUint32(packet[6:10], uint32(len(msg.Type)))
+	binary.BigEndian.PutUint32(packet[10:14], uint32(len(msg.Payload)))
+	packet = append(packet, msg.Type...)
+	return append(packet, msg.Payload...), nil
+}
+
+func (msg *RequestMessage) UnmarshalMux(b []byte) error {
+	if err := checkPacket(b, msgRequest); err != nil {
+		return err
+	}
+	wantReply, err := byteBool(b[5])
+	if err != nil {
+		return err
+	}
+	typeLen := binary.BigEndian.Uint32(b[6:10])
+	payloadLen := binary.BigEndian.Uint32(b[10:14])
+	rest := b[payloadSizes[msgRequest]+1:]
+	if uint64(typeLen)+uint64(payloadLen) != uint64(len(rest)) {
+		return fmt.Errorf("qmux: request length %d does not match header %d+%d", len(rest), typeLen, payloadLen)
+	}
+	msg.ID = binary.BigEndian.Uint32(b[1:5])
+	msg.WantReply = wantReply
+	msg.Type = string(rest[:typeLen])
+	msg.Payload = nil
+	if payloadLen > 0 {
+		msg.Payload = rest[typeLen:]
+	}
+	return nil
+}
+
+// ResponseMessage answers the RequestMessage with the same ID. OK tells
+// whether the request was handled.
+type ResponseMessage struct {
+	ID      uint32
+	OK      bool
+	Payload []byte
+}
+
+func (msg ResponseMessage) String() string {
+	return fmt.Sprintf("{ResponseMessage ID:%d OK:%t Payload:%d bytes}", msg.ID, msg.OK, len(msg.Payload))
+}
+
+func (msg ResponseMessage) Channel() (uint32, bool) {
+	return 0, false
+}
+
+func (msg ResponseMessage) MarshalMux() ([]byte, error) {
+	if len(msg.Payload) > MaxRequestLength {
+		return nil, ErrRequestTooLong
+	}
+	size := payloadSizes[msgResponse] + 1
+	packet := make([]byte, size, size+len(msg.Payload))
+	packet[0] = msgResponse
+	binary.BigEndian.PutUint32(packet[1:5], msg.ID)
+	packet[5] = boolByte(msg.OK)
+	binary.BigEndian.PutUint32(packet[6:10], uint32(len(msg.Payload)))
+	return append(packet, msg.Payload...), nil
+}
+
+func (msg *ResponseMessage) UnmarshalMux(b []byte) error {
+	if err := checkPacket(b, msgResponse); err != nil {
+		return err
+	}
+	ok, err := byteBool(b[5])
+	if err != nil {
+		return err
+	}
+	payload := b[payloadSizes[msgResponse]+1:]
+	if n := binary.BigEndian.Uint32(b[6:10]); uint64(n) != uint64(len(payload)) {
+		return fmt.Errorf("qmux: response length %d does not match header %d", len(payload), n)
+	}
+	msg.ID = binary.BigEndian.Uint32(b[1:5])
+	msg.OK = ok
+	msg.Payload = nil
+	if len(payload) > 0 {
+		msg.Payload = payload
+	}
+	return nil
+}
+
+func boolByte(b bool) byte {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func byteBool(b byte) (bool, error) {
+	switch b {
+	case 0:
+		return false, nil
+	case 1:
+		return true, nil
+	}
+	return false, fmt.Errorf("qmux: invalid boolean %d", b)
+}
@@ -28,6 +28,9 @@ func (msg WindowAdjustMessage) MarshalMux() ([]byte, error) {
 }
 
 func (msg *WindowAdjustMessage) UnmarshalMux(b []byte) error {
+	if err := checkPacket(b, msgChannelWindowAdjust); err != nil {
+		return err
+	}
 	msg.ChannelID = binary.BigEndian.Uint32(b[1:5])
 	msg.AdditionalBytes = binary.BigEndian.Uint32(b[5:9])
 	return nil
@@ -0,0 +1,53 @@
+package codec
+
+import (
+	"math/bits"
+	"sync"
+)
+
+// Decoded DataMessages are pooled in power of two size classes, so that a
+// small payload never pins a large buffer while it waits to be read.
+// Payloads above the largest class are allocated as before.
+const (
+	minPooledShift = 6  // 64 bytes
+	maxPooledShift = 16 // 64 KiB
+)
+
+var dataPools [maxPooledShift - minPooledShift + 1]sync.Pool
+
+// sizeClass returns the index in dataPools for a payload of n bytes.
+func sizeClass(n int) int {
+	if n <= 1<<minPooledShift {
+		return 0
+	}
+	return bits.Len(uint(n-1)) - minPooledShift
+}
+
+// getDataMessage returns a DataMessage with room for n bytes of Data.
+func getDataMessage(n uint32) *DataMessage {
+	if n > 1<<maxPooledShift {
+		return &DataMessage{Length: n, Data: make([]byte, n)}
+	}
+	class := sizeClass(int(n))
+	msg, _ := dataPools[class].Get().(*DataMessage)
+	if msg == nil {
+		msg = &DataMessage{Data: make([]byte, 0, 1<<(class+minPooledShift))}
+	}
+	msg.pooled = true
+	msg.Length = n
+	msg.Data = msg.Data[:n]
+	return msg
+}
+
+// Release hands a DataMessage returned by Decoder.Decode back to the pool.
+// Neither the message nor its Data may be used afterwards. Releasing is
+// optional: messages that are never released are garbage collected.
+func (msg *DataMessage) Release() {
+	if !msg.pooled {
+		return
+	}
+	msg.pooled = false
+	msg.ChannelID, msg.Length = 0, 0
+	msg.Data = msg.Data[:0]
+	dataPools[sizeClass(cap(msg.Data))].Put(msg)
+}
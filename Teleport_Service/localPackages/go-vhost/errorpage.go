@@ -0,0 +1,211 @@
+package vhost
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"html/template"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrorPage is an error answered to an HTTP client in place of the
+// backend it asked for.
+type ErrorPage struct {
+	Status    int    `json:"status"`
+	Code      string `json:"code"` // the kind of error, like "unknown_host"
+	Title     string `json:"title"`
+	Message   string `json:"message"`
+	Host      string `json:"host,omitempty"`
+	RequestID string `json:"requestId"`
+}
+
+// The pages of the errors found while muxing.
+var (
+	PageUnknownHost = ErrorPage{
+		Status:  http.StatusNotFound,
+		Code:    "unknown_host",
+		Title:   "Unknown host",
+		Message: "Nothing is being served at this address.",
+	}
+	PageBadRequest = ErrorPage{
+		Status:  http.StatusBadRequest,
+		Code:    "bad_request",
+		Title:   "Bad request",
+		Message: "The request could not be read.",
+	}
+	PageMisdirected = ErrorPage{
+		Status:  http.StatusMisdirectedRequest,
+		Code:    "misdirected_request",
+		Title:   "Misdirected request",
+		Message: "This address is served over HTTP/1.1 only, retry without HTTP/2.",
+	}
+	PageUnavailable = ErrorPage{
+		Status:  http.StatusServiceUnavailable,
+		Code:    "unavailable",
+		Title:   "Service unavailable",
+		Message: "The service at this address is not keeping up, try again shortly.",
+	}
+	PageServerError = ErrorPage{
+		Status:  http.StatusInternalServerError,
+		Code:    "server_error",
+		Title:   "Server error",
+		Message: "Something went wrong on our side.",
+	}
+)
+
+// DefaultErrorTemplate is the HTML of the error pages unless ErrorPages
+// has its own. It gets the page and the brand, see ErrorPages.HTML.
+var DefaultErrorTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Status}} {{.Title}}{{with .Brand}} - {{.}}{{end}}</title>
+<style>
+body { font-family: sans-serif; color: #222; max-width: 36em; margin: 10vh auto; padding: 0 1em; }
+h1 { font-size: 1.5em; }
+footer { color: #888; font-size: .8em; margin-top: 3em; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{.Message}}</p>
+<footer>{{with .Brand}}{{.}} &middot; {{end}}{{with .Host}}{{.}} &middot; {{end}}request {{.RequestID}}</footer>
+</body>
+</html>
+`))
+
+// ErrorPages writes error pages as HTML or JSON, whichever the client
+// prefers in its Accept header. Each page is given a request ID, sent in
+// X-Request-Id and shown on the page, for users to quote in reports.
+type ErrorPages struct {
+	// HTML renders the HTML pages. It is executed with the fields of
+	// ErrorPage (.Status, .Code, .Title, .Message, .Host, .RequestID) and
+	// .Brand. nil means DefaultErrorTemplate.
+	HTML *template.Template
+
+	// Brand is the name of the service shown on the HTML pages.
+	Brand string
+
+	// Pages overrides the title and message of pages by code, and their
+	// status if set.
+	Pages map[string]ErrorPage
+}
+
+// Write answers the client on conn with page. req is the request it sent,
+// nil if it could not be read. The response asks the client to close the
+// connection, which is left to the caller. An HTTP/2 client, when conn is
+// its *HTTPConn, is answered in HTTP/2.
+func (p *ErrorPages) Write(conn net.Conn, req *http.Request, page ErrorPage) error {
+	if override, ok := p.Pages[page.Code]; ok {
+		if override.Status != 0 {
+			page.Status = override.Status
+		}
+		page.Title, page.Message = override.Title, override.Message
+	}
+	page.RequestID = newRequestID()
+	var accept string
+	if req != nil {
+		page.Host = req.Host
+		accept = req.Header.Get("Accept")
+	}
+
+	var body bytes.Buffer
+	header := http.Header{"X-Request-Id": {page.RequestID}}
+	if prefersJSON(accept) {
+		header.Set("Content-Type", "application/json")
+		if err := json.NewEncoder(&body).Encode(page); err != nil {
+			return err
+		}
+	} else {
+		header.Set("Content-Type", "text/html; charset=utf-8")
+		tmpl := p.HTML
+		if tmpl == nil {
+			tmpl = DefaultErrorTemplate
+		}
+		data := struct {
+			ErrorPage
+			Brand string
+		}{page, p.Brand}
+		if err := tmpl.Execute(&body, data); err != nil {
+			return err
+		}
+	}
+
+	resp := &http.Response{
+		StatusCode:    page.Status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(&body),
+		ContentLength: int64(body.Len()),
+		Close:         true,
+		Request:       req, // no body in answer to HEAD
+	}
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if hc, ok := conn.(*HTTPConn); ok && hc.streamID != 0 {
+		return writeHTTP2Response(conn, hc.streamID, resp, body.Bytes())
+	}
+	return resp.Write(conn)
+}
+
+// prefersJSON reports whether the Accept header ranks application/json
+// above text/html, by quality then by how specifically it is named. HTML
+// wins ties and a missing header.
+func prefersJSON(accept string) bool {
+	jq, js := acceptQuality(accept, "application/json")
+	hq, hs := acceptQuality(accept, "text/html")
+	return jq > hq || (jq == hq && js > hs)
+}
+
+// acceptQuality returns the quality the Accept header gives mediaType,
+// from its most specific matching range, and the specificity of that
+// range: 2 for the type itself, 1 for type/*, 0 for */*.
+func acceptQuality(accept, mediaType string) (float64, int) {
+	if accept == "" {
+		return 1, 0
+	}
+	typ, _, _ := strings.Cut(mediaType, "/")
+	quality, specificity := 0.0, -1
+	for _, r := range strings.Split(accept, ",") {
+		params := strings.Split(r, ";")
+		rng := strings.ToLower(strings.TrimSpace(params[0]))
+		var s int
+		switch rng {
+		case mediaType:
+			s = 2
+		case typ + "/*":
+			s = 1
+		case "*/*":
+			s = 0
+		default:
+			continue
+		}
+		if s < specificity {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			k, v, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(k, "q") {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					q = f
+				}
+			}
+		}
+		quality, specificity = q, s
+	}
+	return quality, specificity
+}
+
+// newRequestID returns a random ID for a request.
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,107 @@
+package vhost
+
+import (
+	"encoding/json"
+	"html/template"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrefersJSON(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   bool
+	}{
+		{"", false},
+		{"*/*", false},
+		{"application/json", true},
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", false},
+		{"application/json, text/plain, */*", true},
+		{"text/html;q=0.5, application/*", true},
+		{"application/json;q=0.1, */*", false},
+		{"Application/JSON;q=1.0, text/html;q=0.9", true},
+	}
+	for _, test := range tests {
+		if got := prefersJSON(test.accept); got != test.want {
+			t.Errorf("%q: got %v, want %v", test.accept, got, test.want)
+		}
+	}
+}
+
+func TestHTTPMuxErrorPages(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux, err := NewHTTPMuxer(l, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mux.Close()
+	mux.Pages = &ErrorPages{
+		HTML:  template.Must(template.New("").Parse(`<h1>{{.Brand}}: {{.Title}}</h1><p>{{.Message}}</p>{{.RequestID}}`)),
+		Brand: "Acme",
+		Pages: map[string]ErrorPage{"unknown_host": {Title: "No such tunnel", Message: "Start <yours> first."}},
+	}
+	go mux.HandleErrors()
+
+	get := func(accept string) (*http.Response, string) {
+		req, _ := http.NewRequest("GET", "http://"+l.Addr().String()+"/", nil)
+		req.Host = "missing.example.com"
+		req.Header.Set("Accept", accept)
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusNotFound || resp.Header.Get("X-Request-Id") == "" {
+			t.Fatalf("expected a 404 with a request ID, got %d %v", resp.StatusCode, resp.Header)
+		}
+		return resp, string(body)
+	}
+
+	resp, body := get("application/json")
+	var page ErrorPage
+	if err := json.Unmarshal([]byte(body), &page); err != nil {
+		t.Fatalf("expected a JSON page, got %q: %v", body, err)
+	}
+	want := ErrorPage{
+		Status:    http.StatusNotFound,
+		Code:      "unknown_host",
+		Title:     "No such tunnel",
+		Message:   "Start <yours> first.",
+		Host:      "missing.example.com",
+		RequestID: resp.Header.Get("X-Request-Id"),
+	}
+	if page != want {
+		t.Fatalf("got page %+v, want %+v", page, want)
+	}
+
+	resp, body = get("text/html")
+	if resp.Header.Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Fatalf("expected HTML, got %q", resp.Header.Get("Content-Type"))
+	}
+	if want := "<h1>Acme: No such tunnel</h1><p>Start &lt;yours&gt; first.</p>" + resp.Header.Get("X-Request-Id"); body != want {
+		t.Fatalf("got body %q, want %q", body, want)
+	}
+
+	// a request that cannot be parsed still gets a page
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("NOT HTTP\r\n\r\n"))
+	b, _ := ioutil.ReadAll(conn)
+	if !strings.HasPrefix(string(b), "HTTP/1.1 400 Bad Request\r\n") || !strings.Contains(string(b), "Bad request") {
+		t.Fatalf("expected a 400 page, got %q", b)
+	}
+}
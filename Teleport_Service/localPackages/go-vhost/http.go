@@ -2,22 +2,36 @@ package vhost
 
 import (
 	"bufio"
+	"bytes"
 	"net"
 	"net/http"
+	"net/textproto"
+	"strings"
 )
 
 type HTTPConn struct {
 	*sharedConn
 	Request *http.Request
+
+	streamID uint32 // the stream of Request on an HTTP/2 connection
 }
 
 // HTTP parses the head of the first HTTP request on conn and returns
-// a new, unread connection with metadata for virtual host muxing
+// a new, unread connection with metadata for virtual host muxing.
+// HTTP/2 connections with prior knowledge (h2c), or after ALPN on a
+// terminated TLS connection, are recognized by their preface: Request is
+// then made of the headers of the first stream, with the :authority as
+// Host.
 func HTTP(conn net.Conn) (httpConn *HTTPConn, err error) {
 	c, rd := newShared(conn)
+	br := bufio.NewReader(rd)
 
 	httpConn = &HTTPConn{sharedConn: c}
-	if httpConn.Request, err = http.ReadRequest(bufio.NewReader(rd)); err != nil {
+	if isHTTP2(br) {
+		httpConn.Request, httpConn.streamID, err = readHTTP2Request(br)
+		return
+	}
+	if httpConn.Request, err = http.ReadRequest(br); err != nil {
 		return
 	}
 
@@ -40,3 +54,133 @@ func (c *HTTPConn) Host() string {
 
 	return c.Request.Host
 }
+
+// Path returns the path of the request, for path-prefix routing.
+func (c *HTTPConn) Path() string {
+	if c.Request == nil || c.Request.URL == nil {
+		return ""
+	}
+	return c.Request.URL.Path
+}
+
+// Upgrade returns the protocol an HTTP/1 request asks to switch to, in
+// lower case, such as "websocket", or "" if it is not an upgrade. Only the
+// first protocol of the Upgrade header is returned.
+func (c *HTTPConn) Upgrade() string {
+	if c.Request == nil || c.streamID != 0 || !headerHasToken(c.Request.Header, "Connection", "upgrade") {
+		return ""
+	}
+	proto, _, _ := strings.Cut(c.Request.Header.Get("Upgrade"), ",")
+	proto, _, _ = strings.Cut(strings.TrimSpace(proto), "/")
+	return strings.ToLower(proto)
+}
+
+// rewritePrefix rewrites the head of the buffered request for a listener
+// bound to the path prefix: with strip, the prefix is removed from the
+// request path, "/alice/app" becoming "/app"; with forwarded, the prefix
+// is passed in X-Forwarded-Prefix, replacing any the client sent. The
+// request is also marked Connection: close unless it is an upgrade, since
+// the requests after the first one on the connection are not routed and
+// may be for another prefix. HTTP/2 requests, HPACK-encoded, are left
+// alone.
+func (c *HTTPConn) rewritePrefix(prefix string, strip, forwarded bool) {
+	c.Lock()
+	defer c.Unlock()
+	if c.vhostBuf == nil || c.Request == nil || c.streamID != 0 {
+		return
+	}
+
+	var first string
+	if strip {
+		u := *c.Request.URL
+		u.Path = stripPrefix(u.Path, prefix)
+		if strings.HasPrefix(u.RawPath, prefix) {
+			u.RawPath = stripPrefix(u.RawPath, prefix)
+		} else {
+			u.RawPath = ""
+		}
+		c.Request.URL = &u
+		c.Request.RequestURI = u.RequestURI()
+		first = c.Request.Method + " " + c.Request.RequestURI + " " + c.Request.Proto
+	}
+
+	upgrade := headerHasToken(c.Request.Header, "Connection", "upgrade")
+	var extra []string
+	if forwarded {
+		extra = append(extra, "X-Forwarded-Prefix: "+prefix)
+		c.Request.Header.Set("X-Forwarded-Prefix", prefix)
+	}
+	if !upgrade {
+		extra = append(extra, "Connection: close")
+		c.Request.Header.Set("Connection", "close")
+		c.Request.Close = true
+	}
+	c.vhostBuf = rebuildHead(c.vhostBuf.Bytes(), first, func(name string) bool {
+		return (forwarded && name == "X-Forwarded-Prefix") || (!upgrade && name == "Connection")
+	}, extra)
+}
+
+// rebuildHead returns the message head at the start of buf with its first
+// line replaced by first, unless empty, the header lines whose canonical
+// name drop reports removed, continuation lines included, and the extra
+// lines added at the end, followed by the rest of buf.
+func rebuildHead(buf []byte, first string, drop func(name string) bool, extra []string) *bytes.Buffer {
+	line, rest := nextLine(buf)
+	var head bytes.Buffer
+	if first != "" {
+		head.WriteString(first + "\r\n")
+	} else {
+		head.Write(line)
+	}
+
+	dropping := false
+	for {
+		line, rest = nextLine(rest)
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			break
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			name, _, _ := strings.Cut(string(line), ":")
+			dropping = drop(textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name)))
+		}
+		if !dropping {
+			head.Write(line)
+		}
+	}
+	for _, l := range extra {
+		head.WriteString(l + "\r\n")
+	}
+	head.WriteString("\r\n")
+	head.Write(rest)
+	return &head
+}
+
+// nextLine splits b after its first line feed.
+func nextLine(b []byte) (line, rest []byte) {
+	if i := bytes.IndexByte(b, '\n'); i >= 0 {
+		return b[:i+1], b[i+1:]
+	}
+	return b, nil
+}
+
+// stripPrefix removes prefix from path, keeping it absolute.
+func stripPrefix(path, prefix string) string {
+	path = strings.TrimPrefix(path, prefix)
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path
+}
+
+// headerHasToken reports whether the comma-separated values of the header
+// name contain token, ignoring case.
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,156 @@
+package vhost
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// http2Preface starts every HTTP/2 connection, with prior knowledge (h2c)
+// or after ALPN negotiated h2.
+const http2Preface = http2.ClientPreface
+
+const (
+	// http2MaxFrames is how many frames may come before the first HEADERS,
+	// SETTINGS, WINDOW_UPDATE and PRIORITY usually.
+	http2MaxFrames = 16
+
+	// http2MaxHeaderListSize bounds the decoded headers of the first
+	// request.
+	http2MaxHeaderListSize = 64 << 10
+)
+
+// isHTTP2 reports whether br starts with the HTTP/2 connection preface. It
+// only waits for the rest of the preface once the first bytes match, since
+// an HTTP/1 request may be shorter.
+func isHTTP2(br *bufio.Reader) bool {
+	if p, err := br.Peek(4); err != nil || string(p) != http2Preface[:4] {
+		return false
+	}
+	p, err := br.Peek(len(http2Preface))
+	return err == nil && string(p) == http2Preface
+}
+
+// readHTTP2Request reads the preface and the frames up to the first
+// HEADERS, and returns its request and stream. The request has the
+// :authority as Host, the :path as URL and no body.
+func readHTTP2Request(br *bufio.Reader) (*http.Request, uint32, error) {
+	if _, err := br.Discard(len(http2Preface)); err != nil {
+		return nil, 0, err
+	}
+	fr := http2.NewFramer(nil, br)
+	fr.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	fr.MaxHeaderListSize = http2MaxHeaderListSize
+
+	for i := 0; i < http2MaxFrames; i++ {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			return nil, 0, err
+		}
+		switch f := f.(type) {
+		case *http2.SettingsFrame, *http2.WindowUpdateFrame, *http2.PriorityFrame, *http2.PingFrame:
+			continue
+		case *http2.MetaHeadersFrame:
+			req, err := http2Request(f)
+			return req, f.StreamID, err
+		default:
+			return nil, 0, fmt.Errorf("unexpected HTTP/2 %v frame before the request headers", f.Header().Type)
+		}
+	}
+	return nil, 0, errors.New("no HTTP/2 request headers")
+}
+
+// http2Request turns the headers of a stream into a request.
+func http2Request(f *http2.MetaHeadersFrame) (*http.Request, error) {
+	req := &http.Request{
+		Method:     f.PseudoValue("method"),
+		Proto:      "HTTP/2.0",
+		ProtoMajor: 2,
+		Header:     make(http.Header),
+		Host:       f.PseudoValue("authority"),
+		RequestURI: f.PseudoValue("path"),
+		Body:       http.NoBody,
+		URL:        &url.URL{},
+	}
+	for _, hf := range f.RegularFields() {
+		req.Header.Add(http.CanonicalHeaderKey(hf.Name), hf.Value)
+	}
+	if req.Host == "" {
+		req.Host = req.Header.Get("Host")
+	}
+	if req.Host == "" {
+		return nil, errors.New("HTTP/2 request without :authority")
+	}
+	if req.RequestURI != "" {
+		u, err := url.ParseRequestURI(req.RequestURI)
+		if err != nil {
+			return nil, fmt.Errorf("bad HTTP/2 :path %q: %v", req.RequestURI, err)
+		}
+		req.URL = u
+	}
+	return req, nil
+}
+
+// writeHTTP2Response answers the request on streamID with a response in
+// its own HTTP/2 connection: our SETTINGS, the response and a GOAWAY.
+func writeHTTP2Response(w io.Writer, streamID uint32, resp *http.Response, body []byte) error {
+	var buf bytes.Buffer
+	fr := http2.NewFramer(&buf, nil)
+	fr.WriteSettings()
+	fr.WriteSettingsAck()
+
+	var block bytes.Buffer
+	enc := hpack.NewEncoder(&block)
+	enc.WriteField(hpack.HeaderField{Name: ":status", Value: strconv.Itoa(resp.StatusCode)})
+	for name, values := range resp.Header {
+		for _, v := range values {
+			enc.WriteField(hpack.HeaderField{Name: strings.ToLower(name), Value: v})
+		}
+	}
+	enc.WriteField(hpack.HeaderField{Name: "content-length", Value: strconv.Itoa(len(body))})
+	sendBody := resp.Request == nil || resp.Request.Method != http.MethodHead
+	fr.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      streamID,
+		BlockFragment: block.Bytes(),
+		EndHeaders:    true,
+		EndStream:     !sendBody || len(body) == 0,
+	})
+	if sendBody && len(body) > 0 {
+		fr.WriteData(streamID, true, body)
+	}
+	fr.WriteGoAway(streamID, http2.ErrCodeNo, nil)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// TerminateTLS returns a listener that terminates TLS with config on the
+// connections of l, for an HTTPMuxer to route them by Host or :authority.
+// Unless config has NextProtos, it offers h2 and http/1.1 with ALPN so
+// that gRPC and other HTTP/2 clients can use h2.
+//
+// An HTTP/2 connection is routed by its first request only. Those routed
+// to a path prefix are refused with 421 Misdirected Request, the later
+// requests being possibly for other prefixes: set NextProtos to http/1.1
+// alone where names are served under path prefixes. Likewise browsers
+// reuse an h2 connection for every name its certificate covers, so with a
+// wildcard certificate the requests for one subdomain may go down the
+// connection routed to another: offer h2 only when all the names of the
+// certificate lead to the same listener.
+func TerminateTLS(l net.Listener, config *tls.Config) net.Listener {
+	if len(config.NextProtos) == 0 {
+		config = config.Clone()
+		config.NextProtos = []string{"h2", "http/1.1"}
+	}
+	return tls.NewListener(l, config)
+}
@@ -0,0 +1,239 @@
+package vhost
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+func TestHTTP2Request(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// what a gRPC client sends first with prior knowledge
+	var sent bytes.Buffer
+	sent.WriteString(http2.ClientPreface)
+	fr := http2.NewFramer(&sent, nil)
+	fr.WriteSettings(http2.Setting{ID: http2.SettingInitialWindowSize, Val: 1 << 20})
+	fr.WriteWindowUpdate(0, 1<<20)
+	var block bytes.Buffer
+	enc := hpack.NewEncoder(&block)
+	for _, hf := range [][2]string{
+		{":method", "POST"},
+		{":scheme", "http"},
+		{":authority", "grpc.example.com"},
+		{":path", "/pkg.Greeter/SayHello?x=1"},
+		{"content-type", "application/grpc"},
+		{"te", "trailers"},
+	} {
+		enc.WriteField(hpack.HeaderField{Name: hf[0], Value: hf[1]})
+	}
+	// split over a CONTINUATION frame
+	fr.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: block.Bytes()[:10]})
+	fr.WriteContinuation(1, true, block.Bytes()[10:])
+	fr.WriteData(1, true, []byte("payload"))
+
+	go func() {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			panic(err)
+		}
+		conn.Write(sent.Bytes())
+		conn.Close()
+	}()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := HTTP(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Host() != "grpc.example.com" || c.Path() != "/pkg.Greeter/SayHello" || c.Request.Method != "POST" || c.Request.ProtoMajor != 2 {
+		t.Fatalf("unexpected request %s %s %s %s", c.Request.Proto, c.Request.Method, c.Host(), c.Path())
+	}
+	if c.Request.Header.Get("Content-Type") != "application/grpc" || c.Request.URL.RawQuery != "x=1" {
+		t.Fatalf("unexpected headers %v and query %q", c.Request.Header, c.Request.URL.RawQuery)
+	}
+	replayed, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(replayed, sent.Bytes()) {
+		t.Fatal("expected the connection to be replayed from the preface")
+	}
+}
+
+// h2cClient speaks HTTP/2 with prior knowledge to addr.
+func h2cClient(addr string) *http.Client {
+	return &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, _ string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+}
+
+// serveH2 answers the HTTP/2 connections of l with their protocol and path.
+func serveH2(l net.Listener) {
+	srv := &http2.Server{}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", r.Proto, r.URL.Path)
+	})
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go srv.ServeConn(conn, &http2.ServeConnOpts{Handler: handler})
+	}
+}
+
+func TestH2CMux(t *testing.T) {
+	l, _ := localListener(t)
+	mux, err := NewHTTPMuxer(l, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mux.Close()
+	go mux.HandleErrors()
+
+	grpc := mustListen(t, mux.VhostMuxer, "grpc.example.com", ListenOptions{})
+	go serveH2(grpc)
+
+	client := h2cClient(l.Addr().String())
+	req, _ := http.NewRequest("GET", "http://grpc.example.com/pkg.Greeter/SayHello", nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "HTTP/2.0 /pkg.Greeter/SayHello" {
+		t.Fatalf("unexpected response %q", body)
+	}
+
+	// unknown hosts get their error page in HTTP/2
+	client = h2cClient(l.Addr().String())
+	req, _ = http.NewRequest("GET", "http://missing.example.com/", nil)
+	req.Header.Set("Accept", "application/json")
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var page ErrorPage
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusNotFound || page.Code != PageUnknownHost.Code || page.RequestID != resp.Header.Get("X-Request-Id") {
+		t.Fatalf("expected the unknown host page, got %d %+v", resp.StatusCode, page)
+	}
+}
+
+func TestH2CRefusedOnPathPrefix(t *testing.T) {
+	l, _ := localListener(t)
+	mux, err := NewHTTPMuxer(l, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mux.Close()
+	go mux.HandleErrors()
+
+	api := mustListen(t, mux.VhostMuxer, "example.com/api", ListenOptions{})
+	go serveH2(api)
+
+	// the next streams could be for /other, so the connection is refused
+	client := h2cClient(l.Addr().String())
+	req, _ := http.NewRequest("GET", "http://example.com/api/users", nil)
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var page ErrorPage
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusMisdirectedRequest || page.Code != PageMisdirected.Code {
+		t.Fatalf("expected the misdirected request page, got %d %+v", resp.StatusCode, page)
+	}
+}
+
+// selfSigned returns a certificate for name.
+func selfSigned(t *testing.T, name string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestTerminateTLSNegotiatesH2(t *testing.T) {
+	l, _ := localListener(t)
+	config := &tls.Config{Certificates: []tls.Certificate{selfSigned(t, "grpc.example.com")}}
+	mux, err := NewHTTPMuxer(TerminateTLS(l, config), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mux.Close()
+	go mux.HandleErrors()
+
+	grpc := mustListen(t, mux.VhostMuxer, "grpc.example.com", ListenOptions{})
+	go serveH2(grpc)
+
+	client := &http.Client{Transport: &http2.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		DialTLSContext: func(ctx context.Context, network, _ string, cfg *tls.Config) (net.Conn, error) {
+			conn, err := tls.Dial(network, l.Addr().String(), cfg)
+			if err == nil && conn.ConnectionState().NegotiatedProtocol != "h2" {
+				conn.Close()
+				return nil, fmt.Errorf("negotiated %q instead of h2", conn.ConnectionState().NegotiatedProtocol)
+			}
+			return conn, err
+		},
+	}}
+	resp, err := client.Get("https://grpc.example.com/hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "HTTP/2.0 /hello" {
+		t.Fatalf("unexpected response %q", body)
+	}
+	if len(config.NextProtos) != 0 {
+		t.Fatal("expected the config passed in to be left alone")
+	}
+}
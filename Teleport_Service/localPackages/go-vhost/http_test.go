@@ -43,3 +43,35 @@ func TestHTTPHost(t *testing.T) {
 		t.Errorf("Connection Host() is %s, expected %s", c.Host(), testHostname)
 	}
 }
+
+func TestHTTPUpgrade(t *testing.T) {
+	tests := []struct {
+		header map[string]string
+		want   string
+	}{
+		{map[string]string{"Connection": "Upgrade", "Upgrade": "websocket"}, "websocket"},
+		{map[string]string{"Connection": "keep-alive, Upgrade", "Upgrade": "WebSocket"}, "websocket"},
+		{map[string]string{"Connection": "Upgrade, HTTP2-Settings", "Upgrade": "h2c"}, "h2c"},
+		{map[string]string{"Connection": "upgrade", "Upgrade": "TLS/1.2, HTTP/1.1"}, "tls"},
+		{map[string]string{"Upgrade": "websocket"}, ""},
+		{map[string]string{"Connection": "keep-alive"}, ""},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "http://foo.example.com/", nil)
+		for name, value := range test.header {
+			req.Header.Set(name, value)
+		}
+		c := &HTTPConn{Request: req}
+		if got := c.Upgrade(); got != test.want {
+			t.Errorf("Upgrade() with %v is %q, expected %q", test.header, got, test.want)
+		}
+	}
+
+	// HTTP/2 streams cannot be upgraded
+	req, _ := http.NewRequest("GET", "http://foo.example.com/", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	if got := (&HTTPConn{Request: req, streamID: 1}).Upgrade(); got != "" {
+		t.Errorf("expected no upgrade on an HTTP/2 stream, got %q", got)
+	}
+}
@@ -1,21 +1,20 @@
 package vhost
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var (
 	normalize = strings.ToLower
 	isClosed  = func(err error) bool {
-		netErr, ok := err.(net.Error)
-		if ok {
-			return netErr.Temporary()
-		}
-		return false
+		return errors.Is(err, net.ErrClosed)
 	}
 )
 
@@ -34,6 +33,29 @@ type Closed struct {
 	error
 }
 
+// Unavailable is returned when the listener for a connection does not take
+// it in time, its accept queue staying full
+type Unavailable struct {
+	error
+}
+
+// Misdirected is returned for an HTTP/2 connection routed to a path
+// prefix, since its later streams may be for other prefixes
+type Misdirected struct {
+	error
+}
+
+// The accept queue of a listener, see ListenOptions.
+const (
+	DefaultQueueSize      = 16
+	DefaultEnqueueTimeout = 10 * time.Second
+)
+
+var (
+	errListenerClosed = errors.New("listener closed")
+	errQueueFull      = errors.New("accept queue full")
+)
+
 type (
 	// this is the function you apply to a net.Conn to get
 	// a new virtual-host multiplexed connection
@@ -44,15 +66,28 @@ type (
 		err  error
 		conn net.Conn
 	}
+
+	// protocolConn is implemented by connections that offer application
+	// protocols, like TLS connections with ALPN
+	protocolConn interface {
+		Protocols() []string
+	}
+
+	// pathConn is implemented by connections that carry a request path,
+	// like HTTP connections
+	pathConn interface {
+		Path() string
+	}
 )
 
 type VhostMuxer struct {
-	listener     net.Listener         // listener on which we mux connections
-	muxTimeout   time.Duration        // a connection fails if it doesn't send enough data to mux after this timeout
-	vhostFn      muxFn                // new connections are multiplexed by applying this function
-	muxErrors    chan muxErr          // all muxing errors are sent over this channel
-	registry     map[string]*Listener // registry of name -> listener
-	sync.RWMutex                      // protects the registry
+	listener     net.Listener           // listener on which we mux connections
+	muxTimeout   time.Duration          // a connection fails if it doesn't send enough data to mux after this timeout
+	vhostFn      muxFn                  // new connections are multiplexed by applying this function
+	muxErrors    chan muxErr            // all muxing errors are sent over this channel
+	registry     map[hostKey]hostRoutes // registry of (name, protocol) -> path prefix -> listeners
+	running      int32                  // 1 while run is accepting connections
+	sync.RWMutex                        // protects the registry
 }
 
 func NewVhostMuxer(listener net.Listener, vhostFn muxFn, muxTimeout time.Duration) (*VhostMuxer, error) {
@@ -61,27 +96,64 @@ func NewVhostMuxer(listener net.Listener, vhostFn muxFn, muxTimeout time.Duratio
 		muxTimeout: muxTimeout,
 		vhostFn:    vhostFn,
 		muxErrors:  make(chan muxErr),
-		registry:   make(map[string]*Listener),
+		registry:   make(map[hostKey]hostRoutes),
 	}
 
+	atomic.StoreInt32(&mux.running, 1)
 	go mux.run()
 	return mux, nil
 }
 
+// Accepting reports whether the muxer is still accepting connections from
+// the wrapped listener.
+func (m *VhostMuxer) Accepting() bool {
+	return atomic.LoadInt32(&m.running) == 1
+}
+
 // Listen begins multiplexing the underlying connection to send new
-// connections for the given name over the returned listener.
+// connections for the given name over the returned listener. The name is
+// a host, "*.example.com" matching any subdomain, optionally followed by a
+// path prefix for HTTP: "example.com/api" gets the requests to /api and
+// below, ahead of a listener for "example.com".
 func (m *VhostMuxer) Listen(name string) (net.Listener, error) {
-	name = normalize(name)
+	return m.ListenWith(name, ListenOptions{})
+}
+
+// ListenWith is Listen with options, to share a route between listeners or
+// take it over from others.
+func (m *VhostMuxer) ListenWith(name string, opts ListenOptions) (*Listener, error) {
+	host, path := splitRoute(name)
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = DefaultQueueSize
+	}
+	if opts.EnqueueTimeout <= 0 {
+		opts.EnqueueTimeout = DefaultEnqueueTimeout
+	}
 
 	vhost := &Listener{
-		name:   name,
-		mux:    m,
-		accept: make(chan Conn),
+		name:    host,
+		path:    path,
+		mux:     m,
+		accept:  make(chan Conn, opts.QueueSize),
+		timeout: opts.EnqueueTimeout,
+		closed:  make(chan struct{}),
+		strip:   opts.StripPrefix,
+		prefix:  opts.ForwardedPrefix,
+	}
+	if len(opts.Protocols) == 0 {
+		vhost.keys = []hostKey{{name: host}}
+	}
+	for _, proto := range opts.Protocols {
+		vhost.keys = append(vhost.keys, hostKey{name: host, proto: proto})
 	}
 
-	if err := m.set(name, vhost); err != nil {
+	replaced, err := m.set(vhost, opts)
+	if err != nil {
 		return nil, err
 	}
+	for _, l := range replaced {
+		l.Close()
+	}
 
 	return vhost, nil
 }
@@ -100,6 +172,7 @@ func (m *VhostMuxer) Close() {
 
 // run is the VhostMuxer's main loop for accepting new connections from the wrapped listener
 func (m *VhostMuxer) run() {
+	defer atomic.StoreInt32(&m.running, 0)
 	for {
 		conn, err := m.listener.Accept()
 		if err != nil {
@@ -124,16 +197,13 @@ func (m *VhostMuxer) handle(conn net.Conn) {
 		}
 	}()
 
-	// Make sure we detect dead connections while we decide how to multiplex
+	// Make sure we detect dead connections while we decide how to multiplex.
+	// route clears the deadline before queueing the connection; on errors
+	// it also bounds writing the error page.
 	if err := conn.SetDeadline(time.Now().Add(m.muxTimeout)); err != nil {
 		m.sendError(conn, fmt.Errorf("Failed to set deadline: %v", err))
 		return
 	}
-	defer func() {
-		if err := conn.SetDeadline(time.Time{}); err != nil {
-			m.sendError(conn, fmt.Errorf("Failed unset connection deadline: %v", err))
-		}
-	}()
 
 	// extract the name
 	vconn, err := m.vhostFn(conn)
@@ -142,80 +212,172 @@ func (m *VhostMuxer) handle(conn net.Conn) {
 		return
 	}
 
+	m.route(vconn)
+}
+
+// route hands vconn to the listener bound to its name, protocols and path,
+// routing it again if that listener closes before taking it.
+func (m *VhostMuxer) route(vconn Conn) {
 	// normalize the name
 	host := normalize(vconn.Host())
 
 	// look up the correct listener
-	l, ok := m.get(host)
-	if !ok {
-		m.sendError(vconn, NotFound{fmt.Errorf("Host not found: %v", host)})
-		return
+	var protos []string
+	if pc, ok := vconn.(protocolConn); ok {
+		protos = pc.Protocols()
+	}
+	var path string
+	if pc, ok := vconn.(pathConn); ok {
+		path = pc.Path()
 	}
+	for {
+		l, shared := m.get(host, protos, path)
+		if l == nil {
+			m.sendError(vconn, NotFound{fmt.Errorf("Host not found: %v", host)})
+			return
+		}
+		// an HTTP/2 connection is routed by its first stream only
+		if hc, ok := vconn.(*HTTPConn); ok && hc.streamID != 0 && l.path != "" {
+			m.sendError(vconn, Misdirected{fmt.Errorf("HTTP/2 connection to path prefix %v%v", host, l.path)})
+			return
+		}
+
+		// the deadline is cleared before the connection is queued, once
+		// there the listener's consumer owns it
+		if err := vconn.SetDeadline(time.Time{}); err != nil {
+			m.sendError(vconn, fmt.Errorf("Failed unset connection deadline: %v", err))
+			return
+		}
 
-	l.accept <- vconn
+		var conn Conn = vconn
+		if shared {
+			atomic.AddInt64(&l.active, 1)
+			conn = &trackedConn{Conn: vconn, l: l}
+		}
+		err := l.enqueue(conn)
+		if err == nil {
+			return
+		}
+		if shared {
+			atomic.AddInt64(&l.active, -1)
+		}
+		if err == errQueueFull {
+			m.sendError(vconn, Unavailable{fmt.Errorf("Listener for %v did not accept within %v", host, l.timeout)})
+			return
+		}
+		// closed or replaced meanwhile, route again
+	}
+}
+
+// reroute routes again a connection left in the queue of a closed
+// listener.
+func (m *VhostMuxer) reroute(conn Conn) {
+	if tc, ok := conn.(*trackedConn); ok {
+		tc.once.Do(func() { atomic.AddInt64(&tc.l.active, -1) })
+		conn = tc.Conn
+	}
+	m.route(conn)
 }
 
 func (m *VhostMuxer) sendError(conn net.Conn, err error) {
 	m.muxErrors <- muxErr{conn: conn, err: err}
 }
 
-func (m *VhostMuxer) get(name string) (l *Listener, ok bool) {
+// get returns the listener for the connection to name, and whether its
+// route is shared. Routes are searched in this order: a protocol the
+// connection offers, in the client's order of preference, before any
+// protocol; the name before the wildcards matching it, the most specific
+// first; the longest path prefix.
+func (m *VhostMuxer) get(name string, protos []string, path string) (*Listener, bool) {
+	names := hostCandidates(name)
+	protos = append(protos[:len(protos):len(protos)], "")
+
 	m.RLock()
 	defer m.RUnlock()
-	l, ok = m.registry[name]
-	if !ok {
-		// look for a matching wildcard
-		parts := strings.Split(name, ".")
-		for i := 0; i < len(parts)-1; i++ {
-			parts[i] = "*"
-			name = strings.Join(parts[i:], ".")
-			l, ok = m.registry[name]
-			if ok {
-				break
+	for _, proto := range protos {
+		for _, name := range names {
+			if r := m.registry[hostKey{name: name, proto: proto}].match(path); r != nil {
+				if !r.shared {
+					return r.listeners[0], false
+				}
+				return r.listeners[r.balancer.Pick(r.listeners)], true
 			}
 		}
 	}
-	return
+	return nil, false
 }
 
-func (m *VhostMuxer) set(name string, l *Listener) error {
+// set binds l to its routes, and returns the listeners it replaced.
+func (m *VhostMuxer) set(l *Listener, opts ListenOptions) ([]*Listener, error) {
 	m.Lock()
 	defer m.Unlock()
-	if _, exists := m.registry[name]; exists {
-		return fmt.Errorf("name %s is already bound", name)
+	for _, key := range l.keys {
+		r := m.registry[key][l.path]
+		if r == nil || opts.Replace || (opts.Shared && r.shared) {
+			continue
+		}
+		name := key.name + l.path
+		if key.proto != "" {
+			return nil, fmt.Errorf("name %s is already bound for protocol %s", name, key.proto)
+		}
+		return nil, fmt.Errorf("name %s is already bound", name)
 	}
-	m.registry[name] = l
-	return nil
+
+	var replaced []*Listener
+	for _, key := range l.keys {
+		routes := m.registry[key]
+		if routes == nil {
+			routes = make(hostRoutes)
+			m.registry[key] = routes
+		}
+		r := routes[l.path]
+		if r != nil && !opts.Replace {
+			r.listeners = append(r.listeners, l)
+			continue
+		}
+		if r != nil {
+			replaced = append(replaced, r.listeners...)
+		}
+		r = &route{listeners: []*Listener{l}, shared: opts.Shared, balancer: opts.Balancer}
+		if r.balancer == nil {
+			r.balancer = RoundRobin()
+		}
+		routes[l.path] = r
+	}
+	return replaced, nil
 }
 
-func (m *VhostMuxer) del(name string) {
+// del unbinds l from its routes.
+func (m *VhostMuxer) del(l *Listener) {
 	m.Lock()
 	defer m.Unlock()
-	delete(m.registry, name)
+	for _, key := range l.keys {
+		routes := m.registry[key]
+		r := routes[l.path]
+		if r == nil {
+			continue
+		}
+		for i, other := range r.listeners {
+			if other == l {
+				r.listeners = append(r.listeners[:i:i], r.listeners[i+1:]...)
+				break
+			}
+		}
+		if len(r.listeners) == 0 {
+			delete(routes, l.path)
+		}
+		if len(routes) == 0 {
+			delete(m.registry, key)
+		}
+	}
 }
 
-const (
-	serverError = `HTTP/1.0 500 Internal Server Error
-Content-Length: 22
-
-Internal Server Error
-`
-
-	notFound = `HTTP/1.0 404 Not Found
-Content-Length: 14
-
-404 not found
-`
-
-	badRequest = `HTTP/1.0 400 Bad Request
-Content-Length: 12
-
-Bad Request
-`
-)
-
 type HTTPMuxer struct {
 	*VhostMuxer
+
+	// Pages renders the error responses of HandleError. nil means the
+	// default pages.
+	Pages *ErrorPages
 }
 
 // HandleErrors handles muxing errors by calling .NextError(). You must
@@ -226,23 +388,34 @@ func (m *HTTPMuxer) HandleErrors() {
 	}
 }
 
+// HandleError answers the client of a connection that could not be muxed
+// with an error page, and closes it.
 func (m *HTTPMuxer) HandleError(conn net.Conn, err error) {
-	switch err.(type) {
-	case Closed:
+	if _, ok := err.(Closed); ok || conn == nil {
 		return
+	}
+
+	pages := m.Pages
+	if pages == nil {
+		pages = &ErrorPages{}
+	}
+	var req *http.Request
+	if hc, ok := conn.(*HTTPConn); ok {
+		req = hc.Request
+	}
+	switch err.(type) {
 	case NotFound:
-		conn.Write([]byte(notFound))
+		pages.Write(conn, req, PageUnknownHost)
 	case BadRequest:
-		conn.Write([]byte(badRequest))
+		pages.Write(conn, req, PageBadRequest)
+	case Unavailable:
+		pages.Write(conn, req, PageUnavailable)
+	case Misdirected:
+		pages.Write(conn, req, PageMisdirected)
 	default:
-		if conn != nil {
-			conn.Write([]byte(serverError))
-		}
-	}
-
-	if conn != nil {
-		conn.Close()
+		pages.Write(conn, req, PageServerError)
 	}
+	conn.Close()
 }
 
 // NewHTTPMuxer begins muxing HTTP connections on the given listener by inspecting
@@ -250,7 +423,7 @@ func (m *HTTPMuxer) HandleError(conn net.Conn, err error) {
 func NewHTTPMuxer(listener net.Listener, muxTimeout time.Duration) (*HTTPMuxer, error) {
 	fn := func(c net.Conn) (Conn, error) { return HTTP(c) }
 	mux, err := NewVhostMuxer(listener, fn, muxTimeout)
-	return &HTTPMuxer{mux}, err
+	return &HTTPMuxer{VhostMuxer: mux}, err
 }
 
 type TLSMuxer struct {
@@ -278,13 +451,23 @@ func (m *TLSMuxer) HandleErrors() {
 	}
 }
 
-func (m *TLSMuxer) Listen(name string) (net.Listener, error) {
+// Listen returns a listener for the connections to name. With protos, it
+// only gets those whose ClientHello offers one of them with ALPN, before
+// any listener for name without protocols: for example "acme-tls/1" for
+// TLS-ALPN-01 challenges can be answered apart from the h2 and http/1.1
+// traffic to the same name.
+func (m *TLSMuxer) Listen(name string, protos ...string) (net.Listener, error) {
+	return m.ListenWith(name, ListenOptions{Protocols: protos})
+}
+
+// ListenWith is Listen with options, see VhostMuxer.ListenWith.
+func (m *TLSMuxer) ListenWith(name string, opts ListenOptions) (*Listener, error) {
 	// TLS SNI never includes the port
 	host, _, err := net.SplitHostPort(name)
 	if err != nil {
 		host = name
 	}
-	return m.VhostMuxer.Listen(host)
+	return m.VhostMuxer.ListenWith(host, opts)
 }
 
 // NewTLSMuxer begins muxing TLS connections by inspecting the SNI extension.
@@ -303,31 +486,112 @@ func NewTLSMuxer(listener net.Listener, muxTimeout time.Duration) (*TLSMuxer, er
 // the parent muxer will stop listening for connections to the Listener's name.
 type Listener struct {
 	name      string
+	path      string
+	keys      []hostKey
 	mux       *VhostMuxer
-	accept    chan Conn
+	accept    chan Conn // the accept queue
+	timeout   time.Duration
+	queueing  sync.RWMutex // held for reading while queueing, see Close
+	closed    chan struct{}
 	closeOnce sync.Once
+	active    int64 // open connections, counted on shared routes
+	strip     bool  // strip the path prefix from HTTP requests
+	prefix    bool  // pass the path prefix in X-Forwarded-Prefix
 }
 
 // Accept returns the next mux'd connection for this listener and blocks
-// until one is available.
+// until one is available. On a shared route the connection is wrapped to
+// count it in Active until it is closed; its Unwrap method returns the
+// muxed connection.
 func (l *Listener) Accept() (net.Conn, error) {
-	conn, ok := <-l.accept
-	if !ok {
+	select {
+	case <-l.closed:
 		return nil, fmt.Errorf("Listener closed")
+	default:
+	}
+	select {
+	case conn := <-l.accept:
+		l.rewrite(conn)
+		return conn, nil
+	case <-l.closed:
+		return nil, fmt.Errorf("Listener closed")
+	}
+}
+
+// enqueue adds conn to the accept queue, waiting up to the enqueue timeout
+// for room. It fails with errListenerClosed once the listener is closed,
+// and errQueueFull when the timeout expires.
+func (l *Listener) enqueue(conn Conn) error {
+	l.queueing.RLock()
+	defer l.queueing.RUnlock()
+	select {
+	case <-l.closed:
+		return errListenerClosed
+	default:
+	}
+
+	select {
+	case l.accept <- conn:
+		return nil
+	default:
+	}
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+	select {
+	case l.accept <- conn:
+		return nil
+	case <-l.closed:
+		return errListenerClosed
+	case <-timer.C:
+		return errQueueFull
+	}
+}
+
+// rewrite applies the path prefix options of the listener to the HTTP
+// request on conn. It is done on Accept since a connection may be routed
+// again before it is delivered.
+func (l *Listener) rewrite(conn Conn) {
+	if l.path == "" || (!l.strip && !l.prefix) {
+		return
+	}
+	if tc, ok := conn.(*trackedConn); ok {
+		conn = tc.Conn
+	}
+	if hc, ok := conn.(*HTTPConn); ok {
+		hc.rewritePrefix(l.path, l.strip, l.prefix)
 	}
-	return conn, nil
 }
 
 // Close stops the parent muxer from listening for connections to the mux'd
-// virtual host name.
+// virtual host name. The connections still in its accept queue are routed
+// again, to the listeners now bound to the name if any.
 func (l *Listener) Close() error {
 	l.closeOnce.Do(func() {
-		l.mux.del(l.name)
-		close(l.accept)
+		l.mux.del(l)
+		close(l.closed)
+
+		// wait for the connections being queued, which now see the
+		// listener closed, so that nothing is queued after the drain
+		l.queueing.Lock()
+		defer l.queueing.Unlock()
+		for {
+			select {
+			case conn := <-l.accept:
+				go l.mux.reroute(conn)
+			default:
+				return
+			}
+		}
 	})
 	return nil
 }
 
+// Active returns how many of the connections accepted from the listener
+// are still open. Only connections of shared routes are counted.
+func (l *Listener) Active() int64 {
+	return atomic.LoadInt64(&l.active)
+}
+
 // Addr returns the address of the bound listener used by the parent muxer.
 func (l *Listener) Addr() net.Addr {
 	// XXX: include name in address?
@@ -338,3 +602,9 @@ func (l *Listener) Addr() net.Addr {
 func (l *Listener) Name() string {
 	return l.name
 }
+
+// Path returns the path prefix this listener receives requests for, "" for
+// the whole host.
+func (l *Listener) Path() string {
+	return l.path
+}
@@ -1,6 +1,7 @@
 package vhost
 
 import (
+	"bufio"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -8,6 +9,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 
 	"testing"
 	"time"
@@ -123,14 +125,14 @@ func testMux(t *testing.T, listen, dial string) {
 	go func() {
 		conn, err := l.Accept()
 		if err != nil {
-			t.Fatalf("failed to accept connection: %v", err)
+			t.Errorf("failed to accept connection: %v", err)
 			return
 		}
 
 		got := conn.(Conn).Host()
 		expected := dial
 		if got != expected {
-			t.Fatalf("got connection with unexpected host. got: %s, expected: %s", got, expected)
+			t.Errorf("got connection with unexpected host. got: %s, expected: %s", got, expected)
 			return
 		}
 
@@ -140,7 +142,7 @@ func testMux(t *testing.T, listen, dial string) {
 	go func() {
 		_, err := mux.NextError()
 		if err != nil {
-			t.Fatalf("muxing error: %v", err)
+			t.Errorf("muxing error: %v", err)
 		}
 	}()
 
@@ -193,3 +195,508 @@ func (l fakeListener) Accept() (net.Conn, error) {
 }
 func (fakeListener) Addr() net.Addr { return nil }
 func (fakeListener) Close() error   { return nil }
+
+func TestAccepting(t *testing.T) {
+	l, _ := localListener(t)
+	mux, err := NewHTTPMuxer(l, time.Second)
+	if err != nil {
+		t.Fatalf("failed to start muxer: %v", err)
+	}
+	go mux.HandleErrors()
+
+	if !mux.Accepting() {
+		t.Fatal("expected a fresh muxer to be accepting")
+	}
+
+	mux.Close()
+	deadline := time.Now().Add(time.Second)
+	for mux.Accepting() {
+		if time.Now().After(deadline) {
+			t.Fatal("muxer still accepting after its listener was closed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// newTableMuxer returns a muxer that never accepts, to test its routing
+// table through get.
+func newTableMuxer(t *testing.T) *VhostMuxer {
+	mux, err := NewVhostMuxer(make(fakeListener), nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mux
+}
+
+func mustListen(t *testing.T, mux *VhostMuxer, name string, opts ListenOptions) *Listener {
+	t.Helper()
+	l, err := mux.ListenWith(name, opts)
+	if err != nil {
+		t.Fatalf("listen %s: %v", name, err)
+	}
+	return l
+}
+
+func TestPathPrefixRoutes(t *testing.T) {
+	mux := newTableMuxer(t)
+	site := mustListen(t, mux, "example.com", ListenOptions{})
+	api := mustListen(t, mux, "example.com/api/", ListenOptions{})
+	v2 := mustListen(t, mux, "example.com/api/v2", ListenOptions{})
+	wildcardDocs := mustListen(t, mux, "*.example.com/docs", ListenOptions{})
+
+	tests := []struct {
+		host, path string
+		want       *Listener
+	}{
+		{"example.com", "/", site},
+		{"example.com", "/api", api},
+		{"example.com", "/api/users", api},
+		{"example.com", "/apis", site},
+		{"example.com", "/api/v2/users", v2},
+		{"example.com", "/api/v23", api},
+		{"www.example.com", "/docs/intro", wildcardDocs},
+		{"www.example.com", "/", nil},
+	}
+	for _, test := range tests {
+		if got, _ := mux.get(test.host, nil, test.path); got != test.want {
+			t.Errorf("%s%s: got listener %v, want %v", test.host, test.path, got, test.want)
+		}
+	}
+	if api.Path() != "/api" || api.Name() != "example.com" {
+		t.Fatalf("unexpected listener name %q and path %q", api.Name(), api.Path())
+	}
+
+	// the host is still served once a prefix is gone
+	v2.Close()
+	if got, _ := mux.get("example.com", nil, "/api/v2/users"); got != api {
+		t.Fatalf("expected the /api listener after closing /api/v2, got %v", got)
+	}
+}
+
+func TestSharedRoutes(t *testing.T) {
+	mux := newTableMuxer(t)
+	a := mustListen(t, mux, "example.com", ListenOptions{Shared: true})
+	b := mustListen(t, mux, "example.com", ListenOptions{Shared: true})
+	if _, err := mux.Listen("example.com"); err == nil {
+		t.Fatal("expected a listener that does not share to be refused")
+	}
+
+	var got []*Listener
+	for i := 0; i < 4; i++ {
+		l, shared := mux.get("example.com", nil, "/")
+		if !shared {
+			t.Fatal("expected a shared route")
+		}
+		got = append(got, l)
+	}
+	if got[0] == got[1] || got[0] != got[2] || got[1] != got[3] {
+		t.Fatalf("expected round-robin, got %v", got)
+	}
+
+	least := newTableMuxer(t)
+	busy := mustListen(t, least, "example.com", ListenOptions{Shared: true, Balancer: LeastConnections()})
+	idle := mustListen(t, least, "example.com", ListenOptions{Shared: true})
+	busy.active = 3
+	idle.active = 1
+	if l, _ := least.get("example.com", nil, ""); l != idle {
+		t.Fatal("expected the listener with the fewest connections")
+	}
+
+	// closing one listener leaves the route to the other
+	a.Close()
+	for i := 0; i < 2; i++ {
+		if l, _ := mux.get("example.com", nil, ""); l != b {
+			t.Fatal("expected the remaining listener")
+		}
+	}
+}
+
+func TestLeastConnectionsCountsOpenConns(t *testing.T) {
+	l, port := localListener(t)
+	mux, err := NewHTTPMuxer(l, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mux.Close()
+	go mux.HandleErrors()
+
+	host := "localhost:" + port
+	a := mustListen(t, mux.VhostMuxer, host, ListenOptions{Shared: true, Balancer: LeastConnections()})
+	b := mustListen(t, mux.VhostMuxer, host, ListenOptions{Shared: true})
+
+	accepted := make(chan net.Conn, 3)
+	for _, l := range []*Listener{a, b} {
+		go func(l *Listener) {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				accepted <- conn
+			}
+		}(l)
+	}
+	next := func() net.Conn {
+		c, err := net.Dial("tcp", host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		fmt.Fprintf(c, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", host)
+		select {
+		case conn := <-accepted:
+			return conn
+		case <-time.After(5 * time.Second):
+			t.Fatal("connection not accepted")
+			return nil
+		}
+	}
+
+	first := next()
+	next()
+	if a.Active() != 1 || b.Active() != 1 {
+		t.Fatalf("expected one connection each, got %d and %d", a.Active(), b.Active())
+	}
+	if _, ok := first.(interface{ Unwrap() Conn }).Unwrap().(*HTTPConn); !ok {
+		t.Fatal("expected the muxed HTTP connection to be unwrappable")
+	}
+	first.Close()
+	first.Close()
+	third := next()
+	if a.Active()+b.Active() != 2 || third.(Conn).Host() != host {
+		t.Fatalf("unexpected counts %d and %d", a.Active(), b.Active())
+	}
+}
+
+// Taking over a name must not leave a gap where connections get 404.
+func TestReplaceIsAtomic(t *testing.T) {
+	l, port := localListener(t)
+	mux, err := NewHTTPMuxer(l, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mux.Close()
+	notFound := make(chan error, 100)
+	go func() {
+		for {
+			conn, err := mux.NextError()
+			if _, ok := err.(Closed); ok {
+				return
+			}
+			if _, ok := err.(NotFound); ok {
+				notFound <- err
+			}
+			if conn != nil {
+				conn.Close()
+			}
+		}
+	}()
+
+	host := "localhost:" + port
+	serve := func(l net.Listener) {
+		http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	}
+	old := mustListen(t, mux.VhostMuxer, host, ListenOptions{})
+	go serve(old)
+
+	stop := make(chan struct{})
+	errs := make(chan error, 1)
+	go func() {
+		client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+		for {
+			select {
+			case <-stop:
+				errs <- nil
+				return
+			default:
+			}
+			resp, err := client.Get("http://" + host + "/")
+			if err != nil {
+				errs <- err
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				errs <- fmt.Errorf("got status %d", resp.StatusCode)
+				return
+			}
+		}
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	replacement := mustListen(t, mux.VhostMuxer, host, ListenOptions{Replace: true})
+	go serve(replacement)
+	time.Sleep(20 * time.Millisecond)
+	close(stop)
+
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-notFound:
+		t.Fatalf("a request was not routed: %v", err)
+	default:
+	}
+	if _, err := old.Accept(); err == nil {
+		t.Fatal("expected the replaced listener to be closed")
+	}
+}
+
+func TestPrefixRewrite(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux, err := NewHTTPMuxer(l, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mux.Close()
+	go mux.HandleErrors()
+
+	alice, err := mux.ListenWith("example.com/alice", ListenOptions{StripPrefix: true, ForwardedPrefix: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	go http.Serve(alice, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s?%s %s", r.URL.Path, r.URL.RawQuery, r.Header.Get("X-Forwarded-Prefix"))
+	}))
+
+	tests := []struct {
+		path, want string
+	}{
+		{"/alice/app?x=1", "/app?x=1 /alice"},
+		{"/alice", "/? /alice"},
+		{"/alice/a%2Fb", "/a/b? /alice"},
+	}
+	for _, test := range tests {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: example.com\r\nX-Forwarded-Prefix: /spoofed\r\nConnection: keep-alive\r\n\r\n", test.path)
+		body, err := ioutil.ReadAll(conn)
+		conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := string(body)
+		if !strings.HasSuffix(resp, "\r\n\r\n"+test.want) {
+			t.Errorf("%s: got response %q, want body %q", test.path, resp, test.want)
+		}
+		// the backend closes after the response, so the client opens a
+		// new connection that is routed again
+		if !strings.Contains(resp, "Connection: close") {
+			t.Errorf("%s: expected the backend to close the connection, got %q", test.path, resp)
+		}
+	}
+}
+
+// getStatus sends a request for host through the muxer on l and returns the
+// status of the response.
+func getStatus(l net.Listener, host string) (int, error) {
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	req, _ := http.NewRequest("GET", "http://"+host+"/", nil)
+	if err := req.Write(conn); err != nil {
+		return 0, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+func TestAcceptQueueFull(t *testing.T) {
+	l, _ := localListener(t)
+	mux, err := NewHTTPMuxer(l, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mux.Close()
+	go mux.HandleErrors()
+
+	slow := mustListen(t, mux.VhostMuxer, "example.com", ListenOptions{QueueSize: 1, EnqueueTimeout: 20 * time.Millisecond})
+	queued := make(chan error, 1)
+	go func() {
+		_, err := getStatus(l, "example.com")
+		queued <- err
+	}()
+	// wait for the first connection to fill the queue
+	for len(slow.accept) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	start := time.Now()
+	status, err := getStatus(l, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusServiceUnavailable {
+		t.Fatalf("expected %d with a full queue, got %d", http.StatusServiceUnavailable, status)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Fatalf("expected to wait for the enqueue timeout, answered after %v", elapsed)
+	}
+
+	conn, err := slow.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.(*HTTPConn).Host() != "example.com" {
+		t.Fatalf("unexpected queued connection for %q", conn.(*HTTPConn).Host())
+	}
+	conn.Close()
+	if err := <-queued; err == nil {
+		t.Fatal("expected the queued connection to get no response")
+	}
+}
+
+// Connections queued on a listener that closes are not lost: they go to
+// the listener that replaced it, even while connections keep coming.
+func TestCloseReroutesQueued(t *testing.T) {
+	l, _ := localListener(t)
+	mux, err := NewHTTPMuxer(l, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mux.Close()
+	go mux.HandleErrors()
+
+	// never accepts, so everything it gets stays queued
+	old := mustListen(t, mux.VhostMuxer, "example.com", ListenOptions{QueueSize: 4})
+
+	const clients = 32
+	statuses := make(chan int, clients)
+	for i := 0; i < clients; i++ {
+		go func() {
+			status, err := getStatus(l, "example.com")
+			if err != nil {
+				t.Error(err)
+			}
+			statuses <- status
+		}()
+	}
+	for len(old.accept) < cap(old.accept) {
+		time.Sleep(time.Millisecond)
+	}
+
+	replacement := mustListen(t, mux.VhostMuxer, "example.com", ListenOptions{Replace: true})
+	go http.Serve(replacement, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer replacement.Close()
+
+	for i := 0; i < clients; i++ {
+		if status := <-statuses; status != http.StatusOK {
+			t.Fatalf("expected every request to reach the replacement, got %d", status)
+		}
+	}
+	if _, err := old.Accept(); err == nil {
+		t.Fatal("expected the replaced listener to be closed")
+	}
+}
+
+func TestConcurrentEnqueueAndClose(t *testing.T) {
+	mux := newTableMuxer(t)
+	// the connections drained on close find no route
+	go func() {
+		for {
+			mux.NextError()
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		l := mustListen(t, mux, "example.com", ListenOptions{QueueSize: 2, EnqueueTimeout: time.Millisecond})
+		var wg sync.WaitGroup
+		for j := 0; j < 8; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				l.enqueue(&HTTPConn{})
+			}()
+		}
+		go l.Close()
+		wg.Wait()
+		l.Close()
+		if n := len(l.accept); n != 0 {
+			t.Fatalf("%d connections left in the queue of a closed listener", n)
+		}
+	}
+}
+
+// deadlineConn records the deadlines set on it. Clearing the deadline is
+// slow, to let a consumer that races with it set its own first.
+type deadlineConn struct {
+	net.Conn
+	mu        sync.Mutex
+	deadlines []time.Time
+}
+
+func (c *deadlineConn) SetDeadline(d time.Time) error {
+	if d.IsZero() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadlines = append(c.deadlines, d)
+	return nil
+}
+
+func (c *deadlineConn) last() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.deadlines[len(c.deadlines)-1]
+}
+
+type namedConn struct {
+	net.Conn
+	host string
+}
+
+func (c namedConn) Host() string { return c.host }
+func (c namedConn) Free()        {}
+
+type connListener chan net.Conn
+
+func (l connListener) Accept() (net.Conn, error) {
+	for c := range l {
+		return c, nil
+	}
+	select {}
+}
+func (connListener) Addr() net.Addr { return nil }
+func (connListener) Close() error   { return nil }
+
+// The mux deadline is cleared before a connection is queued, so it never
+// overwrites the deadline its consumer sets once it has accepted it.
+func TestDeadlineClearedBeforeQueueing(t *testing.T) {
+	conns := make(connListener, 1)
+	mux, err := NewVhostMuxer(conns, func(c net.Conn) (Conn, error) {
+		return namedConn{c, "example.com"}, nil
+	}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := mustListen(t, mux, "example.com", ListenOptions{})
+
+	raw := &deadlineConn{}
+	conns <- raw
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !raw.last().IsZero() {
+		t.Fatalf("expected no deadline on the accepted connection, got %v", raw.last())
+	}
+
+	own := time.Now().Add(time.Minute)
+	conn.SetDeadline(own)
+	time.Sleep(20 * time.Millisecond)
+	if got := raw.last(); !got.Equal(own) {
+		t.Fatalf("expected the consumer's deadline %v to stay, got %v", own, got)
+	}
+}
@@ -0,0 +1,242 @@
+package vhost
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// proxyV2Sig starts every PROXY protocol v2 header.
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	proxyV1MaxLen = 107 // the longest v1 line, CRLF included
+
+	proxyV2Local = 0x20 // version 2, LOCAL command
+	proxyV2Proxy = 0x21 // version 2, PROXY command
+
+	proxyV2Unspec = 0x00
+	proxyV2TCP4   = 0x11
+	proxyV2TCP6   = 0x21
+
+	proxyV2TypeAuthority = 0x02
+)
+
+// ErrNoProxyHeader is returned when a connection from a trusted source does
+// not start with a PROXY protocol header.
+var ErrNoProxyHeader = errors.New("vhost: no PROXY protocol header")
+
+// ProxyListener accepts the connections of a listener that sits behind
+// load balancers speaking the PROXY protocol, v1 or v2. Connections from
+// the Trusted networks must start with a header, and report the client and
+// destination it carries as their remote and local addresses. Those from
+// anywhere else are passed through untouched, so that nobody but the load
+// balancers can claim another address.
+//
+// The header is read on the first call to Read, RemoteAddr or LocalAddr,
+// not in Accept, so that a slow client does not hold up the others. Wrap
+// the listener given to a muxer, which reads under its mux timeout.
+type ProxyListener struct {
+	net.Listener
+	Trusted []*net.IPNet
+}
+
+// Accept returns the next connection, as a *ProxyConn if its source is
+// trusted.
+func (l *ProxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		for _, n := range l.Trusted {
+			if n.Contains(addr.IP) {
+				return &ProxyConn{Conn: conn}, nil
+			}
+		}
+	}
+	return conn, nil
+}
+
+// ProxyConn is a connection that starts with a PROXY protocol header.
+type ProxyConn struct {
+	net.Conn
+	once       sync.Once
+	br         *bufio.Reader
+	err        error
+	remoteAddr net.Addr
+	localAddr  net.Addr
+}
+
+// readHeader reads the header once, falling back to the addresses of the
+// connection for LOCAL and UNKNOWN headers.
+func (c *ProxyConn) readHeader() error {
+	c.once.Do(func() {
+		c.br = bufio.NewReader(c.Conn)
+		c.remoteAddr, c.localAddr, c.err = readProxyHeader(c.br)
+		if c.remoteAddr == nil {
+			c.remoteAddr, c.localAddr = c.Conn.RemoteAddr(), c.Conn.LocalAddr()
+		}
+	})
+	return c.err
+}
+
+func (c *ProxyConn) Read(p []byte) (int, error) {
+	if err := c.readHeader(); err != nil {
+		return 0, err
+	}
+	return c.br.Read(p)
+}
+
+// RemoteAddr returns the client address from the header.
+func (c *ProxyConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	return c.remoteAddr
+}
+
+// LocalAddr returns the address the client connected to from the header.
+func (c *ProxyConn) LocalAddr() net.Addr {
+	c.readHeader()
+	return c.localAddr
+}
+
+// readProxyHeader reads a v1 or v2 header from br. The addresses are nil
+// for headers that do not carry any.
+func readProxyHeader(br *bufio.Reader) (src, dst net.Addr, err error) {
+	sig, err := br.Peek(len(proxyV2Sig))
+	if err != nil {
+		return nil, nil, fmt.Errorf("vhost: reading PROXY header: %v", err)
+	}
+	switch {
+	case bytes.Equal(sig, proxyV2Sig):
+		return readProxyV2(br)
+	case bytes.HasPrefix(sig, []byte("PROXY ")):
+		return readProxyV1(br)
+	}
+	return nil, nil, ErrNoProxyHeader
+}
+
+// readProxyV1 reads "PROXY TCP4 src dst sport dport\r\n".
+func readProxyV1(br *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLen {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, nil, fmt.Errorf("vhost: reading PROXY header: %v", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errors.New("vhost: malformed PROXY v1 header")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("vhost: malformed PROXY v1 header %q", line)
+	}
+	src, err := parseProxyV1Addr(fields[1], fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := parseProxyV1Addr(fields[1], fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+func parseProxyV1Addr(family, ip, port string) (*net.TCPAddr, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil || (addr.To4() != nil) != (family == "TCP4") {
+		return nil, fmt.Errorf("vhost: bad %s address %q in PROXY v1 header", family, ip)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || (len(port) > 1 && port[0] == '0') {
+		return nil, fmt.Errorf("vhost: bad port %q in PROXY v1 header", port)
+	}
+	return &net.TCPAddr{IP: addr, Port: int(p)}, nil
+}
+
+// readProxyV2 reads a binary header, TLVs and all.
+func readProxyV2(br *bufio.Reader) (net.Addr, net.Addr, error) {
+	var fixed [16]byte
+	if _, err := io.ReadFull(br, fixed[:]); err != nil {
+		return nil, nil, fmt.Errorf("vhost: reading PROXY header: %v", err)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(fixed[14:16]))
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, nil, fmt.Errorf("vhost: reading PROXY header: %v", err)
+	}
+
+	switch fixed[12] {
+	case proxyV2Local:
+		return nil, nil, nil
+	case proxyV2Proxy:
+	default:
+		return nil, nil, fmt.Errorf("vhost: unsupported PROXY v2 version and command %#x", fixed[12])
+	}
+
+	var size int
+	switch fixed[13] {
+	case proxyV2TCP4:
+		size = net.IPv4len
+	case proxyV2TCP6:
+		size = net.IPv6len
+	default:
+		// UDP, unix sockets and unspecified: keep the real addresses
+		return nil, nil, nil
+	}
+	if len(body) < 2*size+4 {
+		return nil, nil, errors.New("vhost: truncated PROXY v2 addresses")
+	}
+	src := &net.TCPAddr{IP: net.IP(body[:size]), Port: int(binary.BigEndian.Uint16(body[2*size:]))}
+	dst := &net.TCPAddr{IP: net.IP(body[size : 2*size]), Port: int(binary.BigEndian.Uint16(body[2*size+2:]))}
+	return src, dst, nil
+}
+
+// ProxyHeaderV2 returns a PROXY protocol v2 header for a connection from
+// src to dst. authority, the host name the client asked for, is sent in a
+// PP2_TYPE_AUTHORITY TLV if set. Addresses that are not TCP, or not of the
+// same family, are sent as unspecified.
+func ProxyHeaderV2(src, dst net.Addr, authority string) []byte {
+	var fam byte = proxyV2Unspec
+	var addrs []byte
+	s, sok := src.(*net.TCPAddr)
+	d, dok := dst.(*net.TCPAddr)
+	if sok && dok {
+		if s4, d4 := s.IP.To4(), d.IP.To4(); s4 != nil && d4 != nil {
+			fam = proxyV2TCP4
+			addrs = append(append(addrs, s4...), d4...)
+		} else if s4 == nil && d4 == nil && len(s.IP) == net.IPv6len && len(d.IP) == net.IPv6len {
+			fam = proxyV2TCP6
+			addrs = append(append(addrs, s.IP...), d.IP...)
+		}
+		if fam != proxyV2Unspec {
+			addrs = binary.BigEndian.AppendUint16(addrs, uint16(s.Port))
+			addrs = binary.BigEndian.AppendUint16(addrs, uint16(d.Port))
+		}
+	}
+	if authority != "" {
+		addrs = append(addrs, proxyV2TypeAuthority)
+		addrs = binary.BigEndian.AppendUint16(addrs, uint16(len(authority)))
+		addrs = append(addrs, authority...)
+	}
+
+	header := append([]byte{}, proxyV2Sig...)
+	header = append(header, proxyV2Proxy, fam)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addrs)))
+	return append(header, addrs...)
+}
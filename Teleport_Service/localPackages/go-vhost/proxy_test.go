@@ -0,0 +1,154 @@
+package vhost
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	tcp := func(s string) net.Addr {
+		addr, err := net.ResolveTCPAddr("tcp", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return addr
+	}
+	v6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}
+	local := append(append([]byte{}, proxyV2Sig...), proxyV2Local, proxyV2Unspec, 0, 0)
+
+	tests := []struct {
+		name     string
+		header   string
+		src, dst net.Addr
+		err      string
+	}{
+		{"v1 tcp4", "PROXY TCP4 203.0.113.7 10.0.0.1 56324 443\r\n", tcp("203.0.113.7:56324"), tcp("10.0.0.1:443"), ""},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::7 2001:db8::1 56324 443\r\n", tcp("[2001:db8::7]:56324"), v6, ""},
+		{"v1 unknown", "PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n", nil, nil, ""},
+		{"v1 family mismatch", "PROXY TCP4 2001:db8::7 10.0.0.1 1 2\r\n", nil, nil, "bad TCP4 address"},
+		{"v1 bad port", "PROXY TCP4 203.0.113.7 10.0.0.1 056324 443\r\n", nil, nil, "bad port"},
+		{"v1 no crlf", "PROXY TCP4 203.0.113.7 10.0.0.1 56324 443\n", nil, nil, "malformed"},
+		{"v1 too long", "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", nil, nil, "malformed"},
+		{"v2 tcp4", string(ProxyHeaderV2(tcp("203.0.113.7:56324"), tcp("10.0.0.1:443"), "example.com")), tcp("203.0.113.7:56324"), tcp("10.0.0.1:443"), ""},
+		{"v2 tcp6", string(ProxyHeaderV2(tcp("[2001:db8::7]:56324"), v6, "")), tcp("[2001:db8::7]:56324"), v6, ""},
+		{"v2 mixed families", string(ProxyHeaderV2(tcp("203.0.113.7:56324"), v6, "")), nil, nil, ""},
+		{"v2 local", string(local), nil, nil, ""},
+		{"v2 bad version", string(append(append([]byte{}, proxyV2Sig...), 0x11, proxyV2TCP4, 0, 0)), nil, nil, "unsupported"},
+		{"v2 truncated", string(append(append([]byte{}, proxyV2Sig...), proxyV2Proxy, proxyV2TCP4, 0, 4, 1, 2, 3, 4)), nil, nil, "truncated"},
+		{"none", "GET / HTTP/1.1\r\n\r\n", nil, nil, ErrNoProxyHeader.Error()},
+	}
+	for _, test := range tests {
+		br := bufio.NewReader(strings.NewReader(test.header + "rest"))
+		src, dst, err := readProxyHeader(br)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected an error about %q, got %v", test.name, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !sameAddr(src, test.src) || !sameAddr(dst, test.dst) {
+			t.Errorf("%s: got %v -> %v, want %v -> %v", test.name, src, dst, test.src, test.dst)
+		}
+		if rest, _ := ioutil.ReadAll(br); string(rest) != "rest" {
+			t.Errorf("%s: the header was not consumed exactly, %q left", test.name, rest)
+		}
+	}
+}
+
+func sameAddr(a, b net.Addr) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.String() == b.String()
+}
+
+func TestProxyHeaderV2Authority(t *testing.T) {
+	src := &net.TCPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 56324}
+	dst := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 443}
+	header := ProxyHeaderV2(src, dst, "example.com")
+
+	want := append([]byte{}, proxyV2Sig...)
+	want = append(want, 0x21, 0x11, 0, 12+3+11)
+	want = append(want, 203, 0, 113, 7, 10, 0, 0, 1)
+	want = binary.BigEndian.AppendUint16(want, 56324)
+	want = binary.BigEndian.AppendUint16(want, 443)
+	want = append(want, 0x02, 0, 11)
+	want = append(want, "example.com"...)
+	if !bytes.Equal(header, want) {
+		t.Fatalf("got header\n%x\nwant\n%x", header, want)
+	}
+}
+
+func TestProxyListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, trusted, _ := net.ParseCIDR("127.0.0.2/32")
+	pl := &ProxyListener{Listener: l, Trusted: []*net.IPNet{trusted}}
+
+	dial := func(from string, data string) net.Conn {
+		d := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(from)}}
+		client, err := d.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { client.Close() })
+		client.Write([]byte(data))
+		conn, err := pl.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(time.Second))
+		return conn
+	}
+	read := func(conn net.Conn, n int) string {
+		b := make([]byte, n)
+		if _, err := conn.Read(b); err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	// a load balancer
+	conn := dial("127.0.0.2", "PROXY TCP4 203.0.113.7 10.0.0.1 56324 443\r\nGET")
+	if conn.RemoteAddr().String() != "203.0.113.7:56324" || conn.LocalAddr().String() != "10.0.0.1:443" {
+		t.Fatalf("expected the addresses of the header, got %v -> %v", conn.RemoteAddr(), conn.LocalAddr())
+	}
+	if got := read(conn, 3); got != "GET" {
+		t.Fatalf("expected the data after the header, got %q", got)
+	}
+
+	// a load balancer's health check
+	conn = dial("127.0.0.2", string(append(append([]byte{}, proxyV2Sig...), proxyV2Local, proxyV2Unspec, 0, 0))+"GET")
+	if got := read(conn, 3); got != "GET" || !strings.HasPrefix(conn.RemoteAddr().String(), "127.0.0.2:") {
+		t.Fatalf("expected the real address for a LOCAL header, got %v and %q", conn.RemoteAddr(), got)
+	}
+
+	// anyone else cannot claim an address
+	conn = dial("127.0.0.1", "PROXY TCP4 203.0.113.7 10.0.0.1 56324 443\r\n")
+	if _, ok := conn.(*ProxyConn); ok || !strings.HasPrefix(conn.RemoteAddr().String(), "127.0.0.1:") {
+		t.Fatalf("expected an untrusted connection to be passed through, got %T from %v", conn, conn.RemoteAddr())
+	}
+	if got := read(conn, 6); got != "PROXY " {
+		t.Fatalf("expected the header to be left as data, got %q", got)
+	}
+
+	// a trusted source must send a header
+	conn = dial("127.0.0.2", "GET / HTTP/1.1\r\n\r\n")
+	if _, err := conn.Read(make([]byte, 1)); err != ErrNoProxyHeader {
+		t.Fatalf("expected ErrNoProxyHeader, got %v", err)
+	}
+}
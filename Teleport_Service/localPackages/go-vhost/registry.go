@@ -0,0 +1,172 @@
+package vhost
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Balancer spreads the connections of a shared route over its listeners.
+type Balancer interface {
+	// Pick returns the index in listeners, which is never empty, of the
+	// listener that gets the next connection.
+	Pick(listeners []*Listener) int
+}
+
+// RoundRobin returns a Balancer that hands connections to the listeners
+// in turn.
+func RoundRobin() Balancer {
+	return &roundRobin{}
+}
+
+type roundRobin struct {
+	next uint64
+}
+
+func (b *roundRobin) Pick(listeners []*Listener) int {
+	return int((atomic.AddUint64(&b.next, 1) - 1) % uint64(len(listeners)))
+}
+
+// LeastConnections returns a Balancer that picks the listener with the
+// fewest open connections, see Listener.Active.
+func LeastConnections() Balancer {
+	return leastConnections{}
+}
+
+type leastConnections struct{}
+
+func (leastConnections) Pick(listeners []*Listener) int {
+	best := 0
+	for i, l := range listeners {
+		if l.Active() < listeners[best].Active() {
+			best = i
+		}
+	}
+	return best
+}
+
+// ListenOptions describe how a listener is bound to its route.
+type ListenOptions struct {
+	// Protocols restricts the listener to the connections offering one
+	// of them, with ALPN for TLS. A listener bound to a protocol wins
+	// over one bound to the same name without protocols.
+	Protocols []string
+
+	// Shared lets several listeners bind the same route, connections are
+	// then spread over them by Balancer. Every listener of the route has
+	// to set it.
+	Shared bool
+
+	// Balancer is the strategy of a shared route, set by its first
+	// listener. nil means RoundRobin.
+	Balancer Balancer
+
+	// Replace takes the route over from the listeners bound to it, which
+	// are closed. The switch is atomic: no connection finds the route
+	// unbound, and those on their way to a closed listener are routed
+	// again.
+	Replace bool
+
+	// StripPrefix removes the path prefix of the listener from the
+	// requests it gets, "example.com/alice" receiving "/alice/app" as
+	// "/app". HTTP/1 only.
+	StripPrefix bool
+
+	// ForwardedPrefix passes the path prefix of the listener to the
+	// backend in an X-Forwarded-Prefix header, for the links it builds
+	// once the prefix is stripped. HTTP/1 only.
+	ForwardedPrefix bool
+
+	// QueueSize is how many connections wait for the listener to accept
+	// them, 0 meaning DefaultQueueSize.
+	QueueSize int
+
+	// EnqueueTimeout is how long a connection waits for room in a full
+	// queue before it is given up as Unavailable, which HTTPMuxer answers
+	// with a 503. 0 means DefaultEnqueueTimeout.
+	EnqueueTimeout time.Duration
+}
+
+// hostKey is what the routes are registered under: a name, exact or
+// wildcard, and an application protocol, "" matching any protocol.
+type hostKey struct {
+	name  string
+	proto string
+}
+
+// hostRoutes are the routes of a hostKey by path prefix, "" covering the
+// whole host.
+type hostRoutes map[string]*route
+
+// route is the listeners bound to the same name, protocol and path prefix.
+type route struct {
+	listeners []*Listener
+	shared    bool
+	balancer  Balancer
+}
+
+// match returns the route with the longest path prefix of path, prefixes
+// matching whole segments only: "/api" matches "/api/users" but not
+// "/apis".
+func (h hostRoutes) match(path string) *route {
+	for {
+		if r, ok := h[path]; ok {
+			return r
+		}
+		if path == "" {
+			return nil
+		}
+		i := strings.LastIndexByte(path, '/')
+		if i < 0 {
+			i = 0
+		}
+		path = path[:i]
+	}
+}
+
+// splitRoute splits a name given to Listen into its host and path prefix.
+func splitRoute(name string) (host, path string) {
+	if i := strings.IndexByte(name, '/'); i >= 0 {
+		name, path = name[:i], name[i:]
+	}
+	return normalize(name), strings.TrimRight(path, "/")
+}
+
+// hostCandidates returns host followed by the wildcards matching it, the
+// most specific first.
+func hostCandidates(host string) []string {
+	names := []string{host}
+	parts := strings.Split(host, ".")
+	for i := 0; i < len(parts)-1; i++ {
+		parts[i] = "*"
+		names = append(names, strings.Join(parts[i:], "."))
+	}
+	return names
+}
+
+// trackedConn counts itself in the active connections of its listener
+// until it is closed.
+type trackedConn struct {
+	Conn
+	l    *Listener
+	once sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() { atomic.AddInt64(&c.l.active, -1) })
+	return c.Conn.Close()
+}
+
+// Protocols passes the protocols of the wrapped connection through.
+func (c *trackedConn) Protocols() []string {
+	if pc, ok := c.Conn.(protocolConn); ok {
+		return pc.Protocols()
+	}
+	return nil
+}
+
+// Unwrap returns the connection as muxed, a *HTTPConn or a *TLSConn.
+func (c *trackedConn) Unwrap() Conn {
+	return c.Conn
+}
@@ -0,0 +1,333 @@
+package vhost
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// maxResponseHead bounds the response heads RewriteResponses buffers; a
+// longer one is passed through untouched.
+const maxResponseHead = 64 << 10
+
+// HeaderRules rewrite the HTTP/1 requests of a connection on their way to
+// the upstream server and its responses on their way back, like a reverse
+// proxy in front of a development server would.
+type HeaderRules struct {
+	// Host replaces the Host header of requests, "localhost:3000" for a
+	// server that only answers to its own name.
+	Host string `json:"host,omitempty"`
+
+	Request  HeaderOps `json:"request,omitempty"`
+	Response HeaderOps `json:"response,omitempty"`
+
+	// RewriteLocation sends redirects to the upstream host, or to a
+	// loopback address, to the host the client asked for instead.
+	RewriteLocation bool `json:"rewriteLocation,omitempty"`
+
+	// RewriteCookieDomain does the same for the Domain of the cookies set
+	// by responses.
+	RewriteCookieDomain bool `json:"rewriteCookieDomain,omitempty"`
+}
+
+// HeaderOps edit the headers of a message: the Set headers replace those
+// of the same name, the Add headers are added to them, and the Remove
+// headers are dropped.
+type HeaderOps struct {
+	Set    map[string]string `json:"set,omitempty"`
+	Add    map[string]string `json:"add,omitempty"`
+	Remove []string          `json:"remove,omitempty"`
+}
+
+// framingHeaders are left to the client and upstream server, since
+// changing them would break the connection; Host has its own rule.
+var framingHeaders = map[string]bool{
+	"Connection":        true,
+	"Content-Length":    true,
+	"Host":              true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+}
+
+// Validate reports the first rule that cannot be applied.
+func (r *HeaderRules) Validate() error {
+	if r.Host != "" {
+		if u, err := url.Parse("http://" + r.Host); err != nil || u.Host != r.Host || !httpguts.ValidHostHeader(r.Host) {
+			return fmt.Errorf("vhost: bad host %q", r.Host)
+		}
+	}
+	if err := r.Request.validate(); err != nil {
+		return fmt.Errorf("vhost: request rules: %v", err)
+	}
+	if err := r.Response.validate(); err != nil {
+		return fmt.Errorf("vhost: response rules: %v", err)
+	}
+	return nil
+}
+
+func (o HeaderOps) validate() error {
+	check := func(name string) error {
+		if !httpguts.ValidHeaderFieldName(name) {
+			return fmt.Errorf("bad header name %q", name)
+		}
+		if framingHeaders[textproto.CanonicalMIMEHeaderKey(name)] {
+			return fmt.Errorf("header %s cannot be rewritten", name)
+		}
+		return nil
+	}
+	for _, values := range []map[string]string{o.Set, o.Add} {
+		for name, value := range values {
+			if err := check(name); err != nil {
+				return err
+			}
+			if !httpguts.ValidHeaderFieldValue(value) {
+				return fmt.Errorf("bad value %q for header %s", value, name)
+			}
+		}
+	}
+	for _, name := range o.Remove {
+		if err := check(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// drops reports whether the header name, in canonical form, is replaced or
+// removed.
+func (o HeaderOps) drops(name string) bool {
+	for n := range o.Set {
+		if textproto.CanonicalMIMEHeaderKey(n) == name {
+			return true
+		}
+	}
+	for _, n := range o.Remove {
+		if textproto.CanonicalMIMEHeaderKey(n) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// lines returns the header lines to add, sorted by name.
+func (o HeaderOps) lines() []string {
+	var lines []string
+	for _, values := range []map[string]string{o.Set, o.Add} {
+		names := make([]string, 0, len(values))
+		for name := range values {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			lines = append(lines, textproto.CanonicalMIMEHeaderKey(name)+": "+values[name])
+		}
+	}
+	return lines
+}
+
+// upstream reports whether host, with or without a port, names the
+// upstream server: the Host rule or a loopback address.
+func (r *HeaderRules) upstream(host string) bool {
+	name := hostname(host)
+	if name == "" {
+		return false
+	}
+	if r.Host != "" && strings.EqualFold(name, hostname(r.Host)) {
+		return true
+	}
+	if strings.EqualFold(name, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(name)
+	return ip != nil && ip.IsLoopback()
+}
+
+// hostname strips the port and IPv6 brackets from host.
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return strings.Trim(host, "[]")
+}
+
+// location returns loc pointing at publicBase if it points at the upstream
+// server: its path goes under the path prefix of publicBase, if any. With
+// a prefix, host-relative locations like "/login" are put under it too,
+// so that they do not leave the route.
+func (r *HeaderRules) location(loc, publicBase string) string {
+	u, err := url.Parse(loc)
+	if err != nil {
+		return loc
+	}
+	host, prefix := splitRoute(publicBase)
+	switch {
+	case u.Host != "" && r.upstream(u.Host):
+		u.Host = host
+	case u.Scheme == "" && u.Host == "" && prefix != "" && strings.HasPrefix(loc, "/") && !strings.HasPrefix(loc, "//"):
+	default:
+		return loc
+	}
+	if prefix != "" {
+		u.Path = prefix + "/" + strings.TrimPrefix(u.Path, "/")
+		if u.RawPath != "" {
+			u.RawPath = prefix + "/" + strings.TrimPrefix(u.RawPath, "/")
+		}
+	}
+	return u.String()
+}
+
+// cookie returns the Set-Cookie value v with a Domain of the upstream
+// server replaced by the host name of publicBase.
+func (r *HeaderRules) cookie(v, publicBase string) string {
+	attrs := strings.Split(v, ";")
+	for i := 1; i < len(attrs); i++ { // attrs[0] is the cookie itself
+		name, value, ok := strings.Cut(strings.TrimSpace(attrs[i]), "=")
+		if !ok || !strings.EqualFold(name, "Domain") {
+			continue
+		}
+		if r.upstream(strings.TrimPrefix(strings.TrimSpace(value), ".")) {
+			host, _ := splitRoute(publicBase)
+			attrs[i] = " Domain=" + hostname(host)
+		}
+	}
+	return strings.Join(attrs, ";")
+}
+
+// RewriteRequest applies the Host and request rules to the buffered head
+// of the request. Like the path prefix options, it marks the request
+// Connection: close unless it is an upgrade, since the requests after it
+// on the connection are passed through as they are. Request keeps the
+// Host the client asked for. It reports false for HTTP/2 requests, whose
+// HPACK-encoded headers are left alone.
+func (c *HTTPConn) RewriteRequest(rules *HeaderRules) bool {
+	c.Lock()
+	defer c.Unlock()
+	if c.vhostBuf == nil || c.Request == nil || c.streamID != 0 {
+		return false
+	}
+
+	upgrade := headerHasToken(c.Request.Header, "Connection", "upgrade")
+	var extra []string
+	if rules.Host != "" {
+		extra = append(extra, "Host: "+rules.Host)
+	}
+	for _, name := range rules.Request.Remove {
+		c.Request.Header.Del(name)
+	}
+	for name, value := range rules.Request.Set {
+		c.Request.Header.Set(name, value)
+	}
+	for name, value := range rules.Request.Add {
+		c.Request.Header.Add(name, value)
+	}
+	extra = append(extra, rules.Request.lines()...)
+	if !upgrade {
+		extra = append(extra, "Connection: close")
+		c.Request.Header.Set("Connection", "close")
+		c.Request.Close = true
+	}
+	c.vhostBuf = rebuildHead(c.vhostBuf.Bytes(), "", func(name string) bool {
+		return (rules.Host != "" && name == "Host") || (!upgrade && name == "Connection") || rules.Request.drops(name)
+	}, extra)
+	return true
+}
+
+// RewriteResponses returns a reader of the HTTP/1 responses read from r
+// with the response rules applied to their heads. publicBase is the host
+// the client asked for, followed by the path prefix of its route if any,
+// like "alice.example.com" or "example.com/alice": Location is rewritten
+// to it and cookie domains to its host.
+// The heads are rewritten up to the first final response, or 101 Switching
+// Protocols, which answers a request sent with RewriteRequest: the rest is
+// passed through, as is a head that is too long or malformed.
+func RewriteResponses(r io.Reader, rules *HeaderRules, publicBase string) io.Reader {
+	return &responseRewriter{br: bufio.NewReader(r), rules: rules, publicBase: publicBase}
+}
+
+type responseRewriter struct {
+	br         *bufio.Reader
+	rules      *HeaderRules
+	publicBase string
+	pending    []byte
+	done       bool
+}
+
+func (w *responseRewriter) Read(p []byte) (int, error) {
+	if len(w.pending) == 0 && !w.done {
+		w.pending, w.done = w.nextHead()
+	}
+	if len(w.pending) > 0 {
+		n := copy(p, w.pending)
+		w.pending = w.pending[n:]
+		return n, nil
+	}
+	return w.br.Read(p)
+}
+
+// nextHead reads the next response head and returns it rewritten, and
+// whether it is the last one to rewrite.
+func (w *responseRewriter) nextHead() ([]byte, bool) {
+	var head []byte
+	for {
+		line, err := w.br.ReadSlice('\n')
+		head = append(head, line...)
+		if err == bufio.ErrBufferFull && len(head) < maxResponseHead {
+			continue
+		}
+		if err != nil || len(head) >= maxResponseHead {
+			return head, true
+		}
+		if len(bytes.TrimRight(line, "\r\n")) == 0 && len(head) > len(line) {
+			break
+		}
+	}
+
+	status, rest := nextLine(head)
+	fields := strings.Fields(string(status))
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "HTTP/1.") {
+		return head, true
+	}
+	code, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return head, true
+	}
+	header, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(rest))).ReadMIMEHeader()
+	if err != nil && !errors.Is(err, io.EOF) {
+		return head, true
+	}
+
+	ops := w.rules.Response
+	extra := ops.lines()
+	var edited []string
+	if loc := header.Get("Location"); w.rules.RewriteLocation && loc != "" && !ops.drops("Location") {
+		if l := w.rules.location(loc, w.publicBase); l != loc {
+			edited = append(edited, "Location")
+			extra = append(extra, "Location: "+l)
+		}
+	}
+	if cookies := header.Values("Set-Cookie"); w.rules.RewriteCookieDomain && len(cookies) > 0 && !ops.drops("Set-Cookie") {
+		edited = append(edited, "Set-Cookie")
+		for _, c := range cookies {
+			extra = append(extra, "Set-Cookie: "+w.rules.cookie(c, w.publicBase))
+		}
+	}
+	rewritten := rebuildHead(head, "", func(name string) bool {
+		for _, e := range edited {
+			if name == e {
+				return true
+			}
+		}
+		return ops.drops(name)
+	}, extra)
+	return rewritten.Bytes(), code >= 200 || code == 101
+}
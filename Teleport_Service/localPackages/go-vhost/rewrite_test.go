@@ -0,0 +1,150 @@
+package vhost
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestHeaderRulesValidate(t *testing.T) {
+	tests := []struct {
+		rules HeaderRules
+		err   string
+	}{
+		{HeaderRules{Host: "localhost:3000", Response: HeaderOps{Set: map[string]string{"Access-Control-Allow-Origin": "*"}}}, ""},
+		{HeaderRules{Host: "[::1]:3000"}, ""},
+		{HeaderRules{Host: "localhost/app"}, "bad host"},
+		{HeaderRules{Host: "local host"}, "bad host"},
+		{HeaderRules{Request: HeaderOps{Set: map[string]string{"X Bad": "1"}}}, "bad header name"},
+		{HeaderRules{Request: HeaderOps{Add: map[string]string{"X-Ok": "a\r\nX-Injected: 1"}}}, "bad value"},
+		{HeaderRules{Response: HeaderOps{Remove: []string{"content-length"}}}, "cannot be rewritten"},
+		{HeaderRules{Request: HeaderOps{Set: map[string]string{"Host": "example.com"}}}, "cannot be rewritten"},
+	}
+	for _, test := range tests {
+		err := test.rules.Validate()
+		if test.err == "" && err != nil {
+			t.Errorf("%+v: unexpected error %v", test.rules, err)
+		}
+		if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%+v: expected an error about %q, got %v", test.rules, test.err, err)
+		}
+	}
+}
+
+func TestRewriteRequest(t *testing.T) {
+	client, server := net.Pipe()
+	go func() {
+		client.Write([]byte("POST /api HTTP/1.1\r\nHost: alice.teleport.me\r\nX-Debug: 1\r\nX-Debug: 2\r\nAccept: */*\r\nContent-Length: 4\r\n\r\nbody"))
+		client.Close()
+	}()
+	c, err := HTTP(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := &HeaderRules{
+		Host: "localhost:3000",
+		Request: HeaderOps{
+			Set:    map[string]string{"accept": "application/json"},
+			Add:    map[string]string{"X-Forwarded-Host": "alice.teleport.me"},
+			Remove: []string{"x-debug"},
+		},
+	}
+	if !c.RewriteRequest(rules) {
+		t.Fatal("expected an HTTP/1 request to be rewritten")
+	}
+	if c.Host() != "alice.teleport.me" {
+		t.Fatalf("expected Request to keep the public host, got %q", c.Host())
+	}
+
+	req, err := http.ReadRequest(bufio.NewReader(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(req.Body)
+	if req.Host != "localhost:3000" || req.Header.Get("Accept") != "application/json" || req.Header.Get("X-Forwarded-Host") != "alice.teleport.me" {
+		t.Fatalf("rules not applied: host %q, headers %v", req.Host, req.Header)
+	}
+	if _, ok := req.Header["X-Debug"]; ok || !req.Close || string(body) != "body" {
+		t.Fatalf("expected X-Debug removed, Connection: close and the body kept, got %v and %q", req.Header, body)
+	}
+}
+
+func TestRewriteResponses(t *testing.T) {
+	upstream := "HTTP/1.1 100 Continue\r\n\r\n" +
+		"HTTP/1.1 302 Found\r\n" +
+		"Location: http://localhost:3000/login?next=%2F\r\n" +
+		"Set-Cookie: sid=1; Domain=localhost; Path=/; HttpOnly\r\n" +
+		"Set-Cookie: theme=dark; Domain=.example.com\r\n" +
+		"Server: vite\r\n" +
+		"Content-Length: 3\r\n" +
+		"\r\n" +
+		"HTTP/1.1 200 OK\r\n" // the body, not another head
+	rules := &HeaderRules{
+		Host: "localhost:3000",
+		Response: HeaderOps{
+			Set:    map[string]string{"Access-Control-Allow-Origin": "*"},
+			Remove: []string{"Server"},
+		},
+		RewriteLocation:     true,
+		RewriteCookieDomain: true,
+	}
+	r := bufio.NewReader(RewriteResponses(strings.NewReader(upstream), rules, "alice.teleport.me:9999"))
+
+	cont, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cont.StatusCode != http.StatusContinue || cont.Header.Get("Access-Control-Allow-Origin") != "*" {
+		t.Fatalf("expected the 100 Continue rewritten too, got %d %v", cont.StatusCode, cont.Header)
+	}
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loc := resp.Header.Get("Location"); loc != "http://alice.teleport.me:9999/login?next=%2F" {
+		t.Fatalf("unexpected Location %q", loc)
+	}
+	cookies := resp.Header.Values("Set-Cookie")
+	if len(cookies) != 2 || cookies[0] != "sid=1; Domain=alice.teleport.me; Path=/; HttpOnly" || cookies[1] != "theme=dark; Domain=.example.com" {
+		t.Fatalf("unexpected cookies %q", cookies)
+	}
+	if resp.Header.Get("Server") != "" || resp.Header.Get("Access-Control-Allow-Origin") != "*" {
+		t.Fatalf("response rules not applied: %v", resp.Header)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	rest, _ := ioutil.ReadAll(r)
+	if string(body)+string(rest) != "HTTP/1.1 200 OK\r\n" {
+		t.Fatalf("expected the body to be passed through, got %q", string(body)+string(rest))
+	}
+}
+
+func TestRewriteResponsesUnderPathPrefix(t *testing.T) {
+	// absolute redirects to the upstream and host-relative ones stay under
+	// the prefix, the others are left alone
+	rules := &HeaderRules{RewriteLocation: true, RewriteCookieDomain: true}
+	for loc, want := range map[string]string{
+		"http://localhost:3000/login?next=%2F": "http://teleport.me:9999/alice/login?next=%2F",
+		"http://localhost:3000":                "http://teleport.me:9999/alice/",
+		"http://127.0.0.1:3000/a%2Fb":          "http://teleport.me:9999/alice/a%2Fb",
+		"/login?next=%2F":                      "/alice/login?next=%2F",
+		"/":                                    "/alice/",
+		"//cdn.example.com/app.js":             "//cdn.example.com/app.js",
+		"login":                                "login",
+		"http://other.example.com/":            "http://other.example.com/",
+	} {
+		upstream := "HTTP/1.1 302 Found\r\nLocation: " + loc + "\r\nSet-Cookie: sid=1; Domain=localhost\r\nContent-Length: 0\r\n\r\n"
+		resp, err := http.ReadResponse(bufio.NewReader(RewriteResponses(strings.NewReader(upstream), rules, "teleport.me:9999/alice")), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := resp.Header.Get("Location"); got != want {
+			t.Errorf("%s: expected Location %q, got %q", loc, want, got)
+		}
+		if cookie := resp.Header.Get("Set-Cookie"); cookie != "sid=1; Domain=teleport.me" {
+			t.Errorf("unexpected cookie %q", cookie)
+		}
+	}
+}
@@ -62,12 +62,24 @@ const (
 
 // TLS extension numbers
 var (
-	extensionServerName      uint16 = 0
-	extensionStatusRequest   uint16 = 5
-	extensionSupportedCurves uint16 = 10
-	extensionSupportedPoints uint16 = 11
-	extensionSessionTicket   uint16 = 35
-	extensionNextProtoNeg    uint16 = 13172 // not IANA assigned
+	extensionServerName           uint16 = 0
+	extensionStatusRequest        uint16 = 5
+	extensionSupportedCurves      uint16 = 10
+	extensionSupportedPoints      uint16 = 11
+	extensionSignatureAlgorithms  uint16 = 13
+	extensionALPN                 uint16 = 16
+	extensionSessionTicket        uint16 = 35
+	extensionPreSharedKey         uint16 = 41
+	extensionSupportedVersions    uint16 = 43
+	extensionPSKModes             uint16 = 45
+	extensionKeyShare             uint16 = 51
+	extensionNextProtoNeg         uint16 = 13172 // not IANA assigned
+	extensionEncryptedClientHello uint16 = 0xfe0d
+)
+
+// ECHClientHelloType values (draft-ietf-tls-esni-22, section 5)
+const (
+	echClientHelloOuter uint8 = 0
 )
 
 // TLS CertificateStatusType (RFC 3546)
@@ -102,6 +114,14 @@ func (c *TLSConn) Host() string {
 	return c.ClientHelloMsg.ServerName
 }
 
+// Protocols returns the application protocols offered with ALPN.
+func (c *TLSConn) Protocols() []string {
+	if c.ClientHelloMsg == nil {
+		return nil
+	}
+	return c.ClientHelloMsg.AlpnProtocols
+}
+
 func (c *TLSConn) Free() {
 	c.ClientHelloMsg = nil
 }
@@ -283,19 +303,81 @@ func readClientHello(rd io.Reader) (*ClientHelloMsg, error) {
 }
 
 type ClientHelloMsg struct {
-	Raw                []byte
-	Vers               uint16
-	Random             []byte
-	SessionId          []byte
-	CipherSuites       []uint16
-	CompressionMethods []uint8
-	NextProtoNeg       bool
-	ServerName         string
-	OcspStapling       bool
-	SupportedCurves    []uint16
-	SupportedPoints    []uint8
-	TicketSupported    bool
-	SessionTicket      []uint8
+	Raw                 []byte
+	Vers                uint16
+	Random              []byte
+	SessionId           []byte
+	CipherSuites        []uint16
+	CompressionMethods  []uint8
+	NextProtoNeg        bool
+	ServerName          string
+	OcspStapling        bool
+	SupportedCurves     []uint16
+	SupportedPoints     []uint8
+	TicketSupported     bool
+	SessionTicket       []uint8
+	SignatureAlgorithms []uint16
+	AlpnProtocols       []string
+	SupportedVersions   []uint16 // TLS 1.3 clients list their versions here, Vers stays 1.2
+	KeyShares           []uint16 // groups of the key shares offered, key exchange data is not kept
+	PskModes            []uint8
+	PreSharedKey        bool // resumption with a pre-shared key is offered
+
+	// EncryptedClientHello is set when the ClientHello is the outer one
+	// of Encrypted Client Hello (or a GREASE imitation of it): ServerName
+	// is then the public name of the client-facing server, the real one
+	// is encrypted. ECHConfigID identifies the ECH config used.
+	EncryptedClientHello bool
+	ECHConfigID          uint8
+}
+
+// isGREASE reports whether v is one of the values reserved by RFC 8701 to
+// keep servers tolerant of unknown values.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// MaxVersion returns the highest TLS version the client supports, taking
+// the supported_versions extension into account.
+func (m *ClientHelloMsg) MaxVersion() uint16 {
+	max := m.Vers
+	for _, v := range m.SupportedVersions {
+		if !isGREASE(v) && v > max {
+			max = v
+		}
+	}
+	return max
+}
+
+// HasProtocol reports whether the client offered proto with ALPN.
+func (m *ClientHelloMsg) HasProtocol(proto string) bool {
+	for _, p := range m.AlpnProtocols {
+		if p == proto {
+			return true
+		}
+	}
+	return false
+}
+
+// readUint16s parses a list of uint16 prefixed by its length in bytes, of
+// lenBytes bytes (1 or 2), that must fill data exactly.
+func readUint16s(data []byte, lenBytes int) ([]uint16, bool) {
+	if len(data) < lenBytes {
+		return nil, false
+	}
+	l := int(data[0])
+	if lenBytes == 2 {
+		l = l<<8 | int(data[1])
+	}
+	data = data[lenBytes:]
+	if l%2 == 1 || l != len(data) {
+		return nil, false
+	}
+	values := make([]uint16, l/2)
+	for i := range values {
+		values[i] = uint16(data[2*i])<<8 | uint16(data[2*i+1])
+	}
+	return values, true
 }
 
 func (m *ClientHelloMsg) unmarshal(data []byte) bool {
@@ -342,6 +424,14 @@ func (m *ClientHelloMsg) unmarshal(data []byte) bool {
 	m.OcspStapling = false
 	m.TicketSupported = false
 	m.SessionTicket = nil
+	m.SignatureAlgorithms = nil
+	m.AlpnProtocols = nil
+	m.SupportedVersions = nil
+	m.KeyShares = nil
+	m.PskModes = nil
+	m.PreSharedKey = false
+	m.EncryptedClientHello = false
+	m.ECHConfigID = 0
 
 	if len(data) == 0 {
 		// ClientHello is optionally followed by extension data
@@ -429,6 +519,95 @@ func (m *ClientHelloMsg) unmarshal(data []byte) bool {
 			// http://tools.ietf.org/html/rfc5077#section-3.2
 			m.TicketSupported = true
 			m.SessionTicket = data[:length]
+		case extensionSignatureAlgorithms:
+			// https://tools.ietf.org/html/rfc8446#section-4.2.3
+			var ok bool
+			if m.SignatureAlgorithms, ok = readUint16s(data[:length], 2); !ok {
+				return false
+			}
+		case extensionALPN:
+			// https://tools.ietf.org/html/rfc7301#section-3.1
+			if length < 2 {
+				return false
+			}
+			l := int(data[0])<<8 | int(data[1])
+			if l != length-2 {
+				return false
+			}
+			d := data[2:length]
+			for len(d) != 0 {
+				protoLen := int(d[0])
+				d = d[1:]
+				if protoLen == 0 || protoLen > len(d) {
+					return false
+				}
+				m.AlpnProtocols = append(m.AlpnProtocols, string(d[:protoLen]))
+				d = d[protoLen:]
+			}
+		case extensionSupportedVersions:
+			// https://tools.ietf.org/html/rfc8446#section-4.2.1
+			var ok bool
+			if m.SupportedVersions, ok = readUint16s(data[:length], 1); !ok {
+				return false
+			}
+		case extensionKeyShare:
+			// https://tools.ietf.org/html/rfc8446#section-4.2.8
+			if length < 2 {
+				return false
+			}
+			l := int(data[0])<<8 | int(data[1])
+			if l != length-2 {
+				return false
+			}
+			d := data[2:length]
+			for len(d) != 0 {
+				if len(d) < 4 {
+					return false
+				}
+				group := uint16(d[0])<<8 | uint16(d[1])
+				keyLen := int(d[2])<<8 | int(d[3])
+				d = d[4:]
+				if keyLen == 0 || keyLen > len(d) {
+					return false
+				}
+				m.KeyShares = append(m.KeyShares, group)
+				d = d[keyLen:]
+			}
+		case extensionPSKModes:
+			// https://tools.ietf.org/html/rfc8446#section-4.2.9
+			if length < 1 || int(data[0]) != length-1 {
+				return false
+			}
+			m.PskModes = data[1:length]
+		case extensionPreSharedKey:
+			// https://tools.ietf.org/html/rfc8446#section-4.2.11, the
+			// identities and binders are of no use for routing
+			if length < 2 {
+				return false
+			}
+			m.PreSharedKey = true
+		case extensionEncryptedClientHello:
+			// https://datatracker.ietf.org/doc/html/draft-ietf-tls-esni-22#section-5
+			// outer: type, cipher suite (kdf, aead), config id, enc, payload
+			if length < 1 || data[0] != echClientHelloOuter {
+				// the inner type only appears inside the encrypted payload
+				break
+			}
+			if length < 8 {
+				return false
+			}
+			encLen := int(data[6])<<8 | int(data[7])
+			d := data[8:length]
+			if len(d) < encLen+2 {
+				return false
+			}
+			d = d[encLen:]
+			payloadLen := int(d[0])<<8 | int(d[1])
+			if payloadLen == 0 || payloadLen != len(d)-2 {
+				return false
+			}
+			m.EncryptedClientHello = true
+			m.ECHConfigID = data[5]
 		}
 		data = data[length:]
 	}
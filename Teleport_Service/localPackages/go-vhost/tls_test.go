@@ -1,9 +1,14 @@
 package vhost
 
 import (
+	"bytes"
 	"crypto/tls"
 	"net"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestSNI(t *testing.T) {
@@ -37,3 +42,201 @@ func TestSNI(t *testing.T) {
 		t.Errorf("Connection Host() is %s, expected %s", c.Host(), testHostname)
 	}
 }
+
+// Captured with a local listener from: go 1.27 crypto/tls (NextProtos h2,
+// http/1.1), curl 7.88 --http2, openssl 3.0 s_client -alpn acme-tls/1 and
+// chrome-headless-shell 140, which sends GREASE values, a GREASE ECH
+// extension and an X25519MLKEM768 key share.
+func TestClientHelloCaptures(t *testing.T) {
+	tests := []struct {
+		file       string
+		serverName string
+		alpn       []string
+		maxVersion uint16
+		keyShares  []uint16
+		ech        bool
+	}{
+		{"go.bin", "go.example.com", []string{"h2", "http/1.1"}, tls.VersionTLS13, []uint16{0x11ec, uint16(tls.X25519)}, false},
+		{"curl.bin", "curl.example.com", []string{"h2", "http/1.1"}, tls.VersionTLS13, []uint16{uint16(tls.X25519)}, false},
+		{"openssl.bin", "acme.example.com", []string{"acme-tls/1"}, tls.VersionTLS13, []uint16{uint16(tls.X25519)}, false},
+		{"chrome.bin", "chrome.example.com", []string{"h2", "http/1.1"}, tls.VersionTLS13, []uint16{0xaaaa, 0x11ec, uint16(tls.X25519)}, true},
+	}
+	for _, test := range tests {
+		b, err := os.ReadFile(filepath.Join("testdata", test.file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := readClientHello(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("%s: %v", test.file, err)
+		}
+		if m.ServerName != test.serverName || !reflect.DeepEqual(m.AlpnProtocols, test.alpn) {
+			t.Errorf("%s: got server name %q, ALPN %q", test.file, m.ServerName, m.AlpnProtocols)
+		}
+		if m.Vers != tls.VersionTLS12 || m.MaxVersion() != test.maxVersion {
+			t.Errorf("%s: got version %x, max version %x", test.file, m.Vers, m.MaxVersion())
+		}
+		if !reflect.DeepEqual(m.KeyShares, test.keyShares) {
+			t.Errorf("%s: got key shares %x", test.file, m.KeyShares)
+		}
+		if len(m.SignatureAlgorithms) == 0 || m.PreSharedKey || m.EncryptedClientHello != test.ech {
+			t.Errorf("%s: unexpected %+v", test.file, m)
+		}
+	}
+}
+
+// extension encodes a TLS extension.
+func extension(typ uint16, body ...byte) []byte {
+	return append([]byte{byte(typ >> 8), byte(typ), byte(len(body) >> 8), byte(len(body))}, body...)
+}
+
+// clientHelloRecord wraps extensions in a ClientHello and a TLS record.
+func clientHelloRecord(extensions ...[]byte) []byte {
+	var exts []byte
+	for _, e := range extensions {
+		exts = append(exts, e...)
+	}
+	body := []byte{3, 3}
+	body = append(body, make([]byte, 32)...) // random
+	body = append(body, 0)                   // session id
+	body = append(body, 0, 2, 0x13, 0x01)    // cipher suites
+	body = append(body, 1, 0)                // compression methods
+	body = append(body, byte(len(exts)>>8), byte(len(exts)))
+	body = append(body, exts...)
+	hs := append([]byte{typeClientHello, 0, byte(len(body) >> 8), byte(len(body))}, body...)
+	return append([]byte{byte(recordTypeHandshake), 3, 1, byte(len(hs) >> 8), byte(len(hs))}, hs...)
+}
+
+// A ClientHello shaped like Chrome's: GREASE values, ECH outer extension
+// (as Chrome sends GREASE ECH) and a resumption PSK.
+func TestClientHelloModernExtensions(t *testing.T) {
+	hello := clientHelloRecord(
+		extension(0x5a5a),
+		extension(extensionServerName, 0, 17, 0, 0, 14, 'p', 'u', 'b', 'l', 'i', 'c', '.', 'e', 'x', 'a', 'm', 'p', 'l', 'e'),
+		extension(extensionALPN, 0, 12, 2, 'h', '2', 8, 'h', 't', 't', 'p', '/', '1', '.', '1'),
+		extension(extensionSupportedVersions, 6, 0x7a, 0x7a, 3, 4, 3, 3),
+		extension(extensionSignatureAlgorithms, 0, 4, 4, 3, 8, 4),
+		extension(extensionKeyShare, 0, 11, 0x1a, 0x1a, 0, 1, 0, 0, 0x1d, 0, 2, 1, 2),
+		extension(extensionPSKModes, 1, 1),
+		extension(extensionEncryptedClientHello, echClientHelloOuter, 0, 1, 0, 1, 42, 0, 2, 9, 9, 0, 3, 1, 2, 3),
+		extension(extensionPreSharedKey, 0, 0, 0, 0),
+	)
+	m, err := readClientHello(bytes.NewReader(hello))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.ServerName != "public.example" || !m.HasProtocol("h2") || m.HasProtocol("acme-tls/1") {
+		t.Fatalf("unexpected server name %q or ALPN %q", m.ServerName, m.AlpnProtocols)
+	}
+	if m.MaxVersion() != tls.VersionTLS13 {
+		t.Fatalf("expected TLS 1.3 ignoring GREASE, got %x", m.MaxVersion())
+	}
+	if !reflect.DeepEqual(m.KeyShares, []uint16{0x1a1a, 0x1d}) || !reflect.DeepEqual(m.PskModes, []uint8{1}) {
+		t.Fatalf("unexpected key shares %x or PSK modes %v", m.KeyShares, m.PskModes)
+	}
+	if !m.PreSharedKey || !m.EncryptedClientHello || m.ECHConfigID != 42 {
+		t.Fatalf("unexpected PSK %v or ECH %v/%d", m.PreSharedKey, m.EncryptedClientHello, m.ECHConfigID)
+	}
+	if !reflect.DeepEqual(m.SignatureAlgorithms, []uint16{0x0403, 0x0804}) {
+		t.Fatalf("unexpected signature algorithms %x", m.SignatureAlgorithms)
+	}
+}
+
+func TestClientHelloMalformedExtensions(t *testing.T) {
+	tests := map[string][]byte{
+		"empty protocol":          extension(extensionALPN, 0, 1, 0),
+		"protocol past the end":   extension(extensionALPN, 0, 3, 5, 'h', '2'),
+		"odd versions":            extension(extensionSupportedVersions, 3, 3, 4, 3),
+		"short key share":         extension(extensionKeyShare, 0, 3, 0, 0x1d, 0),
+		"key share past the end":  extension(extensionKeyShare, 0, 6, 0, 0x1d, 0, 9, 1, 2),
+		"truncated ECH":           extension(extensionEncryptedClientHello, echClientHelloOuter, 0, 1),
+		"ECH without payload":     extension(extensionEncryptedClientHello, echClientHelloOuter, 0, 1, 0, 1, 42, 0, 0, 0, 0),
+		"PSK modes length":        extension(extensionPSKModes, 3, 1),
+		"odd signature algorithm": extension(extensionSignatureAlgorithms, 0, 3, 4, 3, 8),
+	}
+	for name, ext := range tests {
+		if _, err := readClientHello(bytes.NewReader(clientHelloRecord(ext))); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+// dialTLS starts a handshake to addr and returns once the ClientHello is
+// out; the handshake itself never completes.
+func dialTLS(addr, serverName string, protos ...string) {
+	go func() {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: serverName, NextProtos: protos})
+		if err == nil {
+			conn.Close()
+		}
+	}()
+}
+
+func acceptTLS(t *testing.T, l net.Listener) *TLSConn {
+	t.Helper()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	select {
+	case conn := <-accepted:
+		t.Cleanup(func() { conn.Close() })
+		return conn.(*TLSConn)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no connection on %s", l.(*Listener).Name())
+		return nil
+	}
+}
+
+func TestALPNRouting(t *testing.T) {
+	l, _ := localListener(t)
+	mux, err := NewTLSMuxer(l, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mux.Close()
+	go mux.HandleErrors()
+
+	tunnel, err := mux.Listen("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	acme, err := mux.Listen("example.com:443", "acme-tls/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wildcardACME, err := mux.Listen("*.example.com", "acme-tls/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mux.Listen("example.com", "acme-tls/1"); err == nil {
+		t.Fatal("expected the protocol to be bound already")
+	}
+
+	addr := l.Addr().String()
+	tests := []struct {
+		serverName string
+		protos     []string
+		want       net.Listener
+	}{
+		{"example.com", []string{"acme-tls/1"}, acme},
+		{"example.com", []string{"h2", "http/1.1"}, tunnel},
+		{"example.com", nil, tunnel},
+		{"sub.example.com", []string{"acme-tls/1"}, wildcardACME},
+	}
+	for _, test := range tests {
+		dialTLS(addr, test.serverName, test.protos...)
+		conn := acceptTLS(t, test.want)
+		if conn.Host() != test.serverName || !reflect.DeepEqual(conn.Protocols(), test.protos) {
+			t.Fatalf("unexpected connection to %q offering %q", conn.Host(), conn.Protocols())
+		}
+	}
+
+	// without a listener for the protocol, the name's listener gets it
+	acme.Close()
+	dialTLS(addr, "example.com", "acme-tls/1")
+	acceptTLS(t, tunnel)
+}
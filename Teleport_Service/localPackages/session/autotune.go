@@ -0,0 +1,93 @@
+package session
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// bdpPingFlag marks the pings used to measure the bandwidth-delay product,
+// so that their pongs are not taken for keepalive answers.
+const bdpPingFlag = 1 << 63
+
+// bdpBeta is the fraction of the window that one round trip's worth of
+// data must fill before the window is considered the bottleneck.
+const bdpBeta = 0.66
+
+// bdpEstimator sizes the receive window of the session's channels after
+// the measured bandwidth-delay product, as gRPC does. A ping goes out with
+// the first data received after the previous pong, and the data that
+// arrives before its pong is what the peer sends in one round trip. When
+// that fills most of the window, the window is what limits throughput and
+// it is doubled, up to max.
+type bdpEstimator struct {
+	window uint32 // accessed atomically, only ever grows
+	max    uint32
+
+	// protects the measurement below
+	mu      sync.Mutex
+	pending bool
+	id      uint64
+	sentAt  time.Time
+	sample  uint32  // bytes received since the ping was sent
+	bwMax   float64 // best bandwidth seen, in bytes per second
+}
+
+// size returns the receive window channels should have.
+func (b *bdpEstimator) size() uint32 {
+	return atomic.LoadUint32(&b.window)
+}
+
+// received accounts for n bytes of channel data. It returns the ID of a
+// ping to send when a new measurement starts.
+func (b *bdpEstimator) received(n uint32) (uint64, bool) {
+	if b.size() >= b.max {
+		return 0, false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.pending {
+		b.sample += n
+		return 0, false
+	}
+	b.pending = true
+	b.id++
+	b.sentAt = time.Now()
+	b.sample = n
+	return b.id | bdpPingFlag, true
+}
+
+// pong completes the measurement started by ping id.
+func (b *bdpEstimator) pong(id uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.pending || id != b.id|bdpPingFlag {
+		return
+	}
+	b.pending = false
+	rtt := time.Since(b.sentAt)
+	if rtt <= 0 {
+		return
+	}
+
+	window := b.size()
+	bw := float64(b.sample) / rtt.Seconds()
+	if float64(b.sample) < bdpBeta*float64(window) || bw <= b.bwMax {
+		return
+	}
+	b.bwMax = bw
+
+	grown := 2 * uint64(b.sample)
+	if grown > uint64(b.max) {
+		grown = uint64(b.max)
+	}
+	if grown > uint64(window) {
+		atomic.StoreUint32(&b.window, uint32(grown))
+	}
+}
+
+// WindowSize returns the receive window new channels start with. It only
+// differs from Config.WindowSize when auto-tuning has grown it.
+func (s *Session) WindowSize() uint32 {
+	return s.bdp.size()
+}
@@ -4,9 +4,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"sync"
+	"time"
 
-	"github.com/progrium/qmux/golang/codec"
+	"teleportServer/localPackages/codec"
 )
 
 type channelDirection uint8
@@ -39,15 +41,23 @@ type Channel struct {
 	// Pending internal channel messages.
 	msg chan codec.Message
 
+	// type and extra data given when the channel was opened
+	chanType string
+	extra    []byte
+
 	sentEOF bool
 
 	// thread-safe data
 	remoteWin window
 	pending   *buffer
 
-	// windowMu protects myWindow, the flow-control window.
-	windowMu sync.Mutex
-	myWindow uint32
+	// windowMu protects myWindow, the flow-control window, unacked,
+	// the bytes read but not yet returned to the peer, and windowSize,
+	// the window the peer was granted in total.
+	windowMu   sync.Mutex
+	myWindow   uint32
+	unacked    uint32
+	windowSize uint32
 
 	// writeMu serializes calls to session.conn.Write() and
 	// protects sentClose and packetPool. This mutex must be
@@ -58,6 +68,9 @@ type Channel struct {
 
 	// packet buffer for writing
 	packetBuf []byte
+
+	// wq is the channel's place in the session writer.
+	wq channelQueue
 }
 
 // ID returns the unique identifier of this channel
@@ -75,10 +88,19 @@ func (ch *Channel) CloseWrite() error {
 }
 
 // Close signals end of channel use. No data may be sent after this
-// call.
+// call. Pending and later Reads and Writes fail.
 func (ch *Channel) Close() error {
-	return ch.send(codec.CloseMessage{
+	// no data may follow the close message
+	ch.session.sched.drop(ch)
+	err := ch.send(codec.CloseMessage{
 		ChannelID: ch.remoteId})
+	ch.pending.eof()
+	ch.remoteWin.close()
+	if err == io.EOF {
+		// already closed, by the peer or the session
+		return nil
+	}
+	return err
 }
 
 // Write writes len(data) bytes to the channel.
@@ -94,12 +116,9 @@ func (ch *Channel) Write(data []byte) (n int, err error) {
 		}
 
 		toSend := data[:space]
+		ch.session.keepalive.sent()
 
-		if err = ch.session.enc.Encode(codec.DataMessage{
-			ChannelID: ch.remoteId,
-			Length:    uint32(len(toSend)),
-			Data:      toSend,
-		}); err != nil {
+		if err = ch.session.sched.write(ch, toSend); err != nil {
 			return n, err
 		}
 
@@ -110,6 +129,90 @@ func (ch *Channel) Write(data []byte) (n int, err error) {
 	return n, err
 }
 
+// Type returns the channel type given when the channel was opened, "" if
+// it was opened without one.
+func (ch *Channel) Type() string {
+	return ch.chanType
+}
+
+// Extra returns the extra data given when the channel was opened.
+func (ch *Channel) Extra() []byte {
+	return ch.extra
+}
+
+// Metadata decodes Extra as key/value pairs, see codec.MarshalExtra.
+func (ch *Channel) Metadata() (map[string]string, error) {
+	return codec.UnmarshalExtra(ch.extra)
+}
+
+// SetDeadline sets the read and write deadlines, as net.Conn does.
+func (ch *Channel) SetDeadline(t time.Time) error {
+	ch.pending.setDeadline(t)
+	ch.remoteWin.setDeadline(t)
+	return nil
+}
+
+// SetReadDeadline makes Read fail with os.ErrDeadlineExceeded once t has
+// passed, including a Read that is already blocked. The zero time means no
+// deadline.
+func (ch *Channel) SetReadDeadline(t time.Time) error {
+	ch.pending.setDeadline(t)
+	return nil
+}
+
+// SetWriteDeadline makes Write fail with os.ErrDeadlineExceeded once t has
+// passed while it waits for the peer to grant window. The zero time means
+// no deadline.
+func (ch *Channel) SetWriteDeadline(t time.Time) error {
+	ch.remoteWin.setDeadline(t)
+	return nil
+}
+
+// LocalAddr returns this end of the channel. Its String is the "tunnel"
+// given in the channel metadata, if any.
+func (ch *Channel) LocalAddr() net.Addr {
+	md, _ := ch.Metadata()
+	return &Addr{ID: ch.localId, Type: ch.chanType, Host: md["tunnel"]}
+}
+
+// RemoteAddr returns the peer's end of the channel. Its String is the
+// "remote-addr" given in the channel metadata, if any, so that code
+// written for net.Conn logs the address of the forwarded client.
+func (ch *Channel) RemoteAddr() net.Addr {
+	md, _ := ch.Metadata()
+	return &Addr{ID: ch.remoteId, Type: ch.chanType, Host: md["remote-addr"]}
+}
+
+// Addr is the synthetic address of either end of a Channel.
+type Addr struct {
+	ID   uint32 // channel ID on that end of the session
+	Type string // channel type, "" for untyped channels
+	Host string // address taken from the channel metadata, if any
+}
+
+// Network returns "qmux".
+func (a *Addr) Network() string {
+	return "qmux"
+}
+
+func (a *Addr) String() string {
+	if a.Host != "" {
+		return a.Host
+	}
+	if a.Type != "" {
+		return fmt.Sprintf("%s/%d", a.Type, a.ID)
+	}
+	return fmt.Sprintf("channel/%d", a.ID)
+}
+
+var _ net.Conn = (*Channel)(nil)
+
+// SetPriority changes how the channel shares the session's transport with
+// the other channels, see Priority.
+func (ch *Channel) SetPriority(p Priority) {
+	ch.session.sched.setPriority(ch, p)
+}
+
 // Read reads up to len(data) bytes from the channel.
 func (c *Channel) Read(data []byte) (n int, err error) {
 	n, err = c.pending.Read(data)
@@ -144,15 +247,31 @@ func (ch *Channel) send(msg interface{}) error {
 	return ch.session.enc.Encode(msg)
 }
 
+// adjustWindow returns n read bytes to the peer. Updates are batched until
+// Config.WindowUpdateThreshold of the window has been read, and carry any
+// growth of the window decided by auto-tuning.
 func (c *Channel) adjustWindow(n uint32) error {
 	c.windowMu.Lock()
-	// Since myWindow is managed on our side, and can never exceed
-	// the initial window setting, we don't worry about overflow.
-	c.myWindow += uint32(n)
+	c.unacked += n
+	var grow uint32
+	if size := c.session.bdp.size(); size > c.windowSize {
+		grow = size - c.windowSize
+	}
+	threshold := uint32(float64(c.windowSize) * c.session.cfg.WindowUpdateThreshold)
+	if grow == 0 && c.unacked < threshold {
+		c.windowMu.Unlock()
+		return nil
+	}
+	// myWindow is managed on our side and never exceeds windowSize, so
+	// there is no overflow to worry about.
+	add := c.unacked + grow
+	c.windowSize += grow
+	c.myWindow += add
+	c.unacked = 0
 	c.windowMu.Unlock()
 	return c.send(codec.WindowAdjustMessage{
 		ChannelID:       c.remoteId,
-		AdditionalBytes: uint32(n),
+		AdditionalBytes: add,
 	})
 }
 
@@ -166,6 +285,7 @@ func (c *Channel) close() {
 	c.writeMu.Unlock()
 	// Unblock writers.
 	c.remoteWin.close()
+	c.session.sched.drop(c)
 }
 
 // responseMessageReceived is called when a success or failure message is
@@ -229,23 +349,34 @@ func (ch *Channel) handle(msg codec.Message) error {
 
 func (ch *Channel) handleData(msg *codec.DataMessage) error {
 	if msg.Length > ch.maxIncomingPayload {
+		msg.Release()
 		// TODO(hanwen): should send Disconnect?
 		return errors.New("qmux: incoming packet exceeds maximum payload size")
 	}
 
 	if msg.Length != uint32(len(msg.Data)) {
+		msg.Release()
 		return errors.New("qmux: wrong packet length")
 	}
 
 	ch.windowMu.Lock()
 	if ch.myWindow < msg.Length {
 		ch.windowMu.Unlock()
+		msg.Release()
 		// TODO(hanwen): should send Disconnect with reason?
 		return errors.New("qmux: remote side wrote too much")
 	}
 	ch.myWindow -= msg.Length
 	ch.windowMu.Unlock()
 
-	ch.pending.write(msg.Data)
+	if id, ok := ch.session.bdp.received(msg.Length); ok {
+		if err := ch.session.enc.Encode(codec.PingMessage{ID: id}); err != nil {
+			msg.Release()
+			return err
+		}
+	}
+
+	// the buffer releases msg once Read has copied all of it out
+	ch.pending.write(msg.Data, msg)
 	return nil
 }
@@ -0,0 +1,63 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+
+	"teleportServer/localPackages/codec"
+)
+
+// The reasons a peer can give for refusing a channel. An *OpenError
+// returned by Open matches the one for its reason with errors.Is.
+var (
+	ErrAdministrativelyProhibited = errors.New("qmux: channel open administratively prohibited")
+	ErrConnectFailed              = errors.New("qmux: channel open failed to connect")
+	ErrUnknownChannelType         = errors.New("qmux: unknown channel type")
+	ErrResourceShortage           = errors.New("qmux: channel open refused for lack of resources")
+)
+
+var reasonErrors = map[codec.OpenFailureReason]error{
+	codec.ReasonAdministrativelyProhibited: ErrAdministrativelyProhibited,
+	codec.ReasonConnectFailed:              ErrConnectFailed,
+	codec.ReasonUnknownChannelType:         ErrUnknownChannelType,
+	codec.ReasonResourceShortage:           ErrResourceShortage,
+}
+
+// OpenError is returned by Open when the peer refused the channel, and
+// can be returned by Config.Approve to refuse one with a reason. Peers
+// that predate reasons always refuse with codec.ReasonUnspecified.
+type OpenError struct {
+	Reason      codec.OpenFailureReason
+	Description string
+}
+
+func (e *OpenError) Error() string {
+	if e.Description == "" {
+		return fmt.Sprintf("qmux: channel open refused: %s", e.Reason)
+	}
+	return fmt.Sprintf("qmux: channel open refused: %s: %s", e.Reason, e.Description)
+}
+
+// Is makes errors.Is(err, ErrConnectFailed) and friends work.
+func (e *OpenError) Is(target error) bool {
+	reasonErr, ok := reasonErrors[e.Reason]
+	return ok && reasonErr == target
+}
+
+// openFailure turns an error returned by Config.Approve into the failure
+// sent to the peer.
+func openFailure(channelID uint32, err error) codec.OpenFailureMessage {
+	msg := codec.OpenFailureMessage{
+		ChannelID:   channelID,
+		Reason:      codec.ReasonAdministrativelyProhibited,
+		Description: err.Error(),
+	}
+	var openErr *OpenError
+	if errors.As(err, &openErr) {
+		msg.Reason, msg.Description = openErr.Reason, openErr.Description
+	}
+	if len(msg.Description) > codec.MaxDescriptionLength {
+		msg.Description = msg.Description[:codec.MaxDescriptionLength]
+	}
+	return msg
+}
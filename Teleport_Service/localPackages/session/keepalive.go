@@ -0,0 +1,157 @@
+package session
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"teleportServer/localPackages/codec"
+)
+
+const defaultKeepaliveMaxMissed = 3
+
+var (
+	// ErrKeepaliveTimeout is returned by Wait when the peer stopped
+	// answering pings.
+	ErrKeepaliveTimeout = errors.New("qmux: keepalive timeout, peer is not answering pings")
+
+	// ErrIdleTimeout is returned by Wait when the session carried no
+	// channel traffic for longer than Config.IdleTimeout.
+	ErrIdleTimeout = errors.New("qmux: session idle timeout")
+
+	// ErrReadTimeout is returned by Wait when nothing was received from
+	// the peer for longer than Config.ReadTimeout.
+	ErrReadTimeout = errors.New("qmux: read timeout, nothing received from peer")
+)
+
+// keepalive tracks the liveness of the peer.
+type keepalive struct {
+	lastSeen   int64 // unix nanos of the last packet received
+	lastActive int64 // unix nanos of the last channel traffic, either way
+
+	// protects the ping state below
+	mu      sync.Mutex
+	nextID  uint64
+	pending bool      // a ping is waiting for its pong
+	sentID  uint64    // ID of the pending ping
+	sentAt  time.Time // when the pending ping was sent
+	missed  int       // pings in a row that got no pong
+	rtt     time.Duration
+}
+
+// received records that a packet was received, and whether it was channel
+// traffic rather than keepalive chatter.
+func (k *keepalive) received(active bool) {
+	now := time.Now().UnixNano()
+	atomic.StoreInt64(&k.lastSeen, now)
+	if active {
+		atomic.StoreInt64(&k.lastActive, now)
+	}
+}
+
+// sent records that channel traffic was sent. It says nothing of the peer,
+// which may be dead while we write, so lastSeen is left alone.
+func (k *keepalive) sent() {
+	atomic.StoreInt64(&k.lastActive, time.Now().UnixNano())
+}
+
+// pong records the answer to a ping.
+func (k *keepalive) pong(id uint64) {
+	k.received(false)
+	k.mu.Lock()
+	if k.pending && id == k.sentID {
+		k.rtt = time.Since(k.sentAt)
+		k.pending = false
+		k.missed = 0
+	}
+	k.mu.Unlock()
+}
+
+// ping returns the ID of a new ping and whether too many pings have already
+// gone unanswered.
+func (k *keepalive) ping(maxMissed int) (uint64, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.pending {
+		k.missed++
+		if k.missed >= maxMissed {
+			return 0, false
+		}
+	}
+	k.nextID++
+	k.pending = true
+	k.sentID = k.nextID
+	k.sentAt = time.Now()
+	return k.sentID, true
+}
+
+// LastSeen returns when the last packet was received from the peer.
+func (s *Session) LastSeen() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&s.keepalive.lastSeen))
+}
+
+// RTT returns the round trip time measured by the last answered ping, or 0
+// if no ping has been answered yet.
+func (s *Session) RTT() time.Duration {
+	s.keepalive.mu.Lock()
+	defer s.keepalive.mu.Unlock()
+	return s.keepalive.rtt
+}
+
+// keepaliveLoop pings the peer and enforces the idle and read timeouts
+// until the session is closed.
+func (s *Session) keepaliveLoop() {
+	var pingC, idleC, readC <-chan time.Time
+	if s.cfg.KeepaliveInterval > 0 {
+		ticker := time.NewTicker(s.cfg.KeepaliveInterval)
+		defer ticker.Stop()
+		pingC = ticker.C
+	}
+	var idleTimer *time.Timer
+	if s.cfg.IdleTimeout > 0 {
+		idleTimer = time.NewTimer(s.cfg.IdleTimeout)
+		defer idleTimer.Stop()
+		idleC = idleTimer.C
+	}
+	var readTimer *time.Timer
+	if s.cfg.ReadTimeout > 0 {
+		readTimer = time.NewTimer(s.cfg.ReadTimeout)
+		defer readTimer.Stop()
+		readC = readTimer.C
+	}
+
+	for {
+		select {
+		case <-s.done:
+			return
+
+		case <-idleC:
+			idle := time.Since(time.Unix(0, atomic.LoadInt64(&s.keepalive.lastActive)))
+			if idle >= s.cfg.IdleTimeout {
+				s.closeWith(ErrIdleTimeout)
+				return
+			}
+			idleTimer.Reset(s.cfg.IdleTimeout - idle)
+
+		case <-readC:
+			quiet := time.Since(time.Unix(0, atomic.LoadInt64(&s.keepalive.lastSeen)))
+			if quiet >= s.cfg.ReadTimeout {
+				s.closeWith(ErrReadTimeout)
+				return
+			}
+			readTimer.Reset(s.cfg.ReadTimeout - quiet)
+
+		case <-pingC:
+			id, ok := s.keepalive.ping(s.cfg.KeepaliveMaxMissed)
+			if !ok {
+				s.closeWith(ErrKeepaliveTimeout)
+				return
+			}
+			if err := s.enc.Encode(codec.PingMessage{ID: id}); err != nil {
+				s.closeWith(err)
+				return
+			}
+		}
+	}
+}
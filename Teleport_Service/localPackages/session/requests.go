@@ -0,0 +1,126 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+
+	"teleportServer/localPackages/codec"
+)
+
+// ErrRequestsUnsupported is returned by Request when Config.GlobalRequests
+// is not set.
+var ErrRequestsUnsupported = errors.New("qmux: peer does not support session requests")
+
+// Request is a session level request received from the peer.
+type Request struct {
+	Type      string
+	WantReply bool
+	Payload   []byte
+}
+
+// RequestHandler handles a request from the peer. When the peer wants a
+// reply, ok and payload are sent back to it.
+type RequestHandler func(req *Request) (ok bool, payload []byte)
+
+// requests tracks the requests sent to the peer that wait for a reply, and
+// the handler of the requests received from it.
+type requests struct {
+	mu      sync.Mutex
+	nextID  uint32
+	pending map[uint32]chan *codec.ResponseMessage
+	handler RequestHandler
+}
+
+// add registers a request waiting for a reply and returns its ID.
+func (r *requests) add() (uint32, chan *codec.ResponseMessage) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.pending == nil {
+		r.pending = make(map[uint32]chan *codec.ResponseMessage)
+	}
+	r.nextID++
+	reply := make(chan *codec.ResponseMessage, 1)
+	r.pending[r.nextID] = reply
+	return r.nextID, reply
+}
+
+func (r *requests) remove(id uint32) {
+	r.mu.Lock()
+	delete(r.pending, id)
+	r.mu.Unlock()
+}
+
+// Request sends a request of type typ to the peer. If wantReply is set it
+// waits for the peer's answer and returns it; otherwise it returns as soon
+// as the request is sent, with ok set. It fails with ErrRequestsUnsupported,
+// before anything is sent, unless the peer is known to support requests.
+func (s *Session) Request(ctx context.Context, typ string, wantReply bool, payload []byte) (ok bool, reply []byte, err error) {
+	if !s.cfg.GlobalRequests {
+		return false, nil, ErrRequestsUnsupported
+	}
+	msg := codec.RequestMessage{Type: typ, WantReply: wantReply, Payload: payload}
+	if !wantReply {
+		if err := s.enc.Encode(msg); err != nil {
+			return false, nil, err
+		}
+		return true, nil, nil
+	}
+
+	id, replyCh := s.requests.add()
+	defer s.requests.remove(id)
+	msg.ID = id
+	if err := s.enc.Encode(msg); err != nil {
+		return false, nil, err
+	}
+
+	select {
+	case m := <-replyCh:
+		return m.OK, m.Payload, nil
+	case <-ctx.Done():
+		return false, nil, ctx.Err()
+	case <-s.done:
+		return false, nil, io.EOF
+	}
+}
+
+// HandleRequests sets the handler of the requests the peer sends. Each
+// request is handled in a goroutine of its own. Without a handler requests
+// are refused.
+func (s *Session) HandleRequests(handler RequestHandler) {
+	s.requests.mu.Lock()
+	s.requests.handler = handler
+	s.requests.mu.Unlock()
+}
+
+func (s *Session) handleRequest(msg *codec.RequestMessage) {
+	s.requests.mu.Lock()
+	handler := s.requests.handler
+	s.requests.mu.Unlock()
+
+	go func() {
+		var ok bool
+		var payload []byte
+		if handler != nil {
+			ok, payload = handler(&Request{Type: msg.Type, WantReply: msg.WantReply, Payload: msg.Payload})
+		}
+		if msg.WantReply {
+			// fails only when the session is gone
+			s.enc.Encode(codec.ResponseMessage{ID: msg.ID, OK: ok, Payload: payload})
+		}
+	}()
+}
+
+func (s *Session) handleResponse(msg *codec.ResponseMessage) error {
+	s.requests.mu.Lock()
+	reply, ok := s.requests.pending[msg.ID]
+	delete(s.requests.pending, msg.ID)
+	s.requests.mu.Unlock()
+	if !ok {
+		// the requester gave up waiting
+		return nil
+	}
+	reply <- msg
+	return nil
+}
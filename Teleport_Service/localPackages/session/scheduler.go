@@ -0,0 +1,211 @@
+package session
+
+import (
+	"io"
+	"sync"
+
+	"teleportServer/localPackages/codec"
+)
+
+// Priority is a channel's weight in the session writer. A channel with
+// twice the priority of another gets twice its share of the transport
+// while both have data to send.
+type Priority uint8
+
+const (
+	PriorityBulk        Priority = 1
+	PriorityNormal      Priority = 4
+	PriorityInteractive Priority = 16
+)
+
+// quantum is the credit, in bytes, a channel earns per unit of priority
+// each time the scheduler comes round to it.
+const quantum = 2048
+
+// scheduler serializes the data frames of all channels onto the encoder.
+// Channels with queued frames are served deficit round robin, so a bulk
+// download cannot hold the transport while an interactive channel waits:
+// at most one frame of another channel goes out before it gets its turn.
+type scheduler struct {
+	mu     sync.Mutex
+	wakeup *sync.Cond // signalled when a frame is queued
+
+	// active holds the channels with queued frames, in service order.
+	active []*Channel
+	err    error // set once the writer has stopped
+
+	// sending is the channel whose frame is being written, outside mu.
+	sending *Channel
+}
+
+// channelQueue is a channel's state in the scheduler, guarded by
+// scheduler.mu.
+type channelQueue struct {
+	priority Priority
+	frames   [][]byte
+	deficit  int
+	queued   uint64     // frames ever queued
+	sent     uint64     // frames ever written
+	err      error      // set when the channel is dropped
+	done     *sync.Cond // signalled when a frame was written or dropped
+}
+
+func newScheduler() *scheduler {
+	s := &scheduler{}
+	s.wakeup = sync.NewCond(&s.mu)
+	return s
+}
+
+func (s *scheduler) add(ch *Channel, p Priority) {
+	ch.wq.priority = p
+	ch.wq.done = sync.NewCond(&s.mu)
+}
+
+// setPriority changes the weight of ch, effective from its next turn.
+func (s *scheduler) setPriority(ch *Channel, p Priority) {
+	if p == 0 {
+		p = PriorityNormal
+	}
+	s.mu.Lock()
+	ch.wq.priority = p
+	s.mu.Unlock()
+}
+
+// write queues data as one frame of ch and waits until it has been
+// written, so data may be reused once write returns.
+func (s *scheduler) write(ch *Channel, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	q := &ch.wq
+	if s.err != nil {
+		return s.err
+	}
+	if q.err != nil {
+		return q.err
+	}
+	if len(q.frames) == 0 {
+		s.active = append(s.active, ch)
+	}
+	q.frames = append(q.frames, data)
+	q.queued++
+	seq := q.queued
+	s.wakeup.Signal()
+
+	for q.sent < seq {
+		if s.err != nil {
+			return s.err
+		}
+		if q.err != nil {
+			return q.err
+		}
+		q.done.Wait()
+	}
+	return nil
+}
+
+// drop discards the queued frames of ch, whose writers get io.EOF. A
+// frame the writer already took is written before drop returns, so no data
+// of ch follows a close message sent after drop.
+func (s *scheduler) drop(ch *Channel) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	q := &ch.wq
+	q.err = io.EOF
+	if len(q.frames) > 0 {
+		for i := range q.frames {
+			q.frames[i] = nil
+		}
+		q.frames = q.frames[:0]
+		q.deficit = 0
+		s.remove(ch)
+		q.done.Broadcast()
+	}
+	for s.sending == ch && s.err == nil {
+		q.done.Wait()
+	}
+}
+
+// remove takes ch out of the active list.
+func (s *scheduler) remove(ch *Channel) {
+	for i, c := range s.active {
+		if c == ch {
+			copy(s.active[i:], s.active[i+1:])
+			s.active[len(s.active)-1] = nil
+			s.active = s.active[:len(s.active)-1]
+			return
+		}
+	}
+}
+
+// close stops the writer. Pending and future writes fail with err.
+func (s *scheduler) close(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return
+	}
+	s.err = err
+	for _, ch := range s.active {
+		ch.wq.done.Broadcast()
+	}
+	s.wakeup.Broadcast()
+}
+
+// loop writes queued frames to enc until the scheduler is closed or a
+// write fails.
+func (s *scheduler) loop(enc *codec.Encoder) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for {
+		for len(s.active) == 0 && s.err == nil {
+			s.wakeup.Wait()
+		}
+		if s.err != nil {
+			return
+		}
+
+		ch := s.active[0]
+		q := &ch.wq
+		q.deficit += quantum * int(q.priority)
+		for len(q.frames) > 0 && q.deficit >= len(q.frames[0]) {
+			data := q.frames[0]
+			copy(q.frames, q.frames[1:])
+			q.frames[len(q.frames)-1] = nil
+			q.frames = q.frames[:len(q.frames)-1]
+			q.deficit -= len(data)
+
+			s.sending = ch
+			s.mu.Unlock()
+			err := enc.EncodeData(ch.remoteId, data)
+			s.mu.Lock()
+			s.sending = nil
+
+			if err != nil {
+				if s.err == nil {
+					s.err = err
+				}
+				q.done.Broadcast()
+				for _, c := range s.active {
+					c.wq.done.Broadcast()
+				}
+				break
+			}
+			q.sent++
+			q.done.Broadcast()
+		}
+
+		// the channel may have been dropped while the lock was released
+		if len(s.active) > 0 && s.active[0] == ch {
+			copy(s.active, s.active[1:])
+			s.active = s.active[:len(s.active)-1]
+			if len(q.frames) > 0 {
+				s.active = append(s.active, ch)
+			} else {
+				q.deficit = 0
+			}
+		}
+	}
+}
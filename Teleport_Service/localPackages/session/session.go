@@ -2,12 +2,14 @@ package session
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"sync"
+	"time"
 
-	"github.com/progrium/qmux/golang/codec"
-	"github.com/progrium/qmux/golang/mux"
+	"teleportServer/localPackages/codec"
+	"teleportServer/localPackages/mux"
 )
 
 const (
@@ -25,37 +27,170 @@ const (
 	// primarily for testing: setting chanSize=0 uncovers deadlocks more
 	// quickly.
 	chanSize = 16
+
+	defaultWindowUpdateThreshold = 0.5
 )
 
+// ErrOpenMetadataUnsupported is returned by OpenWith for a channel type or
+// extra data when Config.OpenMetadata is not set.
+var ErrOpenMetadataUnsupported = errors.New("qmux: peer does not support channel open metadata")
+
 // Session is a bi-directional channel muxing session on a given transport.
 type Session struct {
 	t     mux.Transport
 	chans chanList
 
-	enc *codec.Encoder
-	dec *codec.Decoder
+	enc   *codec.Encoder
+	dec   *codec.Decoder
+	sched *scheduler
+
+	inbox   chan mux.Channel
+	backlog chan struct{} // one token per channel opened by the peer and not yet accepted
+
+	errCond  *sync.Cond
+	err      error
+	closeErr error // reason given to closeWith, reported by Wait
+	done     chan struct{}
+
+	cfg       Config
+	keepalive keepalive
+	bdp       bdpEstimator
+	requests  requests
+}
+
+// Config tunes a Session. The zero value disables keepalive and the idle
+// and read timeouts.
+type Config struct {
+	// KeepaliveInterval is how often the peer is pinged, 0 disables pings.
+	// Peers that predate pings cannot decode them, so support has to be
+	// agreed out of band, as the tunnel handshake does.
+	KeepaliveInterval time.Duration
+
+	// KeepaliveMaxMissed is how many pings in a row may go unanswered
+	// before the session is closed with ErrKeepaliveTimeout.
+	KeepaliveMaxMissed int
+
+	// IdleTimeout closes the session with ErrIdleTimeout once no channel
+	// traffic has been sent or received for that long, 0 disables it.
+	IdleTimeout time.Duration
+
+	// ReadTimeout closes the session with ErrReadTimeout once nothing has
+	// been received from the peer for that long, 0 disables it. It stands
+	// in for keepalive with peers that cannot answer pings.
+	ReadTimeout time.Duration
+
+	// WindowSize is the receive window each channel starts with, 0 means
+	// 2 MiB. The peer cannot have more unread data in flight per channel.
+	WindowSize uint32
+
+	// MaxPacketSize is the largest data packet the peer may send, 0 means
+	// 32 KiB.
+	MaxPacketSize uint32
+
+	// WindowUpdateThreshold is the fraction of the window that has to be
+	// read before the consumed bytes are returned to the peer in a single
+	// window update. 0 means 1/2; it must not be above 1.
+	WindowUpdateThreshold float64
+
+	// MaxWindowSize enables window auto-tuning when larger than
+	// WindowSize: the session measures the bandwidth-delay product with
+	// pings and grows the windows of its channels up to MaxWindowSize, so
+	// that high-latency links stay full. Like keepalive, it needs a peer
+	// that answers pings.
+	MaxWindowSize uint32
+
+	// OpenMetadata tells the session that the peer understands channel
+	// types and extra data (see OpenOptions) and open failure reasons.
+	// Peers that predate them cannot decode such messages, so support has
+	// to be agreed out of band, as the tunnel handshake does.
+	OpenMetadata bool
+
+	// AcceptTypes lists the channel types the peer may open, "" standing
+	// for channels opened without a type. Other opens are refused with
+	// codec.ReasonUnknownChannelType. nil accepts every type.
+	AcceptTypes []string
+
+	// Approve, if set, decides on every channel the peer opens before it
+	// is confirmed, in a goroutine of its own so it may take its time,
+	// for instance to dial the service the channel is for. Returning an
+	// error refuses the channel: an *OpenError is sent with its reason and
+	// description, any other error as administratively prohibited. Only
+	// approved channels are returned by Accept.
+	Approve func(ch *Channel) error
+
+	// AcceptBacklog is how many channels opened by the peer may wait for
+	// Accept, approval included, 0 means 16. Opens beyond it are refused
+	// with codec.ReasonResourceShortage, so a peer cannot stall the
+	// session by opening channels nobody accepts.
+	AcceptBacklog int
+
+	// GlobalRequests tells the session that the peer understands session
+	// requests (see Session.Request). Like OpenMetadata it has to be
+	// agreed out of band.
+	GlobalRequests bool
+}
 
-	inbox chan mux.Channel
+// OpenOptions describe a channel to open.
+type OpenOptions struct {
+	// Type and Extra are sent to the peer with the open, see
+	// codec.OpenMessage. They need Config.OpenMetadata.
+	Type  string
+	Extra []byte
 
-	errCond *sync.Cond
-	err     error
-	closeCh chan bool
+	// Priority schedules the channel's writes, see Priority.
+	Priority Priority
 }
 
 // NewSession returns a session that runs over the given transport.
 func New(t mux.Transport) *Session {
+	return NewWithConfig(t, Config{})
+}
+
+// NewWithConfig returns a session that runs over the given transport and
+// is tuned by cfg.
+func NewWithConfig(t mux.Transport, cfg Config) *Session {
 	if t == nil {
 		return nil
 	}
+	if cfg.KeepaliveMaxMissed <= 0 {
+		cfg.KeepaliveMaxMissed = defaultKeepaliveMaxMissed
+	}
+	if cfg.WindowSize == 0 {
+		cfg.WindowSize = channelWindowSize
+	}
+	if cfg.MaxPacketSize == 0 {
+		cfg.MaxPacketSize = channelMaxPacket
+	}
+	if cfg.MaxPacketSize < minPacketLength {
+		cfg.MaxPacketSize = minPacketLength
+	}
+	if cfg.WindowUpdateThreshold <= 0 || cfg.WindowUpdateThreshold > 1 {
+		cfg.WindowUpdateThreshold = defaultWindowUpdateThreshold
+	}
+	if cfg.AcceptBacklog <= 0 {
+		cfg.AcceptBacklog = chanSize
+	}
 	s := &Session{
 		t:       t,
 		enc:     codec.NewEncoder(t),
 		dec:     codec.NewDecoder(t),
-		inbox:   make(chan mux.Channel, chanSize),
+		sched:   newScheduler(),
+		inbox:   make(chan mux.Channel, cfg.AcceptBacklog),
+		backlog: make(chan struct{}, cfg.AcceptBacklog),
 		errCond: sync.NewCond(new(sync.Mutex)),
-		closeCh: make(chan bool, 1),
+		done:    make(chan struct{}),
+		cfg:     cfg,
 	}
+	// we never advertise a bigger packet than cfg.MaxPacketSize
+	s.dec.MaxDataLength = cfg.MaxPacketSize
+	s.bdp.window = cfg.WindowSize
+	s.bdp.max = cfg.MaxWindowSize
+	s.keepalive.received(true)
 	go s.loop()
+	go s.sched.loop(s.enc)
+	if cfg.KeepaliveInterval > 0 || cfg.IdleTimeout > 0 || cfg.ReadTimeout > 0 {
+		go s.keepaliveLoop()
+	}
 	return s
 }
 
@@ -65,6 +200,17 @@ func (s *Session) Close() error {
 	return nil
 }
 
+// closeWith closes the underlying transport and makes Wait report reason
+// instead of the resulting read error.
+func (s *Session) closeWith(reason error) {
+	s.errCond.L.Lock()
+	if s.closeErr == nil {
+		s.closeErr = reason
+	}
+	s.errCond.L.Unlock()
+	s.t.Close()
+}
+
 // Wait blocks until the transport has shut down, and returns the
 // error causing the shutdown.
 func (s *Session) Wait() error {
@@ -78,23 +224,53 @@ func (s *Session) Wait() error {
 
 // Accept waits for and returns the next incoming channel.
 func (s *Session) Accept() (mux.Channel, error) {
+	return s.AcceptContext(context.Background())
+}
+
+// AcceptContext waits for and returns the next incoming channel, or fails
+// with ctx.Err() once ctx is done.
+func (s *Session) AcceptContext(ctx context.Context) (mux.Channel, error) {
 	select {
 	case ch := <-s.inbox:
+		<-s.backlog
 		return ch, nil
-	case <-s.closeCh:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-s.done:
 		return nil, io.EOF
 	}
 }
 
 // Open establishes a new channel with the other end.
 func (s *Session) Open(ctx context.Context) (mux.Channel, error) {
-	ch := s.newChannel(channelOutbound)
-	ch.maxIncomingPayload = channelMaxPacket
+	return s.OpenPriority(ctx, PriorityNormal)
+}
+
+// OpenPriority establishes a new channel with the other end whose writes
+// are scheduled with priority p. Priorities are local: they decide how
+// this side shares the transport and are not sent to the peer.
+func (s *Session) OpenPriority(ctx context.Context, p Priority) (mux.Channel, error) {
+	return s.OpenWith(ctx, OpenOptions{Priority: p})
+}
+
+// OpenWith establishes a new channel with the other end as described by
+// opts. It fails with ErrOpenMetadataUnsupported, before anything is sent,
+// when opts has a Type or Extra and the peer is not known to support them.
+func (s *Session) OpenWith(ctx context.Context, opts OpenOptions) (mux.Channel, error) {
+	if (opts.Type != "" || len(opts.Extra) > 0) && !s.cfg.OpenMetadata {
+		return nil, ErrOpenMetadataUnsupported
+	}
+
+	ch := s.newChannel(channelOutbound, opts.Priority)
+	ch.maxIncomingPayload = s.cfg.MaxPacketSize
+	ch.chanType, ch.extra = opts.Type, opts.Extra
 
 	if err := s.enc.Encode(codec.OpenMessage{
 		WindowSize:    ch.myWindow,
 		MaxPacketSize: ch.maxIncomingPayload,
 		SenderID:      ch.localId,
+		Type:          opts.Type,
+		Extra:         opts.Extra,
 	}); err != nil {
 		return nil, err
 	}
@@ -114,22 +290,27 @@ func (s *Session) Open(ctx context.Context) (mux.Channel, error) {
 	case *codec.OpenConfirmMessage:
 		return ch, nil
 	case *codec.OpenFailureMessage:
-		return nil, fmt.Errorf("qmux: channel open failed on remote side")
+		return nil, &OpenError{Reason: msg.Reason, Description: msg.Description}
 	default:
 		return nil, fmt.Errorf("qmux: unexpected packet in response to channel open: %v", msg)
 	}
 }
 
-func (s *Session) newChannel(direction channelDirection) *Channel {
+func (s *Session) newChannel(direction channelDirection, p Priority) *Channel {
+	if p == 0 {
+		p = PriorityNormal
+	}
 	ch := &Channel{
 		remoteWin: window{Cond: sync.NewCond(new(sync.Mutex))},
-		myWindow:  channelWindowSize,
 		pending:   newBuffer(),
 		direction: direction,
 		msg:       make(chan codec.Message, chanSize),
 		session:   s,
 		packetBuf: make([]byte, 0),
 	}
+	ch.myWindow = s.bdp.size()
+	ch.windowSize = ch.myWindow
+	s.sched.add(ch, p)
 	ch.localId = s.chans.add(ch)
 	return ch
 }
@@ -142,14 +323,19 @@ func (s *Session) loop() {
 		err = s.onePacket()
 	}
 
+	// stop the writer first, closing channels waits for it
+	s.t.Close()
+	s.sched.close(io.EOF)
+
 	for _, ch := range s.chans.dropAll() {
 		ch.close()
 	}
-
-	s.t.Close()
-	s.closeCh <- true
+	close(s.done)
 
 	s.errCond.L.Lock()
+	if s.closeErr != nil {
+		err = s.closeErr
+	}
 	s.err = err
 	s.errCond.Broadcast()
 	s.errCond.L.Unlock()
@@ -167,8 +353,9 @@ func (s *Session) onePacket() error {
 
 	id, isChan := msg.Channel()
 	if !isChan {
-		return s.handleOpen(msg.(*codec.OpenMessage))
+		return s.handleSessionMessage(msg)
 	}
+	s.keepalive.received(true)
 
 	ch := s.chans.getChan(id)
 	if ch == nil {
@@ -178,21 +365,91 @@ func (s *Session) onePacket() error {
 	return ch.handle(msg)
 }
 
+// handleSessionMessage handles the messages that belong to no channel.
+func (s *Session) handleSessionMessage(msg codec.Message) error {
+	switch m := msg.(type) {
+	case *codec.OpenMessage:
+		s.keepalive.received(true)
+		return s.handleOpen(m)
+	case *codec.PingMessage:
+		s.keepalive.received(false)
+		return s.enc.Encode(codec.PongMessage{ID: m.ID})
+	case *codec.PongMessage:
+		if m.ID&bdpPingFlag != 0 {
+			s.keepalive.received(false)
+			s.bdp.pong(m.ID)
+			return nil
+		}
+		s.keepalive.pong(m.ID)
+		return nil
+	case *codec.RequestMessage:
+		s.keepalive.received(false)
+		s.handleRequest(m)
+		return nil
+	case *codec.ResponseMessage:
+		s.keepalive.received(false)
+		return s.handleResponse(m)
+	default:
+		return fmt.Errorf("qmux: unexpected session message %v", msg)
+	}
+}
+
 // handleChannelOpen schedules a channel to be Accept()ed.
 func (s *Session) handleOpen(msg *codec.OpenMessage) error {
+	// a peer that sent a type or extra data understands failure reasons
+	withReason := s.cfg.OpenMetadata || msg.Type != "" || len(msg.Extra) > 0
+
 	if msg.MaxPacketSize < minPacketLength || msg.MaxPacketSize > maxPacketLength {
-		return s.enc.Encode(codec.OpenFailureMessage{
-			ChannelID: msg.SenderID,
-		})
+		return s.refuse(codec.OpenFailureMessage{ChannelID: msg.SenderID}, withReason)
+	}
+	if !s.acceptsType(msg.Type) {
+		return s.refuse(codec.OpenFailureMessage{
+			ChannelID:   msg.SenderID,
+			Reason:      codec.ReasonUnknownChannelType,
+			Description: fmt.Sprintf("channel type %q is not accepted", msg.Type),
+		}, withReason)
 	}
 
-	c := s.newChannel(channelInbound)
+	// the token is given back by Accept, or when approval fails
+	select {
+	case s.backlog <- struct{}{}:
+	default:
+		return s.refuse(codec.OpenFailureMessage{
+			ChannelID:   msg.SenderID,
+			Reason:      codec.ReasonResourceShortage,
+			Description: "accept backlog is full",
+		}, withReason)
+	}
+
+	c := s.newChannel(channelInbound, PriorityNormal)
 	c.remoteId = msg.SenderID
 	c.maxRemotePayload = msg.MaxPacketSize
 	c.remoteWin.add(msg.WindowSize)
-	c.maxIncomingPayload = channelMaxPacket
+	c.maxIncomingPayload = s.cfg.MaxPacketSize
+	c.chanType, c.extra = msg.Type, msg.Extra
+
+	if s.cfg.Approve != nil {
+		go s.approve(c, withReason)
+		return nil
+	}
+	// never blocks, the inbox holds as many channels as there are tokens
+	s.inbox <- c
+	return s.confirm(c)
+}
+
+// approve runs Config.Approve for c and confirms or refuses it.
+func (s *Session) approve(c *Channel, withReason bool) {
+	if err := s.cfg.Approve(c); err != nil {
+		s.chans.remove(c.localId)
+		<-s.backlog
+		s.refuse(openFailure(c.remoteId, err), withReason)
+		return
+	}
 	s.inbox <- c
+	s.confirm(c)
+}
 
+func (s *Session) confirm(c *Channel) error {
 	return s.enc.Encode(codec.OpenConfirmMessage{
 		ChannelID:     c.remoteId,
 		SenderID:      c.localId,
@@ -200,3 +457,24 @@ func (s *Session) handleOpen(msg *codec.OpenMessage) error {
 		MaxPacketSize: c.maxIncomingPayload,
 	})
 }
+
+// refuse sends msg, stripped of its reason for peers that do not know
+// reasons.
+func (s *Session) refuse(msg codec.OpenFailureMessage, withReason bool) error {
+	if !withReason {
+		msg.Reason, msg.Description = codec.ReasonUnspecified, ""
+	}
+	return s.enc.Encode(msg)
+}
+
+func (s *Session) acceptsType(t string) bool {
+	if s.cfg.AcceptTypes == nil {
+		return true
+	}
+	for _, accepted := range s.cfg.AcceptTypes {
+		if accepted == t {
+			return true
+		}
+	}
+	return false
+}
@@ -4,15 +4,24 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
-	"github.com/progrium/qmux/golang/mux"
+	"teleportServer/localPackages/codec"
+	"teleportServer/localPackages/mux"
+
+	"golang.org/x/net/nettest"
 )
 
-func fatal(err error, t *testing.T) {
+func fatal(err error, t testing.TB) {
 	t.Helper()
 	if err != nil {
 		t.Fatal(err)
@@ -124,3 +133,795 @@ func TestSessionWait(t *testing.T) {
 		t.Fatalf("expected a network error, but got: %v", err)
 	}
 }
+
+// sessionPair returns two sessions talking to each other over TCP.
+func sessionPair(t testing.TB, cfgA, cfgB Config) (*Session, *Session) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	fatal(err, t)
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+
+	connA, err := net.Dial("tcp", l.Addr().String())
+	fatal(err, t)
+	connB, ok := <-accepted
+	if !ok {
+		t.Fatal("accept failed")
+	}
+
+	a, b := NewWithConfig(connA, cfgA), NewWithConfig(connB, cfgB)
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return a, b
+}
+
+func waitErr(t *testing.T, sess *Session, timeout time.Duration) error {
+	t.Helper()
+	errCh := make(chan error, 1)
+	go func() { errCh <- sess.Wait() }()
+	select {
+	case err := <-errCh:
+		return err
+	case <-time.After(timeout):
+		t.Fatal("session did not shut down in time")
+		return nil
+	}
+}
+
+func TestKeepaliveMeasuresRTT(t *testing.T) {
+	a, _ := sessionPair(t, Config{KeepaliveInterval: 10 * time.Millisecond}, Config{})
+
+	deadline := time.Now().Add(2 * time.Second)
+	for a.RTT() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no pong received")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if since := time.Since(a.LastSeen()); since > time.Second {
+		t.Fatalf("last seen %v ago", since)
+	}
+
+	// a healthy peer keeps the session alive well past the missed pong limit
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case <-a.done:
+		t.Fatalf("session closed: %v", a.Wait())
+	default:
+	}
+}
+
+func TestKeepaliveDetectsDeadPeer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	fatal(err, t)
+	defer l.Close()
+
+	// a peer that reads everything and never answers
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(ioutil.Discard, conn)
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	fatal(err, t)
+	defer conn.Close()
+
+	sess := NewWithConfig(conn, Config{KeepaliveInterval: 10 * time.Millisecond, KeepaliveMaxMissed: 3})
+	if err := waitErr(t, sess, 2*time.Second); err != ErrKeepaliveTimeout {
+		t.Fatalf("expected ErrKeepaliveTimeout, got %v", err)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	a, b := sessionPair(t,
+		Config{KeepaliveInterval: 10 * time.Millisecond, IdleTimeout: 100 * time.Millisecond},
+		Config{})
+
+	// traffic keeps the session open
+	ch, err := a.Open(context.Background())
+	fatal(err, t)
+	peer, err := b.Accept()
+	fatal(err, t)
+	go io.Copy(ioutil.Discard, peer)
+	for i := 0; i < 10; i++ {
+		_, err := ch.Write([]byte("ping"))
+		fatal(err, t)
+		time.Sleep(20 * time.Millisecond)
+	}
+	select {
+	case <-a.done:
+		t.Fatalf("session closed while active: %v", a.Wait())
+	default:
+	}
+
+	// pings alone do not
+	if err := waitErr(t, a, 2*time.Second); err != ErrIdleTimeout {
+		t.Fatalf("expected ErrIdleTimeout, got %v", err)
+	}
+}
+
+// benchmarkTransfer moves 1MB per op from ch to remote and reports the
+// heap allocations made by both sessions per megabyte.
+func benchmarkTransfer(b *testing.B, ch, remote mux.Channel) {
+	const perOp = 1 << 20
+	chunk := make([]byte, 1<<15)
+	go func() {
+		for {
+			for sent := 0; sent < perOp; sent += len(chunk) {
+				if _, err := ch.Write(chunk); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	buf := make([]byte, 1<<15)
+	b.SetBytes(perOp)
+	b.ReportAllocs()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for got := 0; got < perOp; {
+			n, err := remote.Read(buf)
+			if err != nil {
+				b.Fatal(err)
+			}
+			got += n
+		}
+	}
+	b.StopTimer()
+	runtime.ReadMemStats(&after)
+	b.ReportMetric(float64(after.Mallocs-before.Mallocs)/float64(b.N), "allocs/MB")
+}
+
+func openPair(tb testing.TB, a, b *Session) (mux.Channel, mux.Channel) {
+	tb.Helper()
+	ch, err := a.Open(context.Background())
+	fatal(err, tb)
+	remote, err := b.Accept()
+	fatal(err, tb)
+	return ch, remote
+}
+
+func BenchmarkChannelThroughput(b *testing.B) {
+	a, peer := sessionPair(b, Config{}, Config{})
+	ch, remote := openPair(b, a, peer)
+	benchmarkTransfer(b, ch, remote)
+}
+
+// BenchmarkHighLatency compares fixed and auto-tuned windows over a link
+// with a 40ms round trip.
+func BenchmarkHighLatency(b *testing.B) {
+	configs := []struct {
+		name string
+		cfg  Config
+	}{
+		{"fixed-2MB", Config{}},
+		{"fixed-2MB-update-every-read", Config{WindowUpdateThreshold: 1e-9}},
+		{"autotune-32MB", Config{MaxWindowSize: 32 << 20}},
+	}
+	for _, c := range configs {
+		b.Run(c.name, func(b *testing.B) {
+			connA, connB := latencyPipe(20 * time.Millisecond)
+			a, peer := New(connA), NewWithConfig(connB, c.cfg)
+			defer a.Close()
+			defer peer.Close()
+			ch, remote := openPair(b, a, peer)
+			benchmarkTransfer(b, ch, remote)
+		})
+	}
+}
+
+func TestWindowUpdatesAreBatched(t *testing.T) {
+	a, b := sessionPair(t, Config{WindowSize: 64 << 10, WindowUpdateThreshold: 0.5}, Config{})
+	ch, remote := openPair(t, a, b)
+	local := ch.(*Channel)
+	windowFilled := func(want uint32) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			peerWin := &remote.(*Channel).remoteWin
+			peerWin.L.Lock()
+			win := peerWin.win
+			peerWin.L.Unlock()
+			if win == want {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("peer window is %d, expected %d", win, want)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	_, err := remote.Write(make([]byte, 10<<10))
+	fatal(err, t)
+	_, err = io.ReadFull(ch, make([]byte, 10<<10))
+	fatal(err, t)
+	// below the threshold nothing is returned to the peer yet
+	time.Sleep(20 * time.Millisecond)
+	windowFilled(54 << 10)
+
+	_, err = remote.Write(make([]byte, 30<<10))
+	fatal(err, t)
+	_, err = io.ReadFull(ch, make([]byte, 30<<10))
+	fatal(err, t)
+	windowFilled(64 << 10)
+
+	local.windowMu.Lock()
+	defer local.windowMu.Unlock()
+	if local.unacked != 0 || local.myWindow != 64<<10 {
+		t.Fatalf("unexpected window state: unacked %d, window %d", local.unacked, local.myWindow)
+	}
+}
+
+func TestWindowAutoTuning(t *testing.T) {
+	connA, connB := latencyPipe(10 * time.Millisecond)
+	a := New(connA)
+	b := NewWithConfig(connB, Config{WindowSize: 64 << 10, MaxWindowSize: 4 << 20})
+	defer a.Close()
+	defer b.Close()
+	ch, remote := openPair(t, a, b)
+
+	const total = 8 << 20
+	go func() {
+		ch.Write(make([]byte, total))
+		ch.CloseWrite()
+	}()
+	n, err := io.Copy(ioutil.Discard, remote)
+	fatal(err, t)
+	if n != total {
+		t.Fatalf("expected %d bytes, got %d", total, n)
+	}
+
+	if got := b.WindowSize(); got <= 64<<10 || got > 4<<20 {
+		t.Fatalf("expected the window to grow within bounds, got %d", got)
+	}
+	if got := remote.(*Channel).windowSize; got <= 64<<10 {
+		t.Fatalf("expected the channel window to grow, got %d", got)
+	}
+	// the sender's window was left alone
+	if a.WindowSize() != channelWindowSize {
+		t.Fatalf("expected the sender to keep its window, got %d", a.WindowSize())
+	}
+}
+
+// latencyPipe returns the two ends of an in-memory connection that
+// delivers every write delay after it was made.
+func latencyPipe(delay time.Duration) (*latencyConn, *latencyConn) {
+	ab, ba := newLatencyQueue(delay), newLatencyQueue(delay)
+	return &latencyConn{in: ba, out: ab}, &latencyConn{in: ab, out: ba}
+}
+
+type latencyConn struct {
+	in, out *latencyQueue
+}
+
+func (c *latencyConn) Read(p []byte) (int, error)  { return c.in.read(p) }
+func (c *latencyConn) Write(p []byte) (int, error) { return c.out.write(p) }
+
+func (c *latencyConn) Close() error {
+	c.in.close()
+	c.out.close()
+	return nil
+}
+
+type latencyQueue struct {
+	*sync.Cond
+	delay  time.Duration
+	chunks []latencyChunk
+	closed bool
+}
+
+type latencyChunk struct {
+	data []byte
+	at   time.Time
+}
+
+func newLatencyQueue(delay time.Duration) *latencyQueue {
+	return &latencyQueue{Cond: sync.NewCond(new(sync.Mutex)), delay: delay}
+}
+
+func (q *latencyQueue) write(p []byte) (int, error) {
+	q.L.Lock()
+	defer q.L.Unlock()
+	if q.closed {
+		return 0, io.ErrClosedPipe
+	}
+	q.chunks = append(q.chunks, latencyChunk{append([]byte(nil), p...), time.Now().Add(q.delay)})
+	q.Signal()
+	return len(p), nil
+}
+
+func (q *latencyQueue) read(p []byte) (int, error) {
+	q.L.Lock()
+	defer q.L.Unlock()
+	for {
+		if q.closed {
+			return 0, io.EOF
+		}
+		if len(q.chunks) == 0 {
+			q.Wait()
+			continue
+		}
+		if wait := time.Until(q.chunks[0].at); wait > 0 {
+			q.L.Unlock()
+			time.Sleep(wait)
+			q.L.Lock()
+			continue
+		}
+		n := copy(p, q.chunks[0].data)
+		q.chunks[0].data = q.chunks[0].data[n:]
+		if len(q.chunks[0].data) == 0 {
+			q.chunks = q.chunks[1:]
+		}
+		return n, nil
+	}
+}
+
+func (q *latencyQueue) close() {
+	q.L.Lock()
+	q.closed = true
+	q.Broadcast()
+	q.L.Unlock()
+}
+
+func TestSchedulerPrefersHigherPriority(t *testing.T) {
+	s := newScheduler()
+	bulk := &Channel{remoteId: 1}
+	interactive := &Channel{remoteId: 2}
+	s.add(bulk, PriorityBulk)
+	s.add(interactive, PriorityInteractive)
+
+	const writers = 8
+	frame := make([]byte, channelMaxPacket)
+	errs := make(chan error, 2*writers)
+	for i := 0; i < writers; i++ {
+		go func() { errs <- s.write(bulk, frame) }()
+		go func() { errs <- s.write(interactive, frame) }()
+	}
+	waitQueued := func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(bulk.wq.frames) == writers && len(interactive.wq.frames) == writers
+	}
+	for !waitQueued() {
+		time.Sleep(time.Millisecond)
+	}
+
+	var out bytes.Buffer
+	go s.loop(codec.NewEncoder(&out))
+	for i := 0; i < 2*writers; i++ {
+		fatal(<-errs, t)
+	}
+	s.close(io.EOF)
+
+	dec := codec.NewDecoder(&out)
+	var order []uint32
+	for {
+		m, err := dec.Decode()
+		if err != nil {
+			break
+		}
+		order = append(order, m.(*codec.DataMessage).ChannelID)
+	}
+	if len(order) != 2*writers {
+		t.Fatalf("expected %d frames, got %d", 2*writers, len(order))
+	}
+	// the interactive channel earns a full frame of credit per turn, the
+	// bulk channel a sixteenth of one
+	for i := 0; i < writers; i++ {
+		if order[i] != 2 {
+			t.Fatalf("bulk frame sent before the interactive ones: %v", order)
+		}
+	}
+}
+
+func TestSchedulerDropFailsQueuedWrites(t *testing.T) {
+	s := newScheduler()
+	ch := &Channel{remoteId: 1}
+	s.add(ch, PriorityNormal)
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- s.write(ch, []byte("never sent")) }()
+	for {
+		s.mu.Lock()
+		n := len(ch.wq.frames)
+		s.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	s.drop(ch)
+	if err := <-errCh; err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+	if err := s.write(ch, []byte("late")); err != io.EOF {
+		t.Fatalf("expected io.EOF after drop, got %v", err)
+	}
+}
+
+func TestOpenPriority(t *testing.T) {
+	a, b := sessionPair(t, Config{}, Config{})
+
+	ch, err := a.OpenPriority(context.Background(), PriorityInteractive)
+	fatal(err, t)
+	peer, err := b.Accept()
+	fatal(err, t)
+	peer.(*Channel).SetPriority(PriorityBulk)
+
+	go func() {
+		peer.Write([]byte("pong"))
+		peer.CloseWrite()
+	}()
+	_, err = ch.Write([]byte("ping"))
+	fatal(err, t)
+	got, err := ioutil.ReadAll(ch)
+	fatal(err, t)
+	if string(got) != "pong" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+}
+
+func TestOpenMetadata(t *testing.T) {
+	a, b := sessionPair(t, Config{OpenMetadata: true}, Config{OpenMetadata: true})
+
+	extra := codec.MarshalExtra(map[string]string{"remote-addr": "1.2.3.4:5555", "host": "a.teleport.me"})
+	opened := make(chan error, 1)
+	go func() {
+		_, err := a.OpenWith(context.Background(), OpenOptions{Type: "forwarded-tcpip", Extra: extra})
+		opened <- err
+	}()
+	ch, err := b.Accept()
+	fatal(err, t)
+	fatal(<-opened, t)
+
+	remote := ch.(*Channel)
+	if remote.Type() != "forwarded-tcpip" {
+		t.Fatalf("unexpected type %q", remote.Type())
+	}
+	md, err := remote.Metadata()
+	fatal(err, t)
+	if md["remote-addr"] != "1.2.3.4:5555" || md["host"] != "a.teleport.me" {
+		t.Fatalf("unexpected metadata %v", md)
+	}
+}
+
+func TestOpenMetadataNeedsSupport(t *testing.T) {
+	a, _ := sessionPair(t, Config{}, Config{})
+	_, err := a.OpenWith(context.Background(), OpenOptions{Type: "forwarded-tcpip"})
+	if err != ErrOpenMetadataUnsupported {
+		t.Fatalf("expected ErrOpenMetadataUnsupported, got %v", err)
+	}
+}
+
+func TestOpenUnknownTypeIsRefused(t *testing.T) {
+	a, b := sessionPair(t,
+		Config{OpenMetadata: true},
+		Config{AcceptTypes: []string{"forwarded-tcpip"}})
+
+	_, err := a.OpenWith(context.Background(), OpenOptions{Type: "x11"})
+	if err == nil || !strings.Contains(err.Error(), codec.ReasonUnknownChannelType.String()) {
+		t.Fatalf("expected an unknown channel type failure, got %v", err)
+	}
+
+	// untyped opens come from peers that know no reasons
+	_, err = a.Open(context.Background())
+	if err == nil || !strings.Contains(err.Error(), codec.ReasonUnspecified.String()) {
+		t.Fatalf("expected an unspecified failure, got %v", err)
+	}
+
+	// the session survives refusals
+	go a.OpenWith(context.Background(), OpenOptions{Type: "forwarded-tcpip"})
+	_, err = b.Accept()
+	fatal(err, t)
+}
+
+func TestOpenErrors(t *testing.T) {
+	a, b := sessionPair(t, Config{OpenMetadata: true}, Config{
+		OpenMetadata: true,
+		Approve: func(ch *Channel) error {
+			switch ch.Type() {
+			case "down":
+				return &OpenError{Reason: codec.ReasonConnectFailed, Description: "dial tcp 127.0.0.1:3000: connection refused"}
+			case "busy":
+				return &OpenError{Reason: codec.ReasonResourceShortage}
+			case "forbidden":
+				return errors.New("not on my watch")
+			}
+			return nil
+		},
+	})
+
+	tests := []struct {
+		typ         string
+		want        error
+		description string
+	}{
+		{"down", ErrConnectFailed, "dial tcp 127.0.0.1:3000: connection refused"},
+		{"busy", ErrResourceShortage, ""},
+		{"forbidden", ErrAdministrativelyProhibited, "not on my watch"},
+	}
+	for _, test := range tests {
+		_, err := a.OpenWith(context.Background(), OpenOptions{Type: test.typ})
+		if !errors.Is(err, test.want) {
+			t.Fatalf("%s: expected %v, got %v", test.typ, test.want, err)
+		}
+		var openErr *OpenError
+		if !errors.As(err, &openErr) || openErr.Description != test.description {
+			t.Fatalf("%s: unexpected error %#v", test.typ, err)
+		}
+	}
+
+	go a.OpenWith(context.Background(), OpenOptions{Type: "up"})
+	ch, err := b.Accept()
+	fatal(err, t)
+	if ch.(*Channel).Type() != "up" {
+		t.Fatal("expected the approved channel")
+	}
+}
+
+func TestRequests(t *testing.T) {
+	a, b := sessionPair(t, Config{GlobalRequests: true}, Config{GlobalRequests: true})
+
+	notified := make(chan string, 1)
+	b.HandleRequests(func(req *Request) (bool, []byte) {
+		switch req.Type {
+		case "echo":
+			return true, req.Payload
+		case "notice":
+			notified <- string(req.Payload)
+			return true, nil
+		}
+		return false, nil
+	})
+
+	ok, reply, err := a.Request(context.Background(), "echo", true, []byte("hello"))
+	fatal(err, t)
+	if !ok || string(reply) != "hello" {
+		t.Fatalf("unexpected reply %t %q", ok, reply)
+	}
+
+	ok, _, err = a.Request(context.Background(), "unknown", true, nil)
+	fatal(err, t)
+	if ok {
+		t.Fatal("expected an unknown request to be refused")
+	}
+
+	_, _, err = a.Request(context.Background(), "notice", false, []byte("draining"))
+	fatal(err, t)
+	select {
+	case got := <-notified:
+		if got != "draining" {
+			t.Fatalf("unexpected notice %q", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("notice not delivered")
+	}
+
+	// a session without a handler refuses, it does not hang
+	ok, _, err = b.Request(context.Background(), "echo", true, nil)
+	fatal(err, t)
+	if ok {
+		t.Fatal("expected the request to be refused without a handler")
+	}
+}
+
+func TestRequestsNeedSupport(t *testing.T) {
+	a, _ := sessionPair(t, Config{}, Config{})
+	if _, _, err := a.Request(context.Background(), "echo", true, nil); err != ErrRequestsUnsupported {
+		t.Fatalf("expected ErrRequestsUnsupported, got %v", err)
+	}
+}
+
+func TestRequestFailsWhenSessionCloses(t *testing.T) {
+	a, b := sessionPair(t, Config{GlobalRequests: true}, Config{GlobalRequests: true})
+	block := make(chan struct{})
+	defer close(block)
+	b.HandleRequests(func(req *Request) (bool, []byte) {
+		<-block
+		return true, nil
+	})
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		a.Close()
+	}()
+	if _, _, err := a.Request(context.Background(), "slow", true, nil); err == nil {
+		t.Fatal("expected the request to fail once the session closed")
+	}
+}
+
+// A peer that opens channels nobody accepts must not stall the session:
+// opens beyond the backlog are refused and data keeps flowing.
+func TestUnacceptedOpensCannotDeadlock(t *testing.T) {
+	a, b := sessionPair(t, Config{OpenMetadata: true}, Config{OpenMetadata: true})
+
+	for i := 0; i < 3*chanSize; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, err := a.OpenWith(ctx, OpenOptions{Type: "unsolicited"})
+		cancel()
+		if i < chanSize {
+			fatal(err, t)
+			continue
+		}
+		if !errors.Is(err, ErrResourceShortage) {
+			t.Fatalf("open %d: expected ErrResourceShortage, got %v", i, err)
+		}
+	}
+
+	// the other direction still works
+	go func() {
+		ch, err := b.Open(context.Background())
+		if err != nil {
+			return
+		}
+		ch.Write([]byte("still alive"))
+	}()
+	ch, err := a.AcceptContext(context.Background())
+	fatal(err, t)
+	buf := make([]byte, 11)
+	_, err = io.ReadFull(ch, buf)
+	fatal(err, t)
+	if string(buf) != "still alive" {
+		t.Fatalf("unexpected data %q", buf)
+	}
+
+	// accepting frees room in the backlog
+	_, err = b.Accept()
+	fatal(err, t)
+	_, err = a.OpenWith(context.Background(), OpenOptions{Type: "unsolicited"})
+	fatal(err, t)
+}
+
+func TestAcceptBacklogCountsApprovals(t *testing.T) {
+	release := make(chan struct{})
+	a, _ := sessionPair(t, Config{OpenMetadata: true}, Config{
+		OpenMetadata:  true,
+		AcceptBacklog: 2,
+		Approve: func(ch *Channel) error {
+			<-release
+			return nil
+		},
+	})
+	defer close(release)
+
+	for i := 0; i < 2; i++ {
+		go a.OpenWith(context.Background(), OpenOptions{Type: "slow"})
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		_, err := a.OpenWith(ctx, OpenOptions{Type: "slow"})
+		cancel()
+		if errors.Is(err, ErrResourceShortage) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the backlog to fill up, got %v", err)
+		}
+	}
+}
+
+func TestAcceptContext(t *testing.T) {
+	a, _ := sessionPair(t, Config{}, Config{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := a.AcceptContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected DeadlineExceeded, got %v", err)
+	}
+
+	// every blocked Accept is released by Close
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := a.Accept()
+			errs <- err
+		}()
+	}
+	a.Close()
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			if err != io.EOF {
+				t.Fatalf("expected io.EOF, got %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Accept not released by Close")
+		}
+	}
+}
+
+func TestChannelIsNetConn(t *testing.T) {
+	nettest.TestConn(t, func() (net.Conn, net.Conn, func(), error) {
+		a, b := sessionPair(t, Config{}, Config{})
+		c1, c2 := openPair(t, a, b)
+		stop := func() {
+			a.Close()
+			b.Close()
+		}
+		return c1.(*Channel), c2.(*Channel), stop, nil
+	})
+}
+
+func TestChannelAddrs(t *testing.T) {
+	a, b := sessionPair(t, Config{OpenMetadata: true}, Config{OpenMetadata: true})
+	extra := codec.MarshalExtra(map[string]string{"remote-addr": "203.0.113.7:51234", "tunnel": "demo.teleport.me"})
+	go a.OpenWith(context.Background(), OpenOptions{Type: "forwarded-tcpip", Extra: extra})
+	ch, err := b.Accept()
+	fatal(err, t)
+	conn := ch.(net.Conn)
+
+	if got := conn.RemoteAddr().String(); got != "203.0.113.7:51234" {
+		t.Fatalf("unexpected remote address %q", got)
+	}
+	if got := conn.LocalAddr().String(); got != "demo.teleport.me" {
+		t.Fatalf("unexpected local address %q", got)
+	}
+	if conn.LocalAddr().Network() != "qmux" {
+		t.Fatalf("unexpected network %q", conn.LocalAddr().Network())
+	}
+
+	c1, _ := openPair(t, a, b)
+	if got := c1.(*Channel).LocalAddr().String(); got != fmt.Sprintf("channel/%d", c1.ID()) {
+		t.Fatalf("unexpected address %q for an untyped channel", got)
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	fatal(err, t)
+	defer l.Close()
+
+	// a peer that reads everything and never sends anything
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(ioutil.Discard, conn)
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	fatal(err, t)
+	defer conn.Close()
+
+	sess := NewWithConfig(conn, Config{ReadTimeout: 50 * time.Millisecond})
+	if err := waitErr(t, sess, 2*time.Second); err != ErrReadTimeout {
+		t.Fatalf("expected ErrReadTimeout, got %v", err)
+	}
+}
+
+func TestWritesDoNotCountAsSeen(t *testing.T) {
+	var k keepalive
+	k.received(true)
+	seen := atomic.LoadInt64(&k.lastSeen)
+	time.Sleep(time.Millisecond)
+	k.sent()
+	if atomic.LoadInt64(&k.lastSeen) != seen {
+		t.Fatal("sending made the peer look alive")
+	}
+	if atomic.LoadInt64(&k.lastActive) <= seen {
+		t.Fatal("sending did not count as channel traffic")
+	}
+}
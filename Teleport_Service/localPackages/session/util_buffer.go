@@ -2,7 +2,9 @@ package session
 
 import (
 	"io"
+	"os"
 	"sync"
+	"time"
 )
 
 // buffer provides a linked list buffer for data exchange
@@ -14,14 +16,23 @@ type buffer struct {
 
 	head *element // the buffer that will be read first
 	tail *element // the buffer that will be read last
+	free *element // consumed elements, reused by write
 
-	closed bool
+	closed   bool
+	deadline deadline // for Read
 }
 
 // An element represents a single link in a linked list.
 type element struct {
-	buf  []byte
-	next *element
+	buf   []byte
+	owner releaser // released once buf has been read, may be nil
+	next  *element
+}
+
+// releaser is implemented by pooled messages, such as codec.DataMessage,
+// whose memory backs an element.
+type releaser interface {
+	Release()
 }
 
 // newBuffer returns an empty buffer that is not closed.
@@ -36,10 +47,18 @@ func newBuffer() *buffer {
 }
 
 // write makes buf available for Read to receive.
-// buf must not be modified after the call to write.
-func (b *buffer) write(buf []byte) {
+// buf must not be modified after the call to write. If owner is not nil,
+// it is released once buf has been read in full.
+func (b *buffer) write(buf []byte, owner releaser) {
 	b.Cond.L.Lock()
-	e := &element{buf: buf}
+	e := b.free
+	if e != nil {
+		b.free = e.next
+		e.next = nil
+	} else {
+		e = new(element)
+	}
+	e.buf, e.owner = buf, owner
 	b.tail.next = e
 	b.tail = e
 	b.Cond.Signal()
@@ -55,12 +74,25 @@ func (b *buffer) eof() {
 	b.Cond.L.Unlock()
 }
 
+// setDeadline sets the time after which Read fails with
+// os.ErrDeadlineExceeded, waking up a blocked Read.
+func (b *buffer) setDeadline(t time.Time) {
+	b.Cond.L.Lock()
+	b.deadline.set(t, b.Cond)
+	b.Cond.L.Unlock()
+}
+
 // Read reads data from the internal buffer in buf.  Reads will block
-// if no data is available, or until the buffer is closed.
+// if no data is available, or until the buffer is closed or its deadline
+// has passed.
 func (b *buffer) Read(buf []byte) (n int, err error) {
 	b.Cond.L.Lock()
 	defer b.Cond.L.Unlock()
 
+	if b.deadline.exceeded() {
+		return 0, os.ErrDeadlineExceeded
+	}
+
 	for len(buf) > 0 {
 		// if there is data in b.head, copy it
 		if len(b.head.buf) > 0 {
@@ -71,7 +103,7 @@ func (b *buffer) Read(buf []byte) (n int, err error) {
 		}
 		// if there is a next buffer, make it the head
 		if len(b.head.buf) == 0 && b.head != b.tail {
-			b.head = b.head.next
+			b.recycle()
 			continue
 		}
 
@@ -86,8 +118,25 @@ func (b *buffer) Read(buf []byte) (n int, err error) {
 			err = io.EOF
 			break
 		}
+		if b.deadline.exceeded() {
+			err = os.ErrDeadlineExceeded
+			break
+		}
 		// out of buffers, wait for producer
 		b.Cond.Wait()
 	}
 	return
 }
+
+// recycle advances head, releasing the consumed element's owner and
+// keeping the element for reuse by write.
+func (b *buffer) recycle() {
+	e := b.head
+	b.head = e.next
+	if e.owner != nil {
+		e.owner.Release()
+	}
+	e.buf, e.owner = nil, nil
+	e.next = b.free
+	b.free = e
+}
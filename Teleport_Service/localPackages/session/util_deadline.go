@@ -0,0 +1,37 @@
+package session
+
+import (
+	"sync"
+	"time"
+)
+
+// deadline wakes the waiters of a sync.Cond when it expires, so that
+// blocking calls can give up with os.ErrDeadlineExceeded. It is protected
+// by the lock of the Cond it belongs to.
+type deadline struct {
+	t     time.Time
+	timer *time.Timer
+}
+
+// set replaces the deadline, the zero time meaning none. cond.L must be
+// held. Waiters are woken up so they check the new deadline.
+func (d *deadline) set(t time.Time, cond *sync.Cond) {
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	d.t = t
+	if dur := time.Until(t); !t.IsZero() && dur > 0 {
+		d.timer = time.AfterFunc(dur, func() {
+			cond.L.Lock()
+			cond.Broadcast()
+			cond.L.Unlock()
+		})
+	}
+	cond.Broadcast()
+}
+
+// exceeded reports whether the deadline has passed.
+func (d *deadline) exceeded() bool {
+	return !d.t.IsZero() && !time.Now().Before(d.t)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"teleportServer/localPackages/go-vhost"
+)
+
+///   *************************************** header rewriting  ***************************************
+
+// A client declares the header rules of its tunnel as JSON in rulesHeader
+// during the handshake, and the server answers with featureHeaderRewrite
+// once it applies them to the HTTP/1 requests and responses of the tunnel.
+// For example, to reach a dev server that only answers to its own name:
+//
+//	{"host": "localhost:3000", "rewriteLocation": true, "rewriteCookieDomain": true,
+//	 "response": {"set": {"Access-Control-Allow-Origin": "*"}}}
+const rulesHeader = "X-Tunnel-Rewrite"
+
+// maxRulesSize bounds the rules a client may declare.
+const maxRulesSize = 8 << 10
+
+// parseHeaderRules returns the rules in the value of rulesHeader, nil if
+// there are none.
+func parseHeaderRules(value string) (*vhost.HeaderRules, error) {
+	if value == "" {
+		return nil, nil
+	}
+	if len(value) > maxRulesSize {
+		return nil, errors.New("header rules too long")
+	}
+	dec := json.NewDecoder(bytes.NewReader([]byte(value)))
+	dec.DisallowUnknownFields()
+	var rules vhost.HeaderRules
+	if err := dec.Decode(&rules); err != nil {
+		return nil, err
+	}
+	if err := rules.Validate(); err != nil {
+		return nil, err
+	}
+	return &rules, nil
+}
+
+// rewriteChannel reads the responses of ch with the rules applied.
+type rewriteChannel struct {
+	io.ReadWriteCloser
+	responses io.Reader
+}
+
+func (c *rewriteChannel) Read(p []byte) (int, error) {
+	return c.responses.Read(p)
+}
+
+// applyHeaderRules rewrites the request on conn, and returns ch with its
+// responses rewritten to point at the host the client asked for, under
+// prefix with path-style names. Connections that are not HTTP/1 are left
+// alone.
+func applyHeaderRules(conn net.Conn, ch io.ReadWriteCloser, rules *vhost.HeaderRules, prefix string) io.ReadWriteCloser {
+	hc := httpConn(conn)
+	if hc == nil || !hc.RewriteRequest(rules) {
+		return ch
+	}
+	return &rewriteChannel{ReadWriteCloser: ch, responses: vhost.RewriteResponses(ch, rules, hc.Host()+prefix)}
+}
@@ -11,17 +11,28 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
-	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"html/template"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"teleportServer/audit"
 	"teleportServer/auth"
-	"teleportServer/local/go-vhost"
-	"teleportServer/local/session"
+	"teleportServer/health"
+	"teleportServer/localPackages/codec"
+	"teleportServer/localPackages/go-vhost"
+	"teleportServer/localPackages/session"
+	"teleportServer/usage"
 	"teleportServer/utilities"
 	"time"
 
@@ -30,25 +41,17 @@ import (
 
 ///   *************************************** conigrations ***************************************
 
-type Config struct {
-	Port          string `json:"port"`
-	Host          string `json:"host"`
-	Addr          string `json:"addr"`
-	ApiUrlAuth    string `json:"apiUrlAuth"`
-	ApiUrlDetails string `json:"apiUrlDetails"`
-	Token         string `json:"token"`
-	Free          int    `json:"free"`
-	Moderate      int    `json:"moderate"`
-	High          int    `json:"high"`
-}
-
 var config Config
 
+// configLoaded and draining back the readiness probe.
+var configLoaded, draining int32
+
 var connectionLimits = map[string]int{}
 
 type ClientConnection struct {
-	limiter *rate.Limiter
-	active  int
+	limiter  *rate.Limiter
+	active   int
+	upgraded int // open upgraded connections and event streams
 }
 
 var activeConnections = struct {
@@ -56,24 +59,212 @@ var activeConnections = struct {
 	connections map[string]*ClientConnection
 }{connections: make(map[string]*ClientConnection)}
 
+// detailsBackoff is how calls to the details API are retried.
+var detailsBackoff = auth.DefaultBackoff
+
+// usageReporter batches usage events to the details API in the background.
+var usageReporter *usage.Reporter
+
+// auditLog records tunnel lifecycle events, nil when auditing is disabled.
+var auditLog *audit.Logger
+
+// The client lists the protocol features it supports in featuresHeader
+// during the handshake, and the server answers with those it enabled.
+const (
+	featuresHeader        = "X-Tunnel-Features"
+	featureOpenMetadata   = "open-metadata"
+	featureGlobalRequests = "global-requests"
+	featureProxyProtocol  = "proxy-protocol"
+	featureHeaderRewrite  = "header-rewrite"
+	featureKeepalive      = "keepalive"
+)
+
+// readTimeoutFallback stands in for keepalive with clients that cannot
+// answer pings when idleTimeoutMinutes is 0: it is the fixed deadline
+// their connection used to have, but counted from the last packet.
+const readTimeoutFallback = 60 * time.Minute
+
+// requestDraining tells clients the server is shutting down, the payload is
+// the number of seconds left before their tunnels are cut.
+const requestDraining = "tunnel-draining"
+
+// tunnelSessions holds the live tunnel sessions, to notify them on drain,
+// and counts the goroutines serving tunnels, to wait for them on exit.
+var tunnelSessions = struct {
+	sync.Mutex
+	sessions map[*session.Session]struct{}
+	handlers sync.WaitGroup
+	stopped  bool
+}{sessions: make(map[*session.Session]struct{})}
+
+// errorPages renders what public clients get when their request cannot
+// reach a tunnel.
+var errorPages = &vhost.ErrorPages{
+	Brand: "TelePort",
+	Pages: map[string]vhost.ErrorPage{
+		vhost.PageUnavailable.Code: {
+			Title:   "Tunnel backed up",
+			Message: "The tunnel is not keeping up with the requests it gets, try again shortly.",
+		},
+	},
+}
+
+// The pages of the public requests a tunnel cannot take, next to those of
+// the vhost muxer.
+var (
+	pageTunnelOffline = vhost.ErrorPage{
+		Status:  http.StatusBadGateway,
+		Code:    "tunnel_offline",
+		Title:   "Tunnel offline",
+		Message: "The tunnel for this address is not connected right now.",
+	}
+	pageLocalUnreachable = vhost.ErrorPage{
+		Status:  http.StatusBadGateway,
+		Code:    "local_unreachable",
+		Title:   "Local service unreachable",
+		Message: "The tunnel is up but could not reach the service it exposes.",
+	}
+	pageTunnelBusy = vhost.ErrorPage{
+		Status:  http.StatusServiceUnavailable,
+		Code:    "tunnel_busy",
+		Title:   "Tunnel busy",
+		Message: "The tunnel is not taking new connections right now, try again shortly.",
+	}
+	pageOverQuota = vhost.ErrorPage{
+		Status:  http.StatusServiceUnavailable,
+		Code:    "over_quota",
+		Title:   "Tunnel over quota",
+		Message: "This tunnel has all the connections its plan allows open, try again once some are closed.",
+	}
+	pageUpgradeQuota = vhost.ErrorPage{
+		Status:  http.StatusServiceUnavailable,
+		Code:    "upgrade_quota",
+		Title:   "Tunnel over quota",
+		Message: "This tunnel has all the WebSockets and event streams its plan allows open, try again once some are closed.",
+	}
+	pageRateLimited = vhost.ErrorPage{
+		Status:  http.StatusTooManyRequests,
+		Code:    "rate_limited",
+		Title:   "Rate limited",
+		Message: "This tunnel is receiving more requests than its plan allows, slow down.",
+	}
+)
+
+// rateLimitWait is how long a public connection may be held back by the
+// rate limit of its tunnel before it is answered with pageRateLimited.
+const rateLimitWait = 5 * time.Second
+
+// tunnelChannelType is the channel type of forwarded public connections.
+const tunnelChannelType = "forwarded-tcpip"
+
+// sendUsage delivers usage events through the increment endpoint of the
+// details API, which counts the connections of each tunnel. Only accepted
+// connections are recorded: the API has nothing for the other kinds, the
+// tunnels being reported by the add endpoint during the handshake and the
+// bytes going to the metrics.
+func sendUsage(ctx context.Context, events []auth.UsageEvent) (int, error) {
+	for i, e := range events {
+		if err := auth.SendIncrementRequest(ctx, e.UserName, e.Url, config.ApiUrlDetails, config.Token); err != nil {
+			return i, err
+		}
+	}
+	return len(events), nil
+}
+
+///   *************************************** errors  ***************************************
+
+// TunnelError reports the failure of a single tunnel. It is handled by
+// tearing that tunnel down and must never take the whole process with it.
+type TunnelError struct {
+	Host  string
+	Stage string
+	Err   error
+}
+
+func (e *TunnelError) Error() string {
+	return fmt.Sprintf("tunnel %s: %s: %v", e.Host, e.Stage, e.Err)
+}
+
+func (e *TunnelError) Unwrap() error {
+	return e.Err
+}
+
+// StatusCode maps the error to the status returned to the client: backend
+// failures are a bad gateway, everything else is our own fault.
+func (e *TunnelError) StatusCode() int {
+	var status *auth.StatusError
+	var unreachable *auth.UnreachableError
+	if errors.As(e.Err, &status) || errors.As(e.Err, &unreachable) {
+		return http.StatusBadGateway
+	}
+	return http.StatusInternalServerError
+}
+
+// openPage is the page a public client gets when its connection could not
+// be forwarded: busy when the developer's client turned it away for now,
+// unreachable when their local service is down, offline when the tunnel
+// itself is gone.
+func openPage(err error) vhost.ErrorPage {
+	switch {
+	case errors.Is(err, session.ErrResourceShortage) || errors.Is(err, session.ErrAdministrativelyProhibited):
+		return pageTunnelBusy
+	case errors.As(err, new(*session.OpenError)):
+		return pageLocalUnreachable
+	}
+	return pageTunnelOffline
+}
+
+// writeErrorPage answers a public connection that cannot be forwarded.
+func writeErrorPage(conn net.Conn, page vhost.ErrorPage) {
+	var req *http.Request
+	if hc, ok := conn.(*vhost.HTTPConn); ok {
+		req = hc.Request
+	}
+	errorPages.Write(conn, req, page)
+}
+
 ///   *************************************** main  ***************************************
 
 func main() {
+	configPath := flag.String("config", "config.json", "path to a JSON, YAML or TOML config file, empty to use only the environment")
+	printConfig := flag.Bool("print-config", false, "print the effective config with secrets redacted and exit")
+	flag.Parse()
 
-	file, err := os.Open("config.json")
+	var err error
+	config, err = LoadConfig(*configPath, os.Environ())
 	if err != nil {
-		log.Fatalf("--------- error opening config file: %v", err)
+		log.Fatalf("--------- invalid configuration:\n%v", err)
 	}
-	defer file.Close()
-
-	err = json.NewDecoder(file).Decode(&config)
-	if err != nil {
-		log.Fatalf("--------- error decoding config file: %v", err)
+	if *printConfig {
+		fmt.Println(config.Redacted())
+		return
+	}
+	log.Printf("effective config:\n%s", config.Redacted())
+	if config.ErrorPageTemplate != "" {
+		errorPages.HTML, err = template.ParseFiles(config.ErrorPageTemplate)
+		if err != nil {
+			log.Fatalf("--------- error loading the error page template: %v", err)
+		}
 	}
+	atomic.StoreInt32(&configLoaded, 1)
 
 	connectionLimits["free"] = config.Free
 	connectionLimits["moderate"] = config.Moderate
 	connectionLimits["high"] = config.High
+	upgradeLimits["free"] = config.FreeUpgrades
+	upgradeLimits["moderate"] = config.ModerateUpgrades
+	upgradeLimits["high"] = config.HighUpgrades
+
+	usageReporter = usage.NewReporter(sendUsage, usage.Options{SpoolPath: config.UsageSpool})
+	defer usageReporter.Close()
+
+	if config.AuditLog != "" {
+		auditLog, err = openAuditLog()
+		if err != nil {
+			log.Fatalf("--------- error opening audit log: %v", err)
+		}
+		defer auditLog.Close()
+	}
 
 	port := config.Port
 	host := config.Host
@@ -82,21 +273,169 @@ func main() {
 	l, err := net.Listen("tcp", net.JoinHostPort(addr, port))
 	utilities.Fatal(err)
 	defer l.Close()
+	l = publicListener(l)
 
 	vmux, err := vhost.NewHTTPMuxer(l, 3*time.Second)
 	utilities.Fatal(err)
+	vmux.Pages = errorPages
 
 	go ConnectionManager(vmux, host, port)
 
+	if config.ManagementAddr != "" {
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("/", newChecker(vmux).Handler())
+			mux.Handle("/metrics", tunnelMetrics)
+			err := http.ListenAndServe(config.ManagementAddr, mux)
+			log.Println("--------- management server stopped:", err)
+		}()
+	}
+	go drainOnSignal()
+
 	log.Printf("TelePort server [%s] ready!\n", host)
 	for {
 		conn, err := vmux.NextError()
 		if err != nil {
 			log.Println(err)
 		}
-		if conn != nil {
-			conn.Close()
+		vmux.HandleError(conn, err)
+	}
+}
+
+// publicListener reads the PROXY protocol headers of the load balancers
+// in proxyProtocolFrom, so that clients are seen with their own addresses.
+func publicListener(l net.Listener) net.Listener {
+	if config.ProxyProtocolFrom == "" {
+		return l
+	}
+	trusted, _ := parseCIDRs(config.ProxyProtocolFrom)
+	return &vhost.ProxyListener{Listener: l, Trusted: trusted}
+}
+
+func openAuditLog() (*audit.Logger, error) {
+	var sinks []audit.Sink
+	if config.AuditSyslog {
+		sink, err := audit.NewSyslogSink("teleport")
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	if config.AuditWebhook != "" {
+		sinks = append(sinks, audit.NewWebhookSink(config.AuditWebhook))
+	}
+	return audit.Open(audit.Options{Path: config.AuditLog, MaxSize: config.AuditMaxSize, Sinks: sinks})
+}
+
+// sessionConfig replaces a fixed deadline on the client connection: dead
+// clients are noticed within a few keepalives and live ones stay connected
+// for as long as they carry traffic. Clients that did not announce
+// featureKeepalive cannot decode pings, so they are dropped once nothing
+// came from them for the idle timeout instead, and their windows are not
+// auto-tuned, which takes pings too.
+func sessionConfig(keepalive bool) session.Config {
+	cfg := session.Config{
+		KeepaliveMaxMissed: config.KeepaliveMaxMissed,
+		IdleTimeout:        time.Duration(config.IdleTimeoutMinutes) * time.Minute,
+		WindowSize:         uint32(config.WindowSize),
+		MaxWindowSize:      uint32(config.MaxWindowSize),
+		// the server only opens channels, it never accepts any
+		Approve: func(*session.Channel) error {
+			return &session.OpenError{Reason: codec.ReasonAdministrativelyProhibited, Description: "the server does not accept channels"}
+		},
+	}
+	if keepalive {
+		cfg.KeepaliveInterval = time.Duration(config.KeepaliveSeconds) * time.Second
+	} else {
+		cfg.MaxWindowSize = cfg.WindowSize
+		cfg.ReadTimeout = cfg.IdleTimeout
+		if cfg.ReadTimeout == 0 {
+			cfg.ReadTimeout = readTimeoutFallback
+		}
+	}
+	return cfg
+}
+
+///   *************************************** health  ***************************************
+
+// newChecker wires the probes served on the management port.
+func newChecker(vmux *vhost.HTTPMuxer) *health.Checker {
+	checker := health.New(2 * time.Second)
+	checker.Live("vhost", func(ctx context.Context) error {
+		if !vmux.Accepting() {
+			return errors.New("vhost muxer is not accepting connections")
+		}
+		return nil
+	})
+	checker.Ready("config", func(ctx context.Context) error {
+		if atomic.LoadInt32(&configLoaded) == 0 {
+			return errors.New("config not loaded")
 		}
+		return nil
+	})
+	checker.Ready("auth", func(ctx context.Context) error {
+		return auth.Ping(ctx, config.ApiUrlAuth)
+	})
+	checker.Ready("draining", func(ctx context.Context) error {
+		if atomic.LoadInt32(&draining) == 1 {
+			return errors.New("server is draining")
+		}
+		return nil
+	})
+	return checker
+}
+
+// drainOnSignal fails readiness and refuses new tunnels on SIGTERM, giving
+// load balancers DrainSeconds to notice before the process exits.
+func drainOnSignal() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+	<-sig
+
+	atomic.StoreInt32(&draining, 1)
+	log.Printf("draining for %ds before exit", config.DrainSeconds)
+	notifyDraining()
+	time.Sleep(time.Duration(config.DrainSeconds) * time.Second)
+
+	stopTunnels()
+	usageReporter.Close()
+	auditLog.Close()
+	os.Exit(0)
+}
+
+// startTunnel counts a new tunnel handler, and reports false once the
+// tunnels are stopped.
+func startTunnel() bool {
+	tunnelSessions.Lock()
+	defer tunnelSessions.Unlock()
+	if tunnelSessions.stopped {
+		return false
+	}
+	tunnelSessions.handlers.Add(1)
+	return true
+}
+
+// stopTunnels refuses new tunnels, closes the live ones and waits for
+// their handlers to return, so that nothing records usage or audit events
+// once it returns.
+func stopTunnels() {
+	tunnelSessions.Lock()
+	tunnelSessions.stopped = true
+	for sess := range tunnelSessions.sessions {
+		sess.Close()
+	}
+	tunnelSessions.Unlock()
+	tunnelSessions.handlers.Wait()
+}
+
+// notifyDraining sends requestDraining to every client that supports
+// session requests.
+func notifyDraining() {
+	payload := []byte(strconv.Itoa(config.DrainSeconds))
+	tunnelSessions.Lock()
+	defer tunnelSessions.Unlock()
+	for sess := range tunnelSessions.sessions {
+		go sess.Request(context.Background(), requestDraining, false, payload)
 	}
 }
 
@@ -107,6 +446,12 @@ func ConnectionManager(vmux *vhost.HTTPMuxer, host, port string) {
 	utilities.Fatal(err)
 
 	srv := &http.Server{Handler: http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+		if atomic.LoadInt32(&draining) == 1 || !startTunnel() {
+			http.Error(responseWriter, "--------- server is draining", http.StatusServiceUnavailable)
+			return
+		}
+		defer tunnelSessions.handlers.Done()
+
 		username := request.Header.Get("X-Username")
 		password := request.Header.Get("X-Password")
 
@@ -123,10 +468,37 @@ func ConnectionManager(vmux *vhost.HTTPMuxer, host, port string) {
 
 		subscription, err := auth.SignInAndGetSubscriptionType(apiUrl, signInData)
 		if err != nil {
+			auditLog.Log(audit.AuthFailure, username, request.RemoteAddr, "", err.Error())
 			http.Error(responseWriter, "--------- Authentication failed", http.StatusUnauthorized)
 			return
 		}
 
+		auditLog.Log(audit.AuthSuccess, username, request.RemoteAddr, "", subscription)
+
+		curve := elliptic.P256()
+		clientPubKeyHex := request.Header.Get("X-Client-Public-Key")
+		if clientPubKeyHex == "" {
+			http.Error(responseWriter, "stupid client public key required", http.StatusBadRequest)
+			return
+		}
+		clientPubKey, err := hex.DecodeString(clientPubKeyHex)
+		if err != nil {
+			http.Error(responseWriter, "invalid  stupid client public key", http.StatusBadRequest)
+			return
+		}
+
+		clientX, clientY := elliptic.Unmarshal(curve, clientPubKey)
+		if clientX == nil || clientY == nil {
+			http.Error(responseWriter, "invalid stupid client public key", http.StatusBadRequest)
+			return
+		}
+
+		rules, err := parseHeaderRules(request.Header.Get(rulesHeader))
+		if err != nil {
+			http.Error(responseWriter, "invalid header rules: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
 		activeConnections.Lock()
 		if _, exists := activeConnections.connections[request.RemoteAddr]; !exists {
 			activeConnections.connections[request.RemoteAddr] = &ClientConnection{
@@ -136,15 +508,39 @@ func ConnectionManager(vmux *vhost.HTTPMuxer, host, port string) {
 		}
 		clientConn := activeConnections.connections[request.RemoteAddr]
 		activeConnections.Unlock()
+		defer func() {
+			activeConnections.Lock()
+			delete(activeConnections.connections, request.RemoteAddr)
+			activeConnections.Unlock()
+		}()
+
+		publicHost := newPublicHost(username, host, port)
+
+		// fail tears down this tunnel only, answering the client while the
+		// handshake is still plain HTTP.
+		fail := func(stage string, err error) {
+			tunnelErr := &TunnelError{Host: publicHost, Stage: stage, Err: err}
+			log.Println("---------", tunnelErr)
+			auditLog.Log(audit.ForceClose, username, request.RemoteAddr, publicHost, tunnelErr.Error())
+			http.Error(responseWriter, "--------- server error", tunnelErr.StatusCode())
+		}
 
-		publicHost := strings.TrimSuffix(net.JoinHostPort(utilities.NewSubdomain(username)+host, port), ":80")
-		pl, err := vmux.Listen(publicHost)
+		// with path-style names the local service sees the paths under
+		// the tunnel's prefix, which it gets in X-Forwarded-Prefix; public
+		// requests wait in the accept queue while the tunnel is at its
+		// rate limit, and get a 503 once it has been full for too long
+		pl, err := vmux.ListenWith(publicHost, vhost.ListenOptions{
+			StripPrefix:     config.StripPrefix,
+			ForwardedPrefix: config.ForwardedPrefix,
+			QueueSize:       config.AcceptQueueSize,
+			EnqueueTimeout:  time.Duration(config.AcceptTimeoutSeconds) * time.Second,
+		})
 		if err != nil {
-			http.Error(responseWriter, "--------- server error", http.StatusInternalServerError)
-			log.Println("--------- error creating listener:", err)
+			fail("listen", err)
 			return
 		}
 		defer pl.Close()
+		auditLog.Log(audit.SubdomainAssigned, username, request.RemoteAddr, publicHost, "")
 
 		apiUrladd := config.ApiUrlDetails
 		token := config.Token
@@ -152,138 +548,279 @@ func ConnectionManager(vmux *vhost.HTTPMuxer, host, port string) {
 		url := fmt.Sprintf("%v", publicHost)
 		timetemp := utilities.GetCurrentTime()
 
-		err = auth.AddUserUrlDetails(apiUrladd, token, userName, url, timetemp)
+		err = auth.AddUserUrlDetailsWithRetry(request.Context(), detailsBackoff, apiUrladd, token, userName, url, timetemp)
 		if err != nil {
-			log.Fatalf("--------- error adding user URL details: %v", err)
+			fail("add user url details", err)
+			return
 		}
 
-		curve := elliptic.P256()
 		privKey, x, y, err := elliptic.GenerateKey(curve, rand.Reader)
 		if err != nil {
-			log.Fatal("--------- failed to generate DH key: I hate gooooooooooooo ", err)
+			fail("generate DH key", err)
+			return
 		}
 		pubKey := elliptic.Marshal(curve, x, y)
 
-		responseWriter.Header().Set("X-Server-Public-Key", fmt.Sprintf("%x", pubKey))
-		responseWriter.Header().Set("X-Public-Host", publicHost)
-		responseWriter.Header().Set("Connection", "close")
-		responseWriter.WriteHeader(http.StatusOK)
+		sharedX, _ := curve.ScalarMult(clientX, clientY, privKey)
+		sharedSecret := sharedX.Bytes()
 
-		clientPubKeyHex := request.Header.Get("X-Client-Public-Key")
-		if clientPubKeyHex == "" {
-			http.Error(responseWriter, "stupid client public key required", http.StatusBadRequest)
+		aesKey := sha256.Sum256(sharedSecret)
+		block, err := aes.NewCipher(aesKey[:])
+		if err != nil {
+			fail("create cipher", err)
 			return
 		}
-		clientPubKey, err := hex.DecodeString(clientPubKeyHex)
+		aesGCM, err := cipher.NewGCM(block)
 		if err != nil {
-			http.Error(responseWriter, "invalid  stupid client public key", http.StatusBadRequest)
+			fail("create GCM", err)
 			return
 		}
 
-		clientX, clientY := elliptic.Unmarshal(curve, clientPubKey)
-		if clientX == nil || clientY == nil {
-			http.Error(responseWriter, "invalid stupid client public key", http.StatusBadRequest)
+		hijacker, ok := responseWriter.(http.Hijacker)
+		if !ok {
+			fail("hijack", errors.New("response writer does not support hijacking"))
 			return
 		}
 
-		sharedX, _ := curve.ScalarMult(clientX, clientY, privKey)
-		sharedSecret := sharedX.Bytes()
-
-		aesKey := sha256.Sum256(sharedSecret)
-		block, err := aes.NewCipher(aesKey[:])
-		if err != nil {
-			log.Fatal(err)
+		responseWriter.Header().Set("X-Server-Public-Key", fmt.Sprintf("%x", pubKey))
+		responseWriter.Header().Set("X-Public-Host", publicHost)
+		var enabled []string
+		openMetadata := hasFeature(request.Header.Get(featuresHeader), featureOpenMetadata)
+		if openMetadata {
+			enabled = append(enabled, featureOpenMetadata)
 		}
-		aesGCM, err := cipher.NewGCM(block)
-		if err != nil {
-			log.Fatal(err)
+		globalRequests := hasFeature(request.Header.Get(featuresHeader), featureGlobalRequests)
+		if globalRequests {
+			enabled = append(enabled, featureGlobalRequests)
+		}
+		proxyHeader := hasFeature(request.Header.Get(featuresHeader), featureProxyProtocol)
+		if proxyHeader {
+			enabled = append(enabled, featureProxyProtocol)
+		}
+		if rules != nil {
+			enabled = append(enabled, featureHeaderRewrite)
+		}
+		keepalive := hasFeature(request.Header.Get(featuresHeader), featureKeepalive)
+		if keepalive {
+			enabled = append(enabled, featureKeepalive)
+		}
+		if len(enabled) > 0 {
+			responseWriter.Header().Set(featuresHeader, strings.Join(enabled, ", "))
 		}
+		responseWriter.Header().Set("Connection", "close")
+		responseWriter.WriteHeader(http.StatusOK)
 
-		conn, _, err := responseWriter.(http.Hijacker).Hijack()
+		conn, _, err := hijacker.Hijack()
 		if err != nil {
-			log.Fatal("failed to hijack connection I hate gooo :", err)
+			// the status line is already out, nothing left to tell the client
+			tunnelErr := &TunnelError{Host: publicHost, Stage: "hijack", Err: err}
+			log.Println("---------", tunnelErr)
+			auditLog.Log(audit.ForceClose, username, request.RemoteAddr, publicHost, tunnelErr.Error())
+			return
 		}
-		sess := session.New(conn)
+		sessCfg := sessionConfig(keepalive)
+		sessCfg.OpenMetadata = openMetadata
+		sessCfg.GlobalRequests = globalRequests
+		sess := session.NewWithConfig(conn, sessCfg)
 		defer sess.Close()
+		tunnelSessions.Lock()
+		tunnelSessions.sessions[sess] = struct{}{}
+		if tunnelSessions.stopped {
+			sess.Close()
+		}
+		tunnelSessions.Unlock()
+		defer func() {
+			tunnelSessions.Lock()
+			delete(tunnelSessions.sessions, sess)
+			tunnelSessions.Unlock()
+		}()
 		log.Printf("%s: start session", publicHost)
+		auditLog.Log(audit.SessionStart, username, request.RemoteAddr, publicHost, subscription)
 
-		conn.SetDeadline(time.Now().Add(60 * time.Minute))
-
-		go handleConnections(sess, pl, subscription, publicHost, userName, token, clientConn, aesGCM)
+		tunnelSessions.handlers.Add(1)
+		go func() {
+			defer tunnelSessions.handlers.Done()
+			handleConnections(sess, pl, subscription, publicHost, userName, clientConn, aesGCM, openMetadata, proxyHeader, rules)
+		}()
 
-		sess.Wait()
+		waitErr := sess.Wait()
 		log.Printf("%s: end session", publicHost)
-
-		activeConnections.Lock()
-		delete(activeConnections.connections, request.RemoteAddr)
-		activeConnections.Unlock()
+		auditLog.Log(audit.SessionEnd, username, request.RemoteAddr, publicHost, fmt.Sprint(waitErr))
 	})}
 	srv.Serve(myStupidListner)
 }
 
 ///   *************************************** handleConnections  ***************************************
 
-func handleConnections(sess *session.Session, pl net.Listener, subscription, publicHost, userName, token string, clientConn *ClientConnection, aesGCM cipher.AEAD) {
+// hasFeature reports whether the comma separated list features names feature.
+func hasFeature(features, feature string) bool {
+	for _, f := range strings.Split(features, ",") {
+		if strings.EqualFold(strings.TrimSpace(f), feature) {
+			return true
+		}
+	}
+	return false
+}
+
+// newPublicHost returns the name a new tunnel of userName is reachable
+// at: a subdomain of host, or a path prefix on host with the path URL style.
+func newPublicHost(userName, host, port string) string {
+	name := utilities.NewSubdomain(userName)
+	if config.UrlStyle == urlStylePath {
+		return strings.TrimSuffix(net.JoinHostPort(host, port), ":80") + "/" + strings.TrimSuffix(name, ".")
+	}
+	return strings.TrimSuffix(net.JoinHostPort(name+host, port), ":80")
+}
+
+// bulkRequestSize is the request body size from which a public connection
+// is forwarded as bulk.
+const bulkRequestSize = 1 << 20
+
+// channelPriority returns how the channel of a public connection of kind
+// shares the tunnel: long-lived connections and large uploads, which could
+// otherwise hold it for long, go as bulk so that the short requests of a
+// page are not stuck behind them.
+func channelPriority(conn net.Conn, kind string) session.Priority {
+	if kind != "" {
+		return session.PriorityBulk
+	}
+	if hc := httpConn(conn); hc != nil && hc.Request != nil && hc.Request.ContentLength >= bulkRequestSize {
+		return session.PriorityBulk
+	}
+	return session.PriorityNormal
+}
+
+// channelMetadata describes a forwarded public connection to the client.
+func channelMetadata(conn net.Conn, publicHost string) []byte {
+	md := map[string]string{
+		"remote-addr": conn.RemoteAddr().String(),
+		"tunnel":      publicHost,
+	}
+	if vconn, ok := conn.(vhost.Conn); ok {
+		md["host"] = vconn.Host()
+	}
+	return codec.MarshalExtra(md)
+}
+
+// handleConnections forwards the public connections accepted on pl into
+// sess until pl is closed, then closes those still open.
+func handleConnections(sess *session.Session, pl *vhost.Listener, subscription, publicHost, userName string, clientConn *ClientConnection, aesGCM cipher.AEAD, openMetadata, proxyHeader bool, rules *vhost.HeaderRules) {
 	var wg sync.WaitGroup
+	var open = struct {
+		sync.Mutex
+		conns map[net.Conn]struct{}
+	}{conns: make(map[net.Conn]struct{})} // the public connections being forwarded
+	forget := func(conn net.Conn) {
+		open.Lock()
+		delete(open.conns, conn)
+		open.Unlock()
+	}
 
 	log.Println("Handling connections for:", publicHost, "with subscription:", subscription)
 
 	for {
-		activeConnections.Lock()
-		if clientConn.active >= connectionLimits[subscription] {
-			log.Println("Connection limit reached for subscription level:", subscription)
-			activeConnections.Unlock()
+		conn, err := pl.Accept()
+		if err != nil {
+			log.Println("---------- listener accept error:", err)
 			break
 		}
-		clientConn.active++
-		activeConnections.Unlock()
 
-		err2 := auth.SendIncrementRequest(userName, publicHost, config.ApiUrlDetails, token)
-		if err2 != nil {
-			log.Fatalf("--------- error adding user URL details: %v", err2)
+		// upgraded connections and event streams stay open, so they are
+		// held to their own limit and do not use up the requests'
+		kind := streamKind(conn)
+		if !acquire(clientConn, subscription, kind) {
+			if kind == "" {
+				log.Println("Connection limit reached for subscription level:", subscription)
+				auditLog.Log(audit.LimitBreach, userName, "", publicHost, "connection limit reached for "+subscription)
+				writeErrorPage(conn, pageOverQuota)
+			} else {
+				log.Println("Upgrade limit reached for subscription level:", subscription, kind)
+				auditLog.Log(audit.LimitBreach, userName, "", publicHost, kind+" limit reached for "+subscription)
+				writeErrorPage(conn, pageUpgradeQuota)
+			}
+			conn.Close()
+			continue
 		}
 
-		if err := clientConn.limiter.Wait(context.Background()); err != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), rateLimitWait)
+		err = clientConn.limiter.Wait(ctx)
+		cancel()
+		if err != nil {
 			log.Println("Rate limit exceeded:", err)
-			activeConnections.Lock()
-			clientConn.active--
-			activeConnections.Unlock()
-			break
+			auditLog.Log(audit.LimitBreach, userName, "", publicHost, "rate limit exceeded: "+err.Error())
+			writeErrorPage(conn, pageRateLimited)
+			conn.Close()
+			release(clientConn, subscription, kind)
+			continue
 		}
 
-		conn, err := pl.Accept()
-		if err != nil {
-			log.Println("---------- listener accept error:", err)
-			activeConnections.Lock()
-			clientConn.active--
-			activeConnections.Unlock()
-			break
-		}
+		usageReporter.Record(auth.UsageEvent{Kind: usage.ConnectionAccepted, UserName: userName, Url: publicHost})
 
-		ch, err := sess.Open(context.Background())
+		opts := session.OpenOptions{Priority: channelPriority(conn, kind)}
+		if openMetadata {
+			opts.Type = tunnelChannelType
+			opts.Extra = channelMetadata(conn, publicHost)
+		}
+		ch, err := sess.OpenWith(context.Background(), opts)
 		if err != nil {
 			log.Println("----------- session open error:", err)
+			writeErrorPage(conn, openPage(err))
 			conn.Close()
-			activeConnections.Lock()
-			clientConn.active--
-			activeConnections.Unlock()
+			release(clientConn, subscription, kind)
+			// a refused channel leaves the tunnel usable
+			var openErr *session.OpenError
+			if errors.As(err, &openErr) {
+				continue
+			}
 			break
 		}
 
 		wg.Add(1)
+		open.Lock()
+		open.conns[conn] = struct{}{}
+		open.Unlock()
 		go func() {
 			defer wg.Done()
-			defer func() {
-				activeConnections.Lock()
-				clientConn.active--
-				log.Println("******** Decrement active connections", clientConn)
-				activeConnections.Unlock()
-			}()
-
-			utilities.JoinEncrypted(ch, conn, aesGCM)
+			defer release(clientConn, subscription, kind)
+			defer forget(conn)
+
+			// the request is rewritten before anything is read from conn
+			var tunnel io.ReadWriteCloser = ch
+			if rules != nil {
+				tunnel = applyHeaderRules(conn, ch, rules, pl.Path())
+			}
+
+			// the local service sees the public client's address
+			if proxyHeader {
+				var authority string
+				if vconn, ok := conn.(vhost.Conn); ok {
+					authority = vconn.Host()
+				}
+				if _, err := ch.Write(vhost.ProxyHeaderV2(conn.RemoteAddr(), conn.LocalAddr(), authority)); err != nil {
+					log.Println("--------- proxy header write error:", err)
+					ch.Close()
+					conn.Close()
+					return
+				}
+			}
+
+			if kind != "" && config.UpgradeIdleMinutes > 0 {
+				conn = newIdleConn(conn, time.Duration(config.UpgradeIdleMinutes)*time.Minute, func() {
+					tunnelMetrics.idle(kind)
+				})
+			}
+			counted := usage.Count(conn)
+			utilities.JoinEncrypted(tunnel, counted, aesGCM)
+			tunnelMetrics.transferred(subscription, counted.Bytes())
 		}()
 	}
 
+	// the tunnel is gone, its public connections would only hang
+	open.Lock()
+	for conn := range open.conns {
+		conn.Close()
+	}
+	open.Unlock()
 	wg.Wait()
 }
 
@@ -0,0 +1,977 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"teleportServer/audit"
+	"teleportServer/auth"
+	"teleportServer/localPackages/codec"
+	"teleportServer/localPackages/go-vhost"
+	"teleportServer/localPackages/session"
+	"teleportServer/usage"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// stubBackend fakes the auth and details APIs. Sign in always succeeds,
+// the details endpoints answer with whatever status is currently stored.
+type stubBackend struct {
+	*httptest.Server
+	addStatus       int32
+	incrementStatus int32
+	addCalls        int32
+	incrementCalls  int32
+}
+
+func newStubBackend(t *testing.T, addStatus, incrementStatus int) *stubBackend {
+	t.Helper()
+	b := &stubBackend{addStatus: int32(addStatus), incrementStatus: int32(incrementStatus)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/auth/signin", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"accessToken":"x","userName":"alice","subscriptionType":"free"}`)
+	})
+	mux.HandleFunc("/details/add", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&b.addCalls, 1)
+		w.WriteHeader(int(atomic.LoadInt32(&b.addStatus)))
+	})
+	mux.HandleFunc("/details/increment", func(w http.ResponseWriter, r *http.Request) {
+		var req auth.IncrementRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UserName != "alice" || req.Url == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		atomic.AddInt32(&b.incrementCalls, 1)
+		w.WriteHeader(int(atomic.LoadInt32(&b.incrementStatus)))
+	})
+	b.Server = httptest.NewServer(mux)
+	t.Cleanup(b.Close)
+	return b
+}
+
+// startServer runs ConnectionManager against backend and returns the
+// address of the public listener and its port.
+func startServer(t *testing.T, backend *stubBackend) (string, string) {
+	t.Helper()
+	return startServerWith(t, backend, nil)
+}
+
+// startServerWith is startServer with configure applied to the config
+// before the server starts. The server is stopped, its tunnels included,
+// before the next test replaces the globals they use.
+func startServerWith(t *testing.T, backend *stubBackend, configure func(*Config)) (string, string) {
+	t.Helper()
+	tunnelSessions.Lock()
+	tunnelSessions.stopped = false
+	tunnelSessions.Unlock()
+	config = Config{
+		Host:          "teleport.me",
+		ApiUrlAuth:    backend.URL + "/auth",
+		ApiUrlDetails: backend.URL + "/details",
+		Token:         "token",
+		Free:          2,
+	}
+	if configure != nil {
+		configure(&config)
+	}
+	connectionLimits["free"] = config.Free
+	upgradeLimits["free"] = config.FreeUpgrades
+	detailsBackoff = auth.Backoff{Attempts: 3, Initial: time.Millisecond, Max: time.Millisecond}
+	usageReporter = usage.NewReporter(sendUsage, usage.Options{
+		Interval: 10 * time.Millisecond,
+		Backoff:  auth.Backoff{Attempts: 1},
+	})
+	t.Cleanup(func() { usageReporter.Close() })
+
+	var err error
+	config.AuditLog = filepath.Join(t.TempDir(), "audit.log")
+	if auditLog, err = openAuditLog(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { auditLog.Close() })
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		l.Close()
+		stopTunnels()
+	})
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+
+	vmux, err := vhost.NewHTTPMuxer(publicListener(l), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vmux.Pages = errorPages
+	go vmux.HandleErrors()
+	go ConnectionManager(vmux, config.Host, port)
+
+	return l.Addr().String(), port
+}
+
+// handshake performs the client side of the tunnel handshake, advertising
+// features. On success the returned transport carries the session.
+func handshake(t *testing.T, addr, port string, features ...string) (*http.Response, io.ReadWriteCloser) {
+	t.Helper()
+	header := make(http.Header)
+	if len(features) > 0 {
+		header.Set(featuresHeader, strings.Join(features, ", "))
+	}
+	return handshakeWith(t, addr, port, header)
+}
+
+// handshakeWith is handshake with extra headers.
+func handshakeWith(t *testing.T, addr, port string, header http.Header) (*http.Response, io.ReadWriteCloser) {
+	t.Helper()
+	_, x, y, err := elliptic.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	req, _ := http.NewRequest("GET", "http://"+net.JoinHostPort(config.Host, port)+"/", nil)
+	req.Header.Set("X-Username", "alice")
+	req.Header.Set("X-Password", "secret")
+	req.Header.Set("X-Client-Public-Key", fmt.Sprintf("%x", elliptic.Marshal(elliptic.P256(), x, y)))
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, struct {
+		io.Reader
+		io.WriteCloser
+	}{br, conn}
+}
+
+func TestDetailsFailureTearsDownOnlyTheTunnel(t *testing.T) {
+	backend := newStubBackend(t, http.StatusInternalServerError, http.StatusOK)
+	addr, port := startServer(t, backend)
+
+	resp, _ := handshake(t, addr, port)
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("expected %d, got %d", http.StatusBadGateway, resp.StatusCode)
+	}
+	if calls := atomic.LoadInt32(&backend.addCalls); calls != 3 {
+		t.Fatalf("expected 3 attempts at the details API, got %d", calls)
+	}
+
+	b, err := os.ReadFile(config.AuditLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, event := range []string{audit.AuthSuccess, audit.SubdomainAssigned, audit.ForceClose} {
+		if !strings.Contains(string(b), `"event":"`+event+`"`) {
+			t.Errorf("expected %s in the audit log", event)
+		}
+	}
+	if _, err := audit.Verify(bytes.NewReader(b), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// the process is still up and the next tunnel goes through
+	atomic.StoreInt32(&backend.addStatus, http.StatusOK)
+	resp, _ = handshake(t, addr, port)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+}
+
+func TestDetailsClientErrorIsNotRetried(t *testing.T) {
+	backend := newStubBackend(t, http.StatusForbidden, http.StatusOK)
+	addr, port := startServer(t, backend)
+
+	resp, _ := handshake(t, addr, port)
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("expected %d, got %d", http.StatusBadGateway, resp.StatusCode)
+	}
+	if calls := atomic.LoadInt32(&backend.addCalls); calls != 1 {
+		t.Fatalf("expected a single attempt at the details API, got %d", calls)
+	}
+}
+
+func TestUsageFailureKeepsTunnel(t *testing.T) {
+	backend := newStubBackend(t, http.StatusOK, http.StatusInternalServerError)
+	addr, port := startServer(t, backend)
+
+	resp, transport := handshake(t, addr, port)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	sess := session.New(transport)
+	defer sess.Close()
+
+	public, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer public.Close()
+	fmt.Fprintf(public, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", resp.Header.Get("X-Public-Host"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	accepted := make(chan error, 1)
+	go func() {
+		_, err := sess.Accept()
+		accepted <- err
+	}()
+	select {
+	case err := <-accepted:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-ctx.Done():
+		t.Fatal("public connection never reached the client")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&backend.incrementCalls) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected usage to be reported")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUsageDeliversEveryRecordedEvent(t *testing.T) {
+	backend := newStubBackend(t, http.StatusOK, http.StatusOK)
+	addr, port := startServer(t, backend)
+
+	resp, transport := handshake(t, addr, port)
+	sess := session.New(transport)
+	defer sess.Close()
+
+	tunnelMetrics.Lock()
+	before := tunnelMetrics.bytes["free"]
+	tunnelMetrics.Unlock()
+
+	public, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(public, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", resp.Header.Get("X-Public-Host"))
+	if _, err := sess.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	public.Close()
+
+	// the connection is counted by the details API, its bytes in the
+	// metrics, and nothing is flushed without being delivered
+	waitUntil := func(what string, cond func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatal(what)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitUntil("expected the connection reported", func() bool { return atomic.LoadInt32(&backend.incrementCalls) == 1 })
+	waitUntil("expected the bytes counted", func() bool {
+		tunnelMetrics.Lock()
+		defer tunnelMetrics.Unlock()
+		return tunnelMetrics.bytes["free"] > before
+	})
+	if stats := usageReporter.Stats(); stats.Recorded != 1 || stats.Flushed != 1 {
+		t.Fatalf("expected the one event recorded and delivered, got %+v", stats)
+	}
+
+	// the reporter counters are served with the metrics
+	rec := httptest.NewRecorder()
+	tunnelMetrics.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{
+		`teleport_usage_events_total{state="recorded"} 1`,
+		`teleport_usage_events_total{state="flushed"} 1`,
+		`teleport_usage_events_total{state="dropped"} 0`,
+		"teleport_usage_flush_failures_total 0",
+	} {
+		if !strings.Contains(rec.Body.String(), want+"\n") {
+			t.Fatalf("expected %q in the metrics, got\n%s", want, rec.Body)
+		}
+	}
+}
+
+func TestChannelMetadata(t *testing.T) {
+	backend := newStubBackend(t, http.StatusOK, http.StatusOK)
+	addr, port := startServer(t, backend)
+
+	resp, transport := handshake(t, addr, port, featureOpenMetadata)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	if !hasFeature(resp.Header.Get(featuresHeader), featureOpenMetadata) {
+		t.Fatal("expected the server to enable open metadata")
+	}
+	sess := session.NewWithConfig(transport, session.Config{OpenMetadata: true})
+	defer sess.Close()
+
+	public, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer public.Close()
+	publicHost := resp.Header.Get("X-Public-Host")
+	fmt.Fprintf(public, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", publicHost)
+
+	ch, err := sess.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	channel := ch.(*session.Channel)
+	md, err := channel.Metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if channel.Type() != tunnelChannelType || md["host"] != publicHost || md["tunnel"] != publicHost || md["remote-addr"] != public.LocalAddr().String() {
+		t.Fatalf("unexpected channel %q %v", channel.Type(), md)
+	}
+}
+
+func TestPathURLStyle(t *testing.T) {
+	backend := newStubBackend(t, http.StatusOK, http.StatusOK)
+	addr, port := startServerWith(t, backend, func(c *Config) { c.UrlStyle = urlStylePath })
+
+	resp, transport := handshake(t, addr, port)
+	publicHost := resp.Header.Get("X-Public-Host")
+	host, prefix, _ := strings.Cut(publicHost, "/")
+	if host != net.JoinHostPort(config.Host, port) || !strings.HasPrefix(prefix, "Teleport_alice_") {
+		t.Fatalf("expected a path on %s, got %q", config.Host, publicHost)
+	}
+	sess := session.New(transport)
+	defer sess.Close()
+
+	public, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer public.Close()
+	fmt.Fprintf(public, "GET /%s/app?x=1 HTTP/1.1\r\nHost: %s\r\n\r\n", prefix, host)
+
+	// the request reaches the tunnel; the rewrite itself is covered by
+	// the vhost tests, the channel being encrypted
+	ch, err := sess.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch.Close()
+}
+
+func TestH2CReachesTunnel(t *testing.T) {
+	backend := newStubBackend(t, http.StatusOK, http.StatusOK)
+	addr, port := startServer(t, backend)
+
+	resp, transport := handshake(t, addr, port, featureOpenMetadata)
+	sess := session.NewWithConfig(transport, session.Config{OpenMetadata: true})
+	defer sess.Close()
+	publicHost := resp.Header.Get("X-Public-Host")
+
+	// a gRPC client with prior knowledge
+	public, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer public.Close()
+	public.Write([]byte(http2.ClientPreface))
+	fr := http2.NewFramer(public, nil)
+	fr.WriteSettings()
+	var block bytes.Buffer
+	enc := hpack.NewEncoder(&block)
+	enc.WriteField(hpack.HeaderField{Name: ":method", Value: "POST"})
+	enc.WriteField(hpack.HeaderField{Name: ":scheme", Value: "http"})
+	enc.WriteField(hpack.HeaderField{Name: ":authority", Value: publicHost})
+	enc.WriteField(hpack.HeaderField{Name: ":path", Value: "/pkg.Greeter/SayHello"})
+	fr.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: block.Bytes(), EndHeaders: true})
+
+	ch, err := sess.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	md, err := ch.(*session.Channel).Metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md["host"] != publicHost {
+		t.Fatalf("expected the channel for %s, got %v", publicHost, md)
+	}
+}
+
+func TestOldClientGetsPlainChannels(t *testing.T) {
+	backend := newStubBackend(t, http.StatusOK, http.StatusOK)
+	addr, port := startServer(t, backend)
+
+	resp, transport := handshake(t, addr, port)
+	if resp.Header.Get(featuresHeader) != "" {
+		t.Fatal("no features were asked for")
+	}
+	sess := session.New(transport)
+	defer sess.Close()
+
+	public, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer public.Close()
+	fmt.Fprintf(public, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", resp.Header.Get("X-Public-Host"))
+
+	ch, err := sess.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ch.(*session.Channel).Type() != "" {
+		t.Fatal("expected an untyped channel")
+	}
+}
+
+func TestDrainingNotice(t *testing.T) {
+	backend := newStubBackend(t, http.StatusOK, http.StatusOK)
+	addr, port := startServer(t, backend)
+
+	resp, transport := handshake(t, addr, port, featureOpenMetadata, featureGlobalRequests)
+	features := resp.Header.Get(featuresHeader)
+	if !hasFeature(features, featureOpenMetadata) || !hasFeature(features, featureGlobalRequests) {
+		t.Fatalf("expected both features to be enabled, got %q", features)
+	}
+	notices := make(chan string, 1)
+	sess := session.NewWithConfig(transport, session.Config{OpenMetadata: true, GlobalRequests: true})
+	defer sess.Close()
+	sess.HandleRequests(func(req *session.Request) (bool, []byte) {
+		if req.Type == requestDraining {
+			notices <- string(req.Payload)
+		}
+		return true, nil
+	})
+
+	// an old client on the same server gets nothing it cannot decode
+	oldResp, oldTransport := handshake(t, addr, port)
+	old := session.New(oldTransport)
+	defer old.Close()
+
+	// a forwarded connection on each tunnel shows both are being served
+	for _, c := range []struct {
+		sess *session.Session
+		host string
+	}{{sess, resp.Header.Get("X-Public-Host")}, {old, oldResp.Header.Get("X-Public-Host")}} {
+		public, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer public.Close()
+		fmt.Fprintf(public, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", c.host)
+		if _, err := c.sess.Accept(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	oldDone := make(chan struct{})
+	go func() {
+		old.Wait()
+		close(oldDone)
+	}()
+
+	notifyDraining()
+	select {
+	case got := <-notices:
+		if got != strconv.Itoa(config.DrainSeconds) {
+			t.Fatalf("unexpected drain notice %q", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no drain notice")
+	}
+	select {
+	case <-oldDone:
+		t.Fatal("the old client's session was broken by the notice")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestClientOpensAreRefused(t *testing.T) {
+	backend := newStubBackend(t, http.StatusOK, http.StatusOK)
+	addr, port := startServer(t, backend)
+
+	resp, transport := handshake(t, addr, port, featureOpenMetadata)
+	sess := session.NewWithConfig(transport, session.Config{OpenMetadata: true})
+	defer sess.Close()
+
+	// more opens than the server's accept backlog
+	for i := 0; i < 20; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, err := sess.OpenWith(ctx, session.OpenOptions{Type: tunnelChannelType})
+		cancel()
+		if !errors.Is(err, session.ErrAdministrativelyProhibited) {
+			t.Fatalf("open %d: expected ErrAdministrativelyProhibited, got %v", i, err)
+		}
+	}
+
+	public, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer public.Close()
+	fmt.Fprintf(public, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", resp.Header.Get("X-Public-Host"))
+	if _, err := sess.Accept(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRefusedChannelStatus(t *testing.T) {
+	backend := newStubBackend(t, http.StatusOK, http.StatusOK)
+	addr, port := startServer(t, backend)
+	connectionLimits["free"] = 10
+
+	resp, transport := handshake(t, addr, port, featureOpenMetadata)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	refusals := make(chan error, 2)
+	refusals <- &session.OpenError{Reason: codec.ReasonConnectFailed, Description: "dial tcp 127.0.0.1:3000: connection refused"}
+	refusals <- &session.OpenError{Reason: codec.ReasonResourceShortage}
+	sess := session.NewWithConfig(transport, session.Config{
+		OpenMetadata: true,
+		Approve:      func(*session.Channel) error { return <-refusals },
+	})
+	defer sess.Close()
+
+	for _, want := range []int{http.StatusBadGateway, http.StatusServiceUnavailable} {
+		public, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, _ := http.NewRequest("GET", "http://"+resp.Header.Get("X-Public-Host")+"/", nil)
+		req.Write(public)
+		publicResp, err := http.ReadResponse(bufio.NewReader(public), req)
+		public.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if publicResp.StatusCode != want {
+			t.Fatalf("expected %d, got %d", want, publicResp.StatusCode)
+		}
+	}
+}
+
+// The counts of open connections setOpen sets.
+var (
+	activeCount   = func(c *ClientConnection) *int { return &c.active }
+	upgradedCount = func(c *ClientConnection) *int { return &c.upgraded }
+)
+
+// setOpen sets the count of open connections picked by count, on the only
+// connected client, once the public connections of earlier steps are
+// released.
+func setOpen(t *testing.T, count func(*ClientConnection) *int, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for publicConnectionsOpen() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("public connections were not released")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	activeConnections.Lock()
+	defer activeConnections.Unlock()
+	if len(activeConnections.connections) != 1 {
+		t.Fatalf("expected one client, got %d", len(activeConnections.connections))
+	}
+	for _, c := range activeConnections.connections {
+		*count(c) = n
+	}
+}
+
+// publicConnectionsOpen returns the number of public connections open in
+// tunnels, of any kind.
+func publicConnectionsOpen() int64 {
+	tunnelMetrics.Lock()
+	defer tunnelMetrics.Unlock()
+	var n int64
+	for _, open := range tunnelMetrics.current {
+		n += open
+	}
+	return n
+}
+
+func TestOverQuotaPage(t *testing.T) {
+	backend := newStubBackend(t, http.StatusOK, http.StatusOK)
+	addr, port := startServer(t, backend)
+
+	resp, transport := handshake(t, addr, port)
+	sess := session.New(transport)
+	defer sess.Close()
+	publicHost := resp.Header.Get("X-Public-Host")
+
+	// all the connections the plan allows are open
+	setOpen(t, activeCount, config.Free)
+	for _, accept := range []string{"application/json", "text/html"} {
+		public, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, _ := http.NewRequest("GET", "http://"+publicHost+"/", nil)
+		req.Header.Set("Accept", accept)
+		req.Write(public)
+		publicResp, err := http.ReadResponse(bufio.NewReader(public), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(publicResp.Body)
+		public.Close()
+		if publicResp.StatusCode != http.StatusServiceUnavailable || publicResp.Header.Get("X-Request-Id") == "" {
+			t.Fatalf("expected a 503 with a request ID, got %d %v", publicResp.StatusCode, publicResp.Header)
+		}
+		if accept == "application/json" && !strings.Contains(string(body), `"code":"over_quota"`) {
+			t.Fatalf("expected the over quota page as JSON, got %q", body)
+		}
+		if accept == "text/html" && !strings.Contains(string(body), "Tunnel over quota") {
+			t.Fatalf("expected the over quota page as HTML, got %q", body)
+		}
+	}
+
+	// the tunnel takes connections again once the quota frees up
+	setOpen(t, activeCount, 0)
+	public, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer public.Close()
+	fmt.Fprintf(public, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", publicHost)
+	if _, err := sess.Accept(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHeaderRulesHandshake(t *testing.T) {
+	backend := newStubBackend(t, http.StatusOK, http.StatusOK)
+	addr, port := startServer(t, backend)
+
+	header := make(http.Header)
+	header.Set(rulesHeader, `{"request": {"set": {"Content-Length": "0"}}}`)
+	resp, _ := handshakeWith(t, addr, port, header)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected rules that break the requests to be refused, got %d", resp.StatusCode)
+	}
+	header.Set(rulesHeader, `{"hots": "localhost:3000"}`)
+	resp, _ = handshakeWith(t, addr, port, header)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected unknown rules to be refused, got %d", resp.StatusCode)
+	}
+
+	header.Set(rulesHeader, `{"host": "localhost:3000", "rewriteLocation": true, "response": {"set": {"Access-Control-Allow-Origin": "*"}}}`)
+	resp, transport := handshakeWith(t, addr, port, header)
+	if resp.StatusCode != http.StatusOK || !hasFeature(resp.Header.Get(featuresHeader), featureHeaderRewrite) {
+		t.Fatalf("expected the rules to be accepted, got %d %q", resp.StatusCode, resp.Header.Get(featuresHeader))
+	}
+	sess := session.New(transport)
+	defer sess.Close()
+
+	// the rewritten request still reaches the tunnel; the rules themselves
+	// are covered by the vhost tests, the channel being encrypted
+	public, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer public.Close()
+	fmt.Fprintf(public, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", resp.Header.Get("X-Public-Host"))
+	ch, err := sess.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch.Close()
+}
+
+func TestUpgradeQuota(t *testing.T) {
+	backend := newStubBackend(t, http.StatusOK, http.StatusOK)
+	addr, port := startServerWith(t, backend, func(c *Config) { c.FreeUpgrades = 1 })
+
+	resp, transport := handshake(t, addr, port)
+	sess := session.New(transport)
+	defer sess.Close()
+	publicHost := resp.Header.Get("X-Public-Host")
+
+	websocket := func() net.Conn {
+		public, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { public.Close() })
+		fmt.Fprintf(public, "GET /ws HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nAccept: application/json\r\n\r\n", publicHost)
+		return public
+	}
+
+	// a live-reload socket still gets through with the requests over quota
+	setOpen(t, activeCount, config.Free)
+	websocket()
+	ch, err := sess.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch.Close()
+
+	// but not past the upgrade limit
+	setOpen(t, upgradedCount, config.FreeUpgrades)
+	publicResp, err := http.ReadResponse(bufio.NewReader(websocket()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(publicResp.Body)
+	if publicResp.StatusCode != http.StatusServiceUnavailable || !strings.Contains(string(body), `"code":"upgrade_quota"`) {
+		t.Fatalf("expected the upgrade quota page, got %d %q", publicResp.StatusCode, body)
+	}
+
+	rec := httptest.NewRecorder()
+	tunnelMetrics.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{
+		`teleport_upgrades_refused_total{subscription="free",kind="websocket"} `,
+		`teleport_public_connections_total{subscription="free",kind="websocket"} `,
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Fatalf("expected %q in the metrics, got\n%s", want, rec.Body)
+		}
+	}
+}
+
+func TestStreamKind(t *testing.T) {
+	for head, want := range map[string]string{
+		"GET / HTTP/1.1\r\nHost: x\r\n\r\n":                                               "",
+		"GET / HTTP/1.1\r\nHost: x\r\nConnection: Upgrade\r\nUpgrade: WebSocket\r\n\r\n":  streamWebSocket,
+		"GET / HTTP/1.1\r\nHost: x\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n":        streamUpgrade,
+		"GET / HTTP/1.1\r\nHost: x\r\nConnection: Upgrade\r\nUpgrade: x-5f3a9c01\r\n\r\n": streamUpgrade,
+		"GET / HTTP/1.1\r\nHost: x\r\nAccept: text/event-stream\r\n\r\n":                  streamEventStream,
+	} {
+		client, server := net.Pipe()
+		go func() {
+			io.WriteString(client, head)
+			client.Close()
+		}()
+		conn, err := vhost.HTTP(server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kind := streamKind(conn); kind != want {
+			t.Errorf("%q: expected kind %q, got %q", head, want, kind)
+		}
+		conn.Close()
+	}
+}
+
+func TestChannelPriority(t *testing.T) {
+	for head, want := range map[string]session.Priority{
+		"GET /app.js HTTP/1.1\r\nHost: x\r\n\r\n":                                          session.PriorityNormal,
+		"POST /form HTTP/1.1\r\nHost: x\r\nContent-Length: 512\r\n\r\n":                    session.PriorityNormal,
+		"PUT /upload HTTP/1.1\r\nHost: x\r\nContent-Length: 4194304\r\n\r\n":               session.PriorityBulk,
+		"GET /ws HTTP/1.1\r\nHost: x\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n": session.PriorityBulk,
+	} {
+		client, server := net.Pipe()
+		go func() {
+			io.WriteString(client, head)
+			client.Close()
+		}()
+		conn, err := vhost.HTTP(server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p := channelPriority(conn, streamKind(conn)); p != want {
+			t.Errorf("%q: expected priority %d, got %d", head, want, p)
+		}
+		conn.Close()
+	}
+}
+
+func TestIdleConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	idle := make(chan struct{})
+	conn := newIdleConn(server, 50*time.Millisecond, func() { close(idle) })
+	go io.Copy(io.Discard, client)
+
+	// traffic keeps it open
+	for i := 0; i < 5; i++ {
+		time.Sleep(20 * time.Millisecond)
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case <-idle:
+		t.Fatal("closed while carrying traffic")
+	default:
+	}
+
+	select {
+	case <-idle:
+	case <-time.After(time.Second):
+		t.Fatal("expected the idle connection to be closed")
+	}
+	if _, err := conn.Write([]byte("ping")); err == nil {
+		t.Fatal("expected writes to fail once closed")
+	}
+}
+
+func TestKeepaliveFeature(t *testing.T) {
+	backend := newStubBackend(t, http.StatusOK, http.StatusOK)
+	addr, port := startServerWith(t, backend, func(c *Config) {
+		c.KeepaliveSeconds = 15
+		c.IdleTimeoutMinutes = 60
+		c.WindowSize = 2 << 20
+		c.MaxWindowSize = 16 << 20
+	})
+
+	resp, _ := handshake(t, addr, port, featureKeepalive)
+	if !hasFeature(resp.Header.Get(featuresHeader), featureKeepalive) {
+		t.Fatal("expected the server to enable keepalive")
+	}
+	if cfg := sessionConfig(true); cfg.KeepaliveInterval != 15*time.Second || cfg.ReadTimeout != 0 || cfg.MaxWindowSize != 16<<20 {
+		t.Fatalf("expected pings for a client that answers them, got %+v", cfg)
+	}
+
+	// older clients cannot decode pings
+	resp, _ = handshake(t, addr, port)
+	if hasFeature(resp.Header.Get(featuresHeader), featureKeepalive) {
+		t.Fatal("expected keepalive to be left off")
+	}
+	if cfg := sessionConfig(false); cfg.KeepaliveInterval != 0 || cfg.ReadTimeout != time.Hour || cfg.MaxWindowSize != cfg.WindowSize {
+		t.Fatalf("expected a read timeout and fixed windows instead of pings, got %+v", cfg)
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	backend := newStubBackend(t, http.StatusOK, http.StatusOK)
+	// 127.0.0.2 plays the load balancer, the client comes from 127.0.0.1
+	addr, port := startServerWith(t, backend, func(c *Config) { c.ProxyProtocolFrom = "127.0.0.2" })
+
+	resp, transport := handshake(t, addr, port, featureProxyProtocol)
+	if !hasFeature(resp.Header.Get(featuresHeader), featureProxyProtocol) {
+		t.Fatal("expected the server to enable the proxy protocol")
+	}
+	sess := session.New(transport)
+	defer sess.Close()
+	publicHost := resp.Header.Get("X-Public-Host")
+
+	lb := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2)}}
+	public, err := lb.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer public.Close()
+	fmt.Fprintf(public, "PROXY TCP4 203.0.113.7 198.51.100.1 56324 80\r\nGET / HTTP/1.1\r\nHost: %s\r\n\r\n", publicHost)
+
+	ch, err := sess.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+	header := make([]byte, 16+12)
+	if _, err := io.ReadFull(ch, header); err != nil {
+		t.Fatal(err)
+	}
+	// version 2 PROXY over TCP4, then the addresses and ports
+	want := append([]byte("\r\n\r\n\x00\r\nQUIT\n\x21\x11"), 0, byte(12+3+len(publicHost)))
+	want = append(want, 203, 0, 113, 7, 198, 51, 100, 1, 56324>>8, 56324&0xff, 0, 80)
+	if !bytes.Equal(header, want) {
+		t.Fatalf("got header %x, want %x", header, want)
+	}
+	tlv := make([]byte, 3+len(publicHost))
+	if _, err := io.ReadFull(ch, tlv); err != nil {
+		t.Fatal(err)
+	}
+	if tlv[0] != 0x02 || string(tlv[3:]) != publicHost {
+		t.Fatalf("expected the authority TLV for %s, got %x", publicHost, tlv)
+	}
+}
+
+func TestOpenPage(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{&session.OpenError{Reason: codec.ReasonResourceShortage}, "tunnel_busy"},
+		{&session.OpenError{Reason: codec.ReasonConnectFailed}, "local_unreachable"},
+		{io.EOF, "tunnel_offline"},
+	}
+	for _, test := range tests {
+		if got := openPage(test.err).Code; got != test.want {
+			t.Errorf("%v: got page %q, want %q", test.err, got, test.want)
+		}
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	backend := newStubBackend(t, http.StatusOK, http.StatusOK)
+	config.ApiUrlAuth = backend.URL + "/auth"
+	atomic.StoreInt32(&configLoaded, 1)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vmux, err := vhost.NewHTTPMuxer(publicListener(l), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go vmux.HandleErrors()
+	h := newChecker(vmux).Handler()
+
+	probe := func(path string) int {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec.Code
+	}
+
+	if code := probe("/readyz"); code != http.StatusOK {
+		t.Fatalf("expected ready, got %d", code)
+	}
+
+	atomic.StoreInt32(&draining, 1)
+	if code := probe("/readyz"); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected not ready while draining, got %d", code)
+	}
+	atomic.StoreInt32(&draining, 0)
+
+	backend.Close()
+	if code := probe("/readyz"); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected not ready without an auth backend, got %d", code)
+	}
+	if code := probe("/healthz"); code != http.StatusOK {
+		t.Fatalf("expected alive, got %d", code)
+	}
+
+	l.Close()
+	deadline := time.Now().Add(time.Second)
+	for probe("/healthz") != http.StatusServiceUnavailable {
+		if time.Now().After(deadline) {
+			t.Fatal("expected not alive once the muxer stopped accepting")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"teleportServer/localPackages/go-vhost"
+	"teleportServer/usage"
+	"time"
+)
+
+///   *************************************** upgraded connections  ***************************************
+
+// Upgraded connections (WebSocket and the like) and event streams stay open
+// for as long as the page that opened them, so they are counted apart from
+// the short requests, against their own per-tier limits, and closed once
+// idle for UpgradeIdleMinutes.
+
+// The kinds of long-lived connections. They label the metrics, so the
+// protocols other than WebSocket a client may ask to upgrade to all count
+// as streamUpgrade.
+const (
+	streamWebSocket   = "websocket"
+	streamUpgrade     = "upgrade"
+	streamEventStream = "event-stream"
+)
+
+// upgradeLimits is the number of long-lived connections open at once, by
+// subscription.
+var upgradeLimits = map[string]int{}
+
+// streamKind returns the kind of long-lived connection conn asks for, or ""
+// for a plain request.
+func streamKind(conn net.Conn) string {
+	hc := httpConn(conn)
+	if hc == nil || hc.Request == nil {
+		return ""
+	}
+	switch hc.Upgrade() {
+	case "":
+	case streamWebSocket:
+		return streamWebSocket
+	default:
+		return streamUpgrade
+	}
+	if strings.Contains(hc.Request.Header.Get("Accept"), "text/event-stream") {
+		return streamEventStream
+	}
+	return ""
+}
+
+// httpConn returns the HTTP connection accepted as conn, nil if it is not
+// one.
+func httpConn(conn net.Conn) *vhost.HTTPConn {
+	if tc, ok := conn.(interface{ Unwrap() vhost.Conn }); ok {
+		conn = tc.Unwrap()
+	}
+	hc, _ := conn.(*vhost.HTTPConn)
+	return hc
+}
+
+// acquire counts a new connection of kind against the limits of
+// subscription, and reports false when they are reached.
+func acquire(clientConn *ClientConnection, subscription, kind string) bool {
+	activeConnections.Lock()
+	defer activeConnections.Unlock()
+	if kind == "" {
+		if clientConn.active >= connectionLimits[subscription] {
+			return false
+		}
+		clientConn.active++
+	} else {
+		if clientConn.upgraded >= upgradeLimits[subscription] {
+			tunnelMetrics.refused(subscription, kind)
+			return false
+		}
+		clientConn.upgraded++
+	}
+	tunnelMetrics.open(subscription, kind, 1)
+	return true
+}
+
+// release undoes acquire once the connection is closed.
+func release(clientConn *ClientConnection, subscription, kind string) {
+	activeConnections.Lock()
+	defer activeConnections.Unlock()
+	if kind == "" {
+		clientConn.active--
+	} else {
+		clientConn.upgraded--
+	}
+	tunnelMetrics.open(subscription, kind, -1)
+	log.Println("******** Decrement active connections", clientConn)
+}
+
+// idleConn closes its connection when no byte went either way for timeout.
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+func newIdleConn(conn net.Conn, timeout time.Duration, onIdle func()) *idleConn {
+	c := &idleConn{Conn: conn, timeout: timeout}
+	c.timer = time.AfterFunc(timeout, func() {
+		onIdle()
+		conn.Close()
+	})
+	return c
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.timer.Reset(c.timeout)
+	}
+	return n, err
+}
+
+func (c *idleConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.timer.Reset(c.timeout)
+	}
+	return n, err
+}
+
+func (c *idleConn) Close() error {
+	c.timer.Stop()
+	return c.Conn.Close()
+}
+
+///   *************************************** metrics  ***************************************
+
+// metrics counts the public connections forwarded into tunnels, served in
+// the Prometheus text format on the management port.
+type metrics struct {
+	sync.Mutex
+	opened     map[[2]string]int64 // by subscription and kind
+	current    map[[2]string]int64
+	refusals   map[[2]string]int64
+	idleClosed map[string]int64 // by kind
+	bytes      map[string]int64 // by subscription
+}
+
+var tunnelMetrics = newMetrics()
+
+func newMetrics() *metrics {
+	return &metrics{
+		opened:     make(map[[2]string]int64),
+		current:    make(map[[2]string]int64),
+		refusals:   make(map[[2]string]int64),
+		idleClosed: make(map[string]int64),
+		bytes:      make(map[string]int64),
+	}
+}
+
+// kindLabel names the plain requests in the metrics.
+func kindLabel(kind string) string {
+	if kind == "" {
+		return "request"
+	}
+	return kind
+}
+
+func (m *metrics) open(subscription, kind string, delta int64) {
+	m.Lock()
+	defer m.Unlock()
+	key := [2]string{subscription, kindLabel(kind)}
+	m.current[key] += delta
+	if delta > 0 {
+		m.opened[key] += delta
+	}
+}
+
+func (m *metrics) refused(subscription, kind string) {
+	m.Lock()
+	m.refusals[[2]string{subscription, kindLabel(kind)}]++
+	m.Unlock()
+}
+
+func (m *metrics) idle(kind string) {
+	m.Lock()
+	m.idleClosed[kindLabel(kind)]++
+	m.Unlock()
+}
+
+// transferred counts the bytes a public connection carried both ways.
+func (m *metrics) transferred(subscription string, n int64) {
+	m.Lock()
+	m.bytes[subscription] += n
+	m.Unlock()
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format.
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.Lock()
+	defer m.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Header().Set("Cache-Control", "no-store")
+
+	byTierAndKind := func(name, typ, help string, values map[[2]string]int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+		keys := make([][2]string, 0, len(values))
+		for key := range values {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i][0] < keys[j][0] || (keys[i][0] == keys[j][0] && keys[i][1] < keys[j][1])
+		})
+		for _, key := range keys {
+			fmt.Fprintf(w, "%s{subscription=%q,kind=%q} %d\n", name, key[0], key[1], values[key])
+		}
+	}
+	byTierAndKind("teleport_public_connections", "gauge", "Public connections open in tunnels.", m.current)
+	byTierAndKind("teleport_public_connections_total", "counter", "Public connections forwarded into tunnels.", m.opened)
+	byTierAndKind("teleport_upgrades_refused_total", "counter", "Long-lived connections refused for the limits of their tunnel.", m.refusals)
+
+	fmt.Fprintf(w, "# HELP teleport_upgrades_idle_closed_total Long-lived connections closed after being idle.\n# TYPE teleport_upgrades_idle_closed_total counter\n")
+	kinds := make([]string, 0, len(m.idleClosed))
+	for kind := range m.idleClosed {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		fmt.Fprintf(w, "teleport_upgrades_idle_closed_total{kind=%q} %d\n", kind, m.idleClosed[kind])
+	}
+
+	fmt.Fprintf(w, "# HELP teleport_public_bytes_total Bytes carried by public connections, both ways.\n# TYPE teleport_public_bytes_total counter\n")
+	subscriptions := make([]string, 0, len(m.bytes))
+	for subscription := range m.bytes {
+		subscriptions = append(subscriptions, subscription)
+	}
+	sort.Strings(subscriptions)
+	for _, subscription := range subscriptions {
+		fmt.Fprintf(w, "teleport_public_bytes_total{subscription=%q} %d\n", subscription, m.bytes[subscription])
+	}
+
+	if usageReporter != nil {
+		writeUsageStats(w, usageReporter.Stats())
+	}
+}
+
+// writeUsageStats writes the counters of the usage reporter, every event
+// recorded being flushed, spooled or dropped.
+func writeUsageStats(w io.Writer, stats usage.Stats) {
+	fmt.Fprintf(w, "# HELP teleport_usage_events_total Usage events by what became of them.\n# TYPE teleport_usage_events_total counter\n")
+	for _, c := range []struct {
+		state string
+		n     uint64
+	}{
+		{"recorded", stats.Recorded},
+		{"flushed", stats.Flushed},
+		{"spooled", stats.Spooled},
+		{"replayed", stats.Replayed},
+		{"dropped", stats.Dropped},
+	} {
+		fmt.Fprintf(w, "teleport_usage_events_total{state=%q} %d\n", c.state, c.n)
+	}
+	fmt.Fprintf(w, "# HELP teleport_usage_flush_failures_total Usage flushes that failed after their retries.\n# TYPE teleport_usage_flush_failures_total counter\n")
+	fmt.Fprintf(w, "teleport_usage_flush_failures_total %d\n", stats.Failures)
+}
@@ -0,0 +1,34 @@
+package usage
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// CountingConn counts the bytes read from and written to a connection.
+type CountingConn struct {
+	io.ReadWriteCloser
+	read, written int64
+}
+
+// Count wraps rwc so the traffic going through it can be reported.
+func Count(rwc io.ReadWriteCloser) *CountingConn {
+	return &CountingConn{ReadWriteCloser: rwc}
+}
+
+func (c *CountingConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	atomic.AddInt64(&c.read, int64(n))
+	return n, err
+}
+
+func (c *CountingConn) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	atomic.AddInt64(&c.written, int64(n))
+	return n, err
+}
+
+// Bytes returns the total number of bytes transferred in both directions.
+func (c *CountingConn) Bytes() int64 {
+	return atomic.LoadInt64(&c.read) + atomic.LoadInt64(&c.written)
+}
@@ -0,0 +1,270 @@
+// Package usage collects tunnel usage events and reports them to the
+// details API in batches, off the connection accept path.
+package usage
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"teleportServer/auth"
+)
+
+// Event kinds.
+const (
+	TunnelCreated      = "tunnel_created"
+	ConnectionAccepted = "connection_accepted"
+	BytesTransferred   = "bytes_transferred"
+)
+
+// Sink delivers a batch of events to the backend. It returns how many
+// events at the start of the batch were delivered, all of them unless it
+// fails, so that a failed batch is resumed where it stopped instead of
+// being delivered twice.
+type Sink func(ctx context.Context, events []auth.UsageEvent) (int, error)
+
+// Options tune a Reporter. Zero values fall back to the defaults below.
+type Options struct {
+	QueueSize int           // events buffered in memory before spilling to disk
+	BatchSize int           // maximum events per flush
+	Interval  time.Duration // how often pending events are flushed
+	Backoff   auth.Backoff  // retries of a single flush
+	SpoolPath string        // where undeliverable events are kept, "" to disable
+}
+
+const (
+	defaultQueueSize = 4096
+	defaultBatchSize = 256
+	defaultInterval  = 5 * time.Second
+)
+
+// Stats are the reporter counters. Every recorded event ends up either
+// flushed, spooled (waiting on disk) or dropped.
+type Stats struct {
+	Recorded uint64 `json:"recorded"`
+	Flushed  uint64 `json:"flushed"`
+	Spooled  uint64 `json:"spooled"`
+	Replayed uint64 `json:"replayed"`
+	Dropped  uint64 `json:"dropped"`
+	Failures uint64 `json:"failures"`
+}
+
+// Reporter queues usage events and flushes them in the background.
+type Reporter struct {
+	sink  Sink
+	opts  Options
+	queue chan auth.UsageEvent
+	spool *spool
+
+	recorded, flushed, spooled, replayed, dropped, failures uint64
+
+	// closeMu makes sure nothing is queued once the loop has drained
+	closeMu   sync.RWMutex
+	closed    bool
+	closeOnce sync.Once
+	done      chan struct{}
+	stopped   chan struct{}
+}
+
+// NewReporter starts a reporter delivering to sink.
+func NewReporter(sink Sink, opts Options) *Reporter {
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = defaultQueueSize
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultBatchSize
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = defaultInterval
+	}
+	if opts.Backoff.Attempts <= 0 {
+		opts.Backoff = auth.DefaultBackoff
+	}
+
+	r := &Reporter{
+		sink:    sink,
+		opts:    opts,
+		queue:   make(chan auth.UsageEvent, opts.QueueSize),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	if opts.SpoolPath != "" {
+		r.spool = &spool{path: opts.SpoolPath}
+	}
+	go r.loop()
+	return r
+}
+
+// Record queues an event. It never blocks: when the queue is full the event
+// goes straight to the spool file.
+func (r *Reporter) Record(e auth.UsageEvent) {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	atomic.AddUint64(&r.recorded, 1)
+
+	r.closeMu.RLock()
+	defer r.closeMu.RUnlock()
+	if r.closed {
+		r.spill([]auth.UsageEvent{e})
+		return
+	}
+
+	select {
+	case r.queue <- e:
+	default:
+		r.spill([]auth.UsageEvent{e})
+	}
+}
+
+// Stats returns a snapshot of the counters.
+func (r *Reporter) Stats() Stats {
+	return Stats{
+		Recorded: atomic.LoadUint64(&r.recorded),
+		Flushed:  atomic.LoadUint64(&r.flushed),
+		Spooled:  atomic.LoadUint64(&r.spooled),
+		Replayed: atomic.LoadUint64(&r.replayed),
+		Dropped:  atomic.LoadUint64(&r.dropped),
+		Failures: atomic.LoadUint64(&r.failures),
+	}
+}
+
+// Close flushes whatever is still queued and stops the reporter.
+func (r *Reporter) Close() error {
+	r.closeOnce.Do(func() {
+		r.closeMu.Lock()
+		r.closed = true
+		r.closeMu.Unlock()
+		close(r.done)
+		<-r.stopped
+	})
+	return nil
+}
+
+func (r *Reporter) loop() {
+	defer close(r.stopped)
+
+	ticker := time.NewTicker(r.opts.Interval)
+	defer ticker.Stop()
+
+	batch := make([]auth.UsageEvent, 0, r.opts.BatchSize)
+	for {
+		select {
+		case e := <-r.queue:
+			batch = append(batch, e)
+			if len(batch) >= r.opts.BatchSize {
+				r.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			r.replay()
+			if len(batch) > 0 {
+				r.flush(batch)
+				batch = batch[:0]
+			}
+		case <-r.done:
+			r.drain(batch)
+			return
+		}
+	}
+}
+
+// drain flushes the batch in progress and everything left in the queue.
+func (r *Reporter) drain(batch []auth.UsageEvent) {
+	for {
+		select {
+		case e := <-r.queue:
+			batch = append(batch, e)
+		default:
+			for len(batch) > 0 {
+				n := len(batch)
+				if n > r.opts.BatchSize {
+					n = r.opts.BatchSize
+				}
+				r.flush(batch[:n])
+				batch = batch[n:]
+			}
+			return
+		}
+	}
+}
+
+// flush sends batch with retries, spilling it to disk if the backend stays
+// unreachable.
+func (r *Reporter) flush(batch []auth.UsageEvent) {
+	sent, err := r.send(batch)
+	atomic.AddUint64(&r.flushed, uint64(sent))
+	if err != nil {
+		log.Println("--------- usage flush failed:", err)
+		r.spill(batch[sent:])
+	}
+}
+
+// send delivers batch with retries, each picking up after the events
+// already delivered, and returns how many were.
+func (r *Reporter) send(batch []auth.UsageEvent) (int, error) {
+	sent := 0
+	err := r.opts.Backoff.Retry(context.Background(), func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		n, err := r.sink(ctx, batch[sent:])
+		sent += n
+		return err
+	})
+	if err != nil {
+		atomic.AddUint64(&r.failures, 1)
+	}
+	return sent, err
+}
+
+// replay sends spooled events back to the backend once it is reachable.
+func (r *Reporter) replay() {
+	if r.spool == nil {
+		return
+	}
+	events, bad, err := r.spool.take()
+	if err != nil {
+		log.Println("--------- usage spool read failed:", err)
+		return
+	}
+	if bad > 0 {
+		log.Printf("--------- usage: dropping %d undecodable spooled events", bad)
+		atomic.AddUint64(&r.dropped, uint64(bad))
+	}
+	for len(events) > 0 {
+		n := len(events)
+		if n > r.opts.BatchSize {
+			n = r.opts.BatchSize
+		}
+		sent, err := r.send(events[:n])
+		atomic.AddUint64(&r.replayed, uint64(sent))
+		atomic.AddUint64(&r.flushed, uint64(sent))
+		events = events[sent:]
+		if err != nil {
+			// still down, put the rest back for the next tick
+			if err := r.spool.append(events); err != nil {
+				log.Println("--------- usage spool write failed:", err)
+				atomic.AddUint64(&r.dropped, uint64(len(events)))
+			}
+			return
+		}
+	}
+}
+
+// spill keeps events on disk, or counts them as dropped if that is not
+// possible either.
+func (r *Reporter) spill(events []auth.UsageEvent) {
+	if r.spool == nil {
+		log.Printf("--------- usage: dropping %d events, no spool configured", len(events))
+		atomic.AddUint64(&r.dropped, uint64(len(events)))
+		return
+	}
+	if err := r.spool.append(events); err != nil {
+		log.Println("--------- usage spool write failed:", err)
+		atomic.AddUint64(&r.dropped, uint64(len(events)))
+		return
+	}
+	atomic.AddUint64(&r.spooled, uint64(len(events)))
+}
@@ -0,0 +1,174 @@
+package usage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"teleportServer/auth"
+)
+
+// fakeSink records delivered batches and fails while down is set.
+type fakeSink struct {
+	sync.Mutex
+	down    bool
+	batches [][]auth.UsageEvent
+}
+
+func (s *fakeSink) send(ctx context.Context, events []auth.UsageEvent) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.down {
+		return 0, &auth.UnreachableError{Op: "usage", Err: errors.New("connection refused")}
+	}
+	s.batches = append(s.batches, append([]auth.UsageEvent(nil), events...))
+	return len(events), nil
+}
+
+func (s *fakeSink) setDown(down bool) {
+	s.Lock()
+	s.down = down
+	s.Unlock()
+}
+
+func (s *fakeSink) delivered() int {
+	s.Lock()
+	defer s.Unlock()
+	n := 0
+	for _, b := range s.batches {
+		n += len(b)
+	}
+	return n
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestReporterBatches(t *testing.T) {
+	sink := &fakeSink{}
+	r := NewReporter(sink.send, Options{BatchSize: 10, Interval: time.Hour})
+
+	for i := 0; i < 25; i++ {
+		r.Record(auth.UsageEvent{Kind: ConnectionAccepted, UserName: "alice"})
+	}
+	waitFor(t, func() bool { return sink.delivered() == 20 })
+	r.Close()
+
+	if got := sink.delivered(); got != 25 {
+		t.Fatalf("expected 25 events after close, got %d", got)
+	}
+	if len(sink.batches) != 3 {
+		t.Fatalf("expected 3 batches, got %d", len(sink.batches))
+	}
+	stats := r.Stats()
+	if stats.Recorded != 25 || stats.Flushed != 25 || stats.Dropped != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestReporterSpoolsWhileBackendIsDown(t *testing.T) {
+	sink := &fakeSink{down: true}
+	spoolPath := filepath.Join(t.TempDir(), "spool.jsonl")
+	r := NewReporter(sink.send, Options{
+		Interval:  10 * time.Millisecond,
+		Backoff:   auth.Backoff{Attempts: 2, Initial: time.Millisecond, Max: time.Millisecond},
+		SpoolPath: spoolPath,
+	})
+	defer r.Close()
+
+	for i := 0; i < 5; i++ {
+		r.Record(auth.UsageEvent{Kind: BytesTransferred, Bytes: 100})
+	}
+	waitFor(t, func() bool { return r.Stats().Spooled == 5 })
+	if sink.delivered() != 0 {
+		t.Fatal("nothing should be delivered while the backend is down")
+	}
+
+	sink.setDown(false)
+	waitFor(t, func() bool { return sink.delivered() == 5 })
+
+	stats := r.Stats()
+	if stats.Replayed != 5 || stats.Flushed != 5 || stats.Dropped != 0 || stats.Failures == 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestReporterCountsDropsWithoutSpool(t *testing.T) {
+	sink := &fakeSink{down: true}
+	r := NewReporter(sink.send, Options{Interval: time.Hour, Backoff: auth.Backoff{Attempts: 1}})
+
+	r.Record(auth.UsageEvent{Kind: TunnelCreated})
+	r.Close()
+
+	if stats := r.Stats(); stats.Recorded != 1 || stats.Dropped != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestReporterResumesPartialBatches(t *testing.T) {
+	var mu sync.Mutex
+	var delivered []string
+	failed := false
+	// delivers two events, then fails once
+	sink := func(ctx context.Context, events []auth.UsageEvent) (int, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		for i, e := range events {
+			if len(delivered) == 2 && !failed {
+				failed = true
+				return i, &auth.UnreachableError{Op: "increment", Err: errors.New("connection reset")}
+			}
+			delivered = append(delivered, e.Url)
+		}
+		return len(events), nil
+	}
+	r := NewReporter(sink, Options{BatchSize: 5, Interval: time.Hour, Backoff: auth.Backoff{Attempts: 2}})
+	for _, url := range []string{"a", "b", "c", "d", "e"} {
+		r.Record(auth.UsageEvent{Kind: ConnectionAccepted, Url: url})
+	}
+	r.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(delivered, "") != "abcde" {
+		t.Fatalf("expected every event delivered once, got %q", delivered)
+	}
+	if stats := r.Stats(); stats.Flushed != 5 || stats.Failures != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestReporterSkipsCorruptSpoolLines(t *testing.T) {
+	spoolPath := filepath.Join(t.TempDir(), "spool.jsonl")
+	// a garbled line, and a last one cut short by a crash mid-append
+	corrupt := `{"kind":"connection_accepted","url":"a"}` + "\n" +
+		"\x00\x00garbage\n" +
+		`{"kind":"connection_accepted","url":"b"}` + "\n" +
+		`{"kind":"connection_acc`
+	if err := os.WriteFile(spoolPath, []byte(corrupt), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	sink := &fakeSink{}
+	r := NewReporter(sink.send, Options{Interval: 10 * time.Millisecond, SpoolPath: spoolPath})
+	defer r.Close()
+
+	waitFor(t, func() bool { return sink.delivered() == 2 })
+	waitFor(t, func() bool { return r.Stats().Dropped == 2 })
+	if _, err := os.Stat(spoolPath); !os.IsNotExist(err) {
+		t.Fatalf("expected the spool to be consumed, got %v", err)
+	}
+}
@@ -0,0 +1,81 @@
+package usage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+
+	"teleportServer/auth"
+)
+
+// spool keeps undelivered events on disk as JSON lines so they survive a
+// backend outage or a restart.
+type spool struct {
+	mu   sync.Mutex
+	path string
+}
+
+// append writes events at the end of the spool file.
+func (s *spool) append(events []auth.UsageEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, e := range events {
+		if err := enc.Encode(e); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// take reads and removes every spooled event. Lines that do not decode,
+// such as one cut short by a crash in the middle of an append, are skipped
+// and counted in bad, so that they cannot hold up the rest of the spool.
+func (s *spool) take() (events []auth.UsageEvent, bad int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	br := bufio.NewReader(f)
+	for {
+		line, readErr := br.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			var e auth.UsageEvent
+			if err := json.Unmarshal(line, &e); err != nil {
+				bad++
+			} else {
+				events = append(events, e)
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			f.Close()
+			return nil, 0, readErr
+		}
+	}
+	f.Close()
+	return events, bad, os.Remove(s.path)
+}